@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// FutureInstallment is an installment of a purchase that was not charged yet
+type FutureInstallment struct {
+	PurchaseID    string  `json:"purchaseId"`
+	Description   string  `json:"description"`
+	Merchant      string  `json:"merchant,omitempty"`
+	Installment   int     `json:"installment"`
+	Installments  int     `json:"installments"`
+	Amount        float64 `json:"amount"`
+	PurchaseTotal float64 `json:"purchaseTotal"`
+	Currency      string  `json:"currency"` // Of Amount and PurchaseTotal, as charged
+}
+
+// InstallmentMonth sums the installments due in one month
+type InstallmentMonth struct {
+	Month        string              `json:"month"`
+	Year         int                 `json:"year"`
+	Total        float64             `json:"total"`
+	Currency     string              `json:"currency"` // Of Total, the base currency
+	Installments []FutureInstallment `json:"installments"`
+	// Unconverted lists the currencies without an exchange rate to Currency,
+	// whose installments are listed but left out of Total
+	Unconverted []string `json:"unconverted,omitempty"`
+}
+
+// installmentPurchase is the latest installment imported of a purchase
+type installmentPurchase struct {
+	PurchaseID    string    `bson:"_id"`
+	Description   string    `bson:"description"`
+	Merchant      string    `bson:"merchant"`
+	Date          time.Time `bson:"date"`
+	Amount        float64   `bson:"amount"`
+	Installment   int       `bson:"installment"`
+	Installments  int       `bson:"installments"`
+	PurchaseTotal float64   `bson:"purchaseTotal"`
+	Currency      string    `bson:"currency"`
+}
+
+// getFutureInstallmentsHandler projects the installments of the user's
+// purchases that are still to be charged, one month after the other from the
+// latest installment imported, and sums them per month. Months before the
+// current one are left out, their installments were charged already even if
+// that statement was not imported. Totals are converted to the base currency
+// with the latest rate, as the installments are still to be charged.
+func getFutureInstallmentsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	currency, ok := baseCurrency(ctx, r, userID)
+	if !ok {
+		http.Error(w, "Currency must be an ISO 4217 code such as BRL or USD", http.StatusBadRequest)
+		return
+	}
+
+	rates, err := loadRateTable(ctx)
+	if err != nil {
+		log.Printf("Error loading exchange rates: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	pipeline := mongo.Pipeline{
+		bson.D{
+			{Key: "$match", Value: bson.D{
+				{Key: "userId", Value: userID},
+				{Key: "purchaseId", Value: bson.D{{Key: "$exists", Value: true}}},
+				{Key: "type", Value: "debit"},
+				{Key: "duplicateStatus", Value: notMerged},
+			}},
+		},
+		// Keep the latest installment of every purchase
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "installment", Value: -1}, {Key: "date", Value: -1}}}},
+		bson.D{
+			{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: "$purchaseId"},
+				{Key: "description", Value: bson.D{{Key: "$first", Value: "$description"}}},
+				{Key: "merchant", Value: bson.D{{Key: "$first", Value: "$merchant"}}},
+				{Key: "date", Value: bson.D{{Key: "$first", Value: "$date"}}},
+				{Key: "amount", Value: bson.D{{Key: "$first", Value: "$amount"}}},
+				{Key: "installment", Value: bson.D{{Key: "$first", Value: "$installment"}}},
+				{Key: "installments", Value: bson.D{{Key: "$first", Value: "$installments"}}},
+				{Key: "purchaseTotal", Value: bson.D{{Key: "$first", Value: "$purchaseTotal"}}},
+				{Key: "currency", Value: bson.D{{Key: "$first", Value: transactionCurrency}}},
+			}},
+		},
+		bson.D{{Key: "$match", Value: bson.D{
+			{Key: "$expr", Value: bson.D{{Key: "$lt", Value: bson.A{"$installment", "$installments"}}}},
+		}}},
+	}
+
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		log.Printf("Error in installment aggregation: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	var purchases []installmentPurchase
+	if err := cursor.All(ctx, &purchases); err != nil {
+		log.Printf("Error parsing installment results: %v", err)
+		http.Error(w, "Error parsing results", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	currentMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	months := make(map[time.Time]*InstallmentMonth)
+	for _, p := range purchases {
+		charged := time.Date(p.Date.Year(), p.Date.Month(), 1, 0, 0, 0, 0, time.UTC)
+		for n := p.Installment + 1; n <= p.Installments; n++ {
+			due := charged.AddDate(0, n-p.Installment, 0)
+			if due.Before(currentMonth) {
+				continue
+			}
+			month, ok := months[due]
+			if !ok {
+				month = &InstallmentMonth{Month: due.Month().String(), Year: due.Year(), Currency: currency, Installments: []FutureInstallment{}}
+				months[due] = month
+			}
+			if amount, _, ok := rates.convert(p.Amount, p.Currency, currency, due); ok {
+				month.Total += amount
+			} else if !containsCurrency(month.Unconverted, p.Currency) {
+				month.Unconverted = append(month.Unconverted, p.Currency)
+			}
+			month.Installments = append(month.Installments, FutureInstallment{
+				PurchaseID:    p.PurchaseID,
+				Description:   p.Description,
+				Merchant:      p.Merchant,
+				Installment:   n,
+				Installments:  p.Installments,
+				Amount:        p.Amount,
+				PurchaseTotal: p.PurchaseTotal,
+				Currency:      p.Currency,
+			})
+		}
+	}
+
+	keys := make([]time.Time, 0, len(months))
+	for key := range months {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Before(keys[j]) })
+
+	// An optional limit on the months returned, counted from the current one
+	if monthsParam := r.URL.Query().Get("months"); monthsParam != "" {
+		if val, err := strconv.Atoi(monthsParam); err == nil && val > 0 {
+			last := currentMonth.AddDate(0, val, 0)
+			for len(keys) > 0 && !keys[len(keys)-1].Before(last) {
+				keys = keys[:len(keys)-1]
+			}
+		}
+	}
+
+	result := make([]InstallmentMonth, 0, len(keys))
+	for _, key := range keys {
+		month := months[key]
+		month.Total = math.Round(month.Total*100) / 100
+		sort.Strings(month.Unconverted)
+		result = append(result, *month)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// containsCurrency reports whether code is one of currencies
+func containsCurrency(currencies []string, code string) bool {
+	for _, c := range currencies {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
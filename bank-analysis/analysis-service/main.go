@@ -4,8 +4,10 @@ import (
 	"context"
 	"encoding/json"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"time"
 
@@ -23,12 +25,34 @@ type Transaction struct {
 	Date        time.Time          `json:"date" bson:"date"`
 	Description string             `json:"description" bson:"description"`
 	Category    string             `json:"category" bson:"category"`
+	// CategoryConfidence is set when the category was applied from a
+	// suggestion, see CategorySuggestion
+	CategoryConfidence float64 `json:"categoryConfidence,omitempty" bson:"categoryConfidence,omitempty"`
+	// CategoryManual is set once the user picked the category, which keeps
+	// the import service's category rules from changing it
+	CategoryManual bool `json:"categoryManual,omitempty" bson:"categoryManual,omitempty"`
 	Amount      float64            `json:"amount" bson:"amount"`
 	Type        string             `json:"type" bson:"type"` // "credit" or "debit"
 	Source      string             `json:"source" bson:"source"`
+	Merchant    string             `json:"merchant,omitempty" bson:"merchant,omitempty"` // Merchant or counterparty recognized in the description
+	Method      string             `json:"method,omitempty" bson:"method,omitempty"`     // "pix", "ted", "doc", "boleto", "debit" or "credit"
+	// Installment purchases: the number of this installment, how many the
+	// purchase was split into, the ID they share and the purchase's value
+	Installment   int     `json:"installment,omitempty" bson:"installment,omitempty"`
+	Installments  int     `json:"installments,omitempty" bson:"installments,omitempty"`
+	PurchaseID    string  `json:"purchaseId,omitempty" bson:"purchaseId,omitempty"`
+	PurchaseTotal float64 `json:"purchaseTotal,omitempty" bson:"purchaseTotal,omitempty"`
+	// Currency is the ISO 4217 code of Amount; empty for transactions imported
+	// before currencies were recorded, which are in defaultCurrency
+	Currency string `json:"currency,omitempty" bson:"currency,omitempty"`
+	// DuplicateStatus is "pending" while the import service suspects the
+	// transaction was also imported from another statement, and "merged" once
+	// it was merged into that other transaction
+	DuplicateStatus string `json:"duplicateStatus,omitempty" bson:"duplicateStatus,omitempty"`
 }
 
-// MonthlySpending represents monthly spending aggregation
+// MonthlySpending represents monthly spending aggregation. Amounts are
+// converted to Currency, the user's base currency.
 type MonthlySpending struct {
 	Month            string             `json:"month"`
 	Year             int                `json:"year"`
@@ -36,8 +60,33 @@ type MonthlySpending struct {
 	TotalExpenses    float64            `json:"totalExpenses"`
 	NetCashflow      float64            `json:"netCashflow"`
 	CategoryBreakdown map[string]float64 `json:"categoryBreakdown"`
+	// PendingDuplicates is the part of the totals that may be counted twice,
+	// from transactions waiting in the import duplicate review queue
+	PendingDuplicates float64 `json:"pendingDuplicates"`
+	Currency          string  `json:"currency"`
+	// Currencies breaks the month down by the currency of its transactions
+	Currencies map[string]CurrencyTotals `json:"currencies"`
+	// Unconverted lists the currencies without an exchange rate to Currency,
+	// whose transactions are left out of the converted totals
+	Unconverted []string `json:"unconverted,omitempty"`
+	// RatesOutOfRange lists the currencies converted with a rate far from
+	// the transactions' days, see appliedRate
+	RatesOutOfRange []string `json:"ratesOutOfRange,omitempty"`
 }
 
+// CurrencyTotals sums a month's transactions in one currency, in that
+// currency and converted to the base currency
+type CurrencyTotals struct {
+	TotalIncome       float64 `json:"totalIncome"`
+	TotalExpenses     float64 `json:"totalExpenses"`
+	ConvertedIncome   float64 `json:"convertedIncome"`
+	ConvertedExpenses float64 `json:"convertedExpenses"`
+	Converted         bool    `json:"converted"` // Unset when some of the transactions had no exchange rate
+}
+
+// notMerged excludes transactions merged into a duplicate from every result
+var notMerged = bson.M{"$ne": "merged"}
+
 // TransactionList represents a paginated list of transactions
 type TransactionList struct {
 	Total        int           `json:"total"`
@@ -65,6 +114,35 @@ func main() {
 
 	collection = client.Database("bank_analysis").Collection("transactions")
 
+	suggestionSettingsCollection = client.Database("bank_analysis").Collection("category_suggestion_settings")
+	_, err = suggestionSettingsCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "userId", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Printf("Warning: Failed to create suggestion settings indexes: %v", err)
+	}
+	go autoApplySuggestions()
+
+	rateCollection = client.Database("bank_analysis").Collection("exchange_rates")
+	_, err = rateCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "from", Value: 1}, {Key: "to", Value: 1}, {Key: "date", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Printf("Warning: Failed to create exchange rate indexes: %v", err)
+	}
+	go watchRatesFile()
+
+	currencySettingsCollection = client.Database("bank_analysis").Collection("currency_settings")
+	_, err = currencySettingsCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "userId", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Printf("Warning: Failed to create currency settings indexes: %v", err)
+	}
+
 	// HTTP server
 	router := mux.NewRouter()
 
@@ -82,10 +160,24 @@ func main() {
 	// IMPORTANT: The routes must match exactly what the API gateway is forwarding
 	// Main routes - notice these are explicitly defined
 	router.HandleFunc("/monthly", getMonthlyAnalysisHandler).Methods("GET")
+	router.HandleFunc("/merchants", getMerchantAnalysisHandler).Methods("GET")
+	router.HandleFunc("/installments", getFutureInstallmentsHandler).Methods("GET")
 	router.HandleFunc("/transactions", getTransactionsHandler).Methods("GET")
 	router.HandleFunc("/transactions/search", searchTransactionsHandler).Methods("GET")
 	router.HandleFunc("/categories", updateCategoryHandler).Methods("PUT")
 
+	// Categories learned from the transactions the user already categorized
+	router.HandleFunc("/suggestions", getSuggestionsHandler).Methods("GET")
+	router.HandleFunc("/suggestions/apply", applySuggestionsHandler).Methods("POST")
+	router.HandleFunc("/suggestions/settings", getSuggestionSettingsHandler).Methods("GET")
+	router.HandleFunc("/suggestions/settings", updateSuggestionSettingsHandler).Methods("PUT")
+
+	// Exchange rates and the currency amounts are converted to
+	router.HandleFunc("/rates", getRatesHandler).Methods("GET")
+	router.HandleFunc("/convert", convertHandler).Methods("POST")
+	router.HandleFunc("/currency", getCurrencySettingsHandler).Methods("GET")
+	router.HandleFunc("/currency", updateCurrencySettingsHandler).Methods("PUT")
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8083"
@@ -140,7 +232,7 @@ func getTransactionsHandler(w http.ResponseWriter, r *http.Request) {
 	defer cancel()
 
 	// Build filter
-	filter := bson.M{"userId": userID}
+	filter := bson.M{"userId": userID, "duplicateStatus": notMerged}
 	if len(dateFilter) > 0 {
 		filter["date"] = dateFilter
 	}
@@ -203,6 +295,7 @@ func searchTransactionsHandler(w http.ResponseWriter, r *http.Request) {
 	// Create search filter
 	filter := bson.M{
 		"userId": userID,
+		"duplicateStatus": notMerged,
 		"$or": []bson.M{
 			{"description": bson.M{"$regex": query, "$options": "i"}}, // Case-insensitive search
 			{"category": bson.M{"$regex": query, "$options": "i"}},
@@ -289,8 +382,10 @@ func updateCategoryHandler(w http.ResponseWriter, r *http.Request) {
 		"userId": userID, // Ensure user can only update their own transactions
 	}
 	
+	// Mark the category as picked by hand so category rules leave it alone
 	update := bson.M{
-		"$set": bson.M{"category": req.Category},
+		"$set":   bson.M{"category": req.Category, "categoryManual": true},
+		"$unset": bson.M{"categoryRuleId": "", "categoryConfidence": ""},
 	}
 	
 	result, err := collection.UpdateMany(ctx, filter, update)
@@ -348,7 +443,20 @@ func getMonthlyAnalysisHandler(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	// Group by year and month - using proper MongoDB pipeline syntax
+	currency, ok := baseCurrency(ctx, r, userID)
+	if !ok {
+		http.Error(w, "Currency must be an ISO 4217 code such as BRL or USD", http.StatusBadRequest)
+		return
+	}
+
+	rates, err := loadRateTable(ctx)
+	if err != nil {
+		log.Printf("Error loading exchange rates: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Group by day, category and currency - each day is converted with its own rate
 	pipeline := mongo.Pipeline{
 		// Match user's transactions within date range
 		bson.D{
@@ -358,15 +466,17 @@ func getMonthlyAnalysisHandler(w http.ResponseWriter, r *http.Request) {
 					{Key: "$gte", Value: start},
 					{Key: "$lte", Value: end},
 				}},
+				{Key: "duplicateStatus", Value: notMerged},
 			}},
 		},
-		// Group by year, month, and category
 		bson.D{
 			{Key: "$group", Value: bson.D{
 				{Key: "_id", Value: bson.D{
 					{Key: "year", Value: bson.D{{Key: "$year", Value: "$date"}}},
 					{Key: "month", Value: bson.D{{Key: "$month", Value: "$date"}}},
+					{Key: "day", Value: bson.D{{Key: "$dayOfMonth", Value: "$date"}}},
 					{Key: "category", Value: "$category"},
+					{Key: "currency", Value: transactionCurrency},
 				}},
 				{Key: "totalAmount", Value: bson.D{
 					{Key: "$sum", Value: bson.D{
@@ -377,35 +487,11 @@ func getMonthlyAnalysisHandler(w http.ResponseWriter, r *http.Request) {
 						}},
 					}},
 				}},
-			}},
-		},
-		// Group by year and month to get category breakdown
-		bson.D{
-			{Key: "$group", Value: bson.D{
-				{Key: "_id", Value: bson.D{
-					{Key: "year", Value: "$_id.year"},
-					{Key: "month", Value: "$_id.month"},
-				}},
-				{Key: "categories", Value: bson.D{
-					{Key: "$push", Value: bson.D{
-						{Key: "category", Value: "$_id.category"},
-						{Key: "amount", Value: "$totalAmount"},
-					}},
-				}},
-				{Key: "totalIncome", Value: bson.D{
-					{Key: "$sum", Value: bson.D{
-						{Key: "$cond", Value: bson.A{
-							bson.D{{Key: "$gt", Value: bson.A{"$totalAmount", 0}}},
-							"$totalAmount",
-							0,
-						}},
-					}},
-				}},
-				{Key: "totalExpenses", Value: bson.D{
+				{Key: "pendingDuplicates", Value: bson.D{
 					{Key: "$sum", Value: bson.D{
 						{Key: "$cond", Value: bson.A{
-							bson.D{{Key: "$lt", Value: bson.A{"$totalAmount", 0}}},
-							bson.D{{Key: "$abs", Value: "$totalAmount"}},
+							bson.D{{Key: "$eq", Value: bson.A{"$duplicateStatus", "pending"}}},
+							"$amount",
 							0,
 						}},
 					}},
@@ -430,52 +516,153 @@ func getMonthlyAnalysisHandler(w http.ResponseWriter, r *http.Request) {
 	defer cursor.Close(ctx)
 
 	// Process results
-	var results []bson.M
+	var results []monthlyGroup
 	if err := cursor.All(ctx, &results); err != nil {
 		log.Printf("Error parsing aggregation results: %v", err)
 		http.Error(w, "Error parsing results", http.StatusInternalServerError)
 		return
 	}
 
+	monthlySpending := summarizeMonths(results, rates, currency)
+
+	log.Printf("Returning %d months of analysis data", len(monthlySpending))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(monthlySpending)
+}
+
+// monthlyGroup sums the user's transactions of one day, category and currency
+type monthlyGroup struct {
+	ID struct {
+		Year     int    `bson:"year"`
+		Month    int    `bson:"month"`
+		Day      int    `bson:"day"`
+		Category string `bson:"category"`
+		Currency string `bson:"currency"`
+	} `bson:"_id"`
+	TotalAmount       float64 `bson:"totalAmount"`
+	PendingDuplicates float64 `bson:"pendingDuplicates"`
+}
+
+// summarizeMonths converts the groups to the base currency and sums them per
+// month. As before currencies were recorded, a category counts as income when
+// its net amount in the month is positive and as expense otherwise, both for
+// the converted totals and for the original ones of each currency. Groups
+// without an exchange rate are left out of the converted totals and their
+// currency is reported in Unconverted, those converted with a stale rate in
+// RatesOutOfRange.
+func summarizeMonths(groups []monthlyGroup, rates *rateTable, currency string) []MonthlySpending {
 	// Convert to MonthlySpending format
 	monthNames := []string{
 		"January", "February", "March", "April", "May", "June",
 		"July", "August", "September", "October", "November", "December",
 	}
 
-	var monthlySpending []MonthlySpending
-	for _, result := range results {
-		id := result["_id"].(bson.M)
-		year := id["year"].(int32)
-		month := id["month"].(int32)
-		
-		// Create category breakdown map
-		categoryBreakdown := make(map[string]float64)
-		categories := result["categories"].(bson.A)
-		for _, cat := range categories {
-			category := cat.(bson.M)
-			categoryBreakdown[category["category"].(string)] = category["amount"].(float64)
+	type categoryNet struct {
+		original, converted float64
+		convertible         bool
+	}
+	type month struct {
+		spending   MonthlySpending
+		categories map[string]float64                 // Converted net amount per category
+		currencies map[string]map[string]*categoryNet // Net amounts per currency and category
+	}
+
+	var months []*month
+	for _, g := range groups {
+		if len(months) == 0 || months[len(months)-1].spending.Year != g.ID.Year || months[len(months)-1].spending.Month != monthNames[g.ID.Month-1] {
+			months = append(months, &month{
+				spending: MonthlySpending{
+					Month:    monthNames[g.ID.Month-1],
+					Year:     g.ID.Year,
+					Currency: currency,
+				},
+				categories: make(map[string]float64),
+				currencies: make(map[string]map[string]*categoryNet),
+			})
 		}
-		
-		// Calculate net cashflow
-		totalIncome := result["totalIncome"].(float64)
-		totalExpenses := result["totalExpenses"].(float64)
-		netCashflow := totalIncome - totalExpenses
-		
-		// Create monthly spending object
-		spending := MonthlySpending{
-			Month:            monthNames[month-1],
-			Year:             int(year),
-			TotalIncome:      totalIncome,
-			TotalExpenses:    totalExpenses,
-			NetCashflow:      netCashflow,
-			CategoryBreakdown: categoryBreakdown,
+		m := months[len(months)-1]
+
+		nets, ok := m.currencies[g.ID.Currency]
+		if !ok {
+			nets = make(map[string]*categoryNet)
+			m.currencies[g.ID.Currency] = nets
+		}
+		net, ok := nets[g.ID.Category]
+		if !ok {
+			net = &categoryNet{convertible: true}
+			nets[g.ID.Category] = net
+		}
+		net.original += g.TotalAmount
+
+		date := time.Date(g.ID.Year, time.Month(g.ID.Month), g.ID.Day, 0, 0, 0, 0, time.UTC)
+		amount, rate, ok := rates.convert(g.TotalAmount, g.ID.Currency, currency, date)
+		if !ok {
+			net.convertible = false
+			continue
 		}
-		
+		if rate.OutOfRange && !containsCurrency(m.spending.RatesOutOfRange, g.ID.Currency) {
+			m.spending.RatesOutOfRange = append(m.spending.RatesOutOfRange, g.ID.Currency)
+		}
+		net.converted += amount
+		m.categories[g.ID.Category] += amount
+		pending, _, _ := rates.convert(g.PendingDuplicates, g.ID.Currency, currency, date)
+		m.spending.PendingDuplicates += pending
+	}
+
+	monthlySpending := make([]MonthlySpending, 0, len(months))
+	for _, m := range months {
+		spending := m.spending
+		spending.CategoryBreakdown = make(map[string]float64)
+		for category, amount := range m.categories {
+			amount = roundCents(amount)
+			spending.CategoryBreakdown[category] = amount
+			if amount > 0 {
+				spending.TotalIncome += amount
+			} else {
+				spending.TotalExpenses -= amount
+			}
+		}
+		spending.TotalIncome = roundCents(spending.TotalIncome)
+		spending.TotalExpenses = roundCents(spending.TotalExpenses)
+		spending.NetCashflow = roundCents(spending.TotalIncome - spending.TotalExpenses)
+		spending.PendingDuplicates = roundCents(spending.PendingDuplicates)
+
+		spending.Currencies = make(map[string]CurrencyTotals)
+		for code, nets := range m.currencies {
+			totals := CurrencyTotals{Converted: true}
+			for _, net := range nets {
+				if net.original > 0 {
+					totals.TotalIncome += net.original
+				} else {
+					totals.TotalExpenses -= net.original
+				}
+				if !net.convertible {
+					totals.Converted = false
+				}
+				if net.converted > 0 {
+					totals.ConvertedIncome += net.converted
+				} else {
+					totals.ConvertedExpenses -= net.converted
+				}
+			}
+			totals.TotalIncome = roundCents(totals.TotalIncome)
+			totals.TotalExpenses = roundCents(totals.TotalExpenses)
+			totals.ConvertedIncome = roundCents(totals.ConvertedIncome)
+			totals.ConvertedExpenses = roundCents(totals.ConvertedExpenses)
+			spending.Currencies[code] = totals
+			if !totals.Converted {
+				spending.Unconverted = append(spending.Unconverted, code)
+			}
+		}
+		sort.Strings(spending.Unconverted)
+		sort.Strings(spending.RatesOutOfRange)
+
 		monthlySpending = append(monthlySpending, spending)
 	}
-	
-	log.Printf("Returning %d months of analysis data", len(monthlySpending))
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(monthlySpending)
-}
\ No newline at end of file
+	return monthlySpending
+}
+
+// roundCents rounds an amount to cents, dropping the noise of adding converted amounts
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
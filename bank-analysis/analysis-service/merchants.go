@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// MerchantSpending sums the transactions with one merchant or counterparty,
+// converted to the base currency
+type MerchantSpending struct {
+	Merchant      string    `json:"merchant"`
+	TotalExpenses float64   `json:"totalExpenses"`
+	TotalIncome   float64   `json:"totalIncome"`
+	Count         int       `json:"count"`
+	LastDate      time.Time `json:"lastDate"`
+	Currency      string    `json:"currency"`
+	// Unconverted lists the currencies without an exchange rate to Currency,
+	// whose transactions are left out of the totals but still counted
+	Unconverted []string `json:"unconverted,omitempty"`
+	// RatesOutOfRange lists the currencies converted with a rate far from
+	// the transactions' days, see appliedRate
+	RatesOutOfRange []string `json:"ratesOutOfRange,omitempty"`
+}
+
+// merchantGroup sums the transactions with a merchant of one day and currency
+type merchantGroup struct {
+	ID struct {
+		Merchant string `bson:"merchant"`
+		Year     int    `bson:"year"`
+		Month    int    `bson:"month"`
+		Day      int    `bson:"day"`
+		Currency string `bson:"currency"`
+	} `bson:"_id"`
+	TotalExpenses float64   `bson:"totalExpenses"`
+	TotalIncome   float64   `bson:"totalIncome"`
+	Count         int       `bson:"count"`
+	LastDate      time.Time `bson:"lastDate"`
+}
+
+// getMerchantAnalysisHandler groups the user's transactions by merchant, the
+// largest expenses first. Transactions imported before merchants were
+// recognized are grouped by their description. Amounts are converted to the
+// base currency with the rate of their day.
+func getMerchantAnalysisHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	// Default to last 6 months if not specified
+	start := time.Now().AddDate(0, -6, 0)
+	end := time.Now()
+	if parsedStart, err := time.Parse("2006-01-02", r.URL.Query().Get("start")); err == nil {
+		start = parsedStart
+	}
+	if parsedEnd, err := time.Parse("2006-01-02", r.URL.Query().Get("end")); err == nil {
+		end = parsedEnd
+	}
+
+	limit := 50 // Default limit
+	if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+		if val, err := strconv.Atoi(limitParam); err == nil && val > 0 {
+			limit = val
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	currency, ok := baseCurrency(ctx, r, userID)
+	if !ok {
+		http.Error(w, "Currency must be an ISO 4217 code such as BRL or USD", http.StatusBadRequest)
+		return
+	}
+
+	rates, err := loadRateTable(ctx)
+	if err != nil {
+		log.Printf("Error loading exchange rates: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Group by merchant, day and currency - each day is converted with its own rate
+	pipeline := mongo.Pipeline{
+		bson.D{
+			{Key: "$match", Value: bson.D{
+				{Key: "userId", Value: userID},
+				{Key: "date", Value: bson.D{
+					{Key: "$gte", Value: start},
+					{Key: "$lte", Value: end},
+				}},
+				{Key: "duplicateStatus", Value: notMerged},
+			}},
+		},
+		bson.D{
+			{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: bson.D{
+					{Key: "merchant", Value: bson.D{{Key: "$ifNull", Value: bson.A{"$merchant", "$description"}}}},
+					{Key: "year", Value: bson.D{{Key: "$year", Value: "$date"}}},
+					{Key: "month", Value: bson.D{{Key: "$month", Value: "$date"}}},
+					{Key: "day", Value: bson.D{{Key: "$dayOfMonth", Value: "$date"}}},
+					{Key: "currency", Value: transactionCurrency},
+				}},
+				{Key: "totalExpenses", Value: bson.D{
+					{Key: "$sum", Value: bson.D{
+						{Key: "$cond", Value: bson.A{
+							bson.D{{Key: "$eq", Value: bson.A{"$type", "debit"}}},
+							"$amount",
+							0,
+						}},
+					}},
+				}},
+				{Key: "totalIncome", Value: bson.D{
+					{Key: "$sum", Value: bson.D{
+						{Key: "$cond", Value: bson.A{
+							bson.D{{Key: "$eq", Value: bson.A{"$type", "credit"}}},
+							"$amount",
+							0,
+						}},
+					}},
+				}},
+				{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+				{Key: "lastDate", Value: bson.D{{Key: "$max", Value: "$date"}}},
+			}},
+		},
+	}
+
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		log.Printf("Error in merchant aggregation: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	var groups []merchantGroup
+	if err := cursor.All(ctx, &groups); err != nil {
+		log.Printf("Error parsing merchant results: %v", err)
+		http.Error(w, "Error parsing results", http.StatusInternalServerError)
+		return
+	}
+
+	merchants := summarizeMerchants(groups, rates, currency)
+	if len(merchants) > limit {
+		merchants = merchants[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(merchants)
+}
+
+// summarizeMerchants converts the groups to the base currency and sums them
+// per merchant, the largest expenses first
+func summarizeMerchants(groups []merchantGroup, rates *rateTable, currency string) []MerchantSpending {
+	merchants := []MerchantSpending{}
+	index := make(map[string]int)
+	for _, g := range groups {
+		i, ok := index[g.ID.Merchant]
+		if !ok {
+			i = len(merchants)
+			index[g.ID.Merchant] = i
+			merchants = append(merchants, MerchantSpending{Merchant: g.ID.Merchant, Currency: currency})
+		}
+		m := &merchants[i]
+
+		m.Count += g.Count
+		if g.LastDate.After(m.LastDate) {
+			m.LastDate = g.LastDate
+		}
+		date := time.Date(g.ID.Year, time.Month(g.ID.Month), g.ID.Day, 0, 0, 0, 0, time.UTC)
+		expenses, rate, ok := rates.convert(g.TotalExpenses, g.ID.Currency, currency, date)
+		income, _, _ := rates.convert(g.TotalIncome, g.ID.Currency, currency, date)
+		if !ok {
+			if !containsCurrency(m.Unconverted, g.ID.Currency) {
+				m.Unconverted = append(m.Unconverted, g.ID.Currency)
+			}
+			continue
+		}
+		if rate.OutOfRange && !containsCurrency(m.RatesOutOfRange, g.ID.Currency) {
+			m.RatesOutOfRange = append(m.RatesOutOfRange, g.ID.Currency)
+		}
+		m.TotalExpenses += expenses
+		m.TotalIncome += income
+	}
+
+	for i := range merchants {
+		merchants[i].TotalExpenses = roundCents(merchants[i].TotalExpenses)
+		merchants[i].TotalIncome = roundCents(merchants[i].TotalIncome)
+		sort.Strings(merchants[i].Unconverted)
+		sort.Strings(merchants[i].RatesOutOfRange)
+	}
+	sort.Slice(merchants, func(i, j int) bool {
+		a, b := merchants[i], merchants[j]
+		if a.TotalExpenses != b.TotalExpenses {
+			return a.TotalExpenses > b.TotalExpenses
+		}
+		if a.TotalIncome != b.TotalIncome {
+			return a.TotalIncome > b.TotalIncome
+		}
+		return a.Merchant < b.Merchant
+	})
+	return merchants
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// defaultCurrency is the currency of transactions imported without one and
+// the base currency of users who didn't pick another
+const defaultCurrency = "BRL"
+
+// ExchangeRate is the value of one unit of From in To on Date
+type ExchangeRate struct {
+	Date time.Time `json:"date" bson:"date"`
+	From string    `json:"from" bson:"from"`
+	To   string    `json:"to" bson:"to"`
+	Rate float64   `json:"rate" bson:"rate"`
+}
+
+// CurrencySettings is the currency the user's analysis and exports are converted to
+type CurrencySettings struct {
+	UserID       string `json:"-" bson:"userId"`
+	BaseCurrency string `json:"baseCurrency" bson:"baseCurrency"`
+}
+
+var rateCollection *mongo.Collection
+var currencySettingsCollection *mongo.Collection
+
+// currencyCode matches an ISO 4217 code
+var currencyCode = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// normalizeCurrency returns the ISO 4217 code in upper case, or "" when value isn't one
+func normalizeCurrency(value string) string {
+	code := strings.ToUpper(strings.TrimSpace(value))
+	if !currencyCode.MatchString(code) {
+		return ""
+	}
+	return code
+}
+
+// transactionCurrency is the currency of a transaction, for those imported before currencies were recorded
+var transactionCurrency = bson.D{{Key: "$ifNull", Value: bson.A{"$currency", defaultCurrency}}}
+
+// readRatesFile reads an exchange-rate table from a CSV file with the columns
+// date, from, to and rate, or from a JSON array of ExchangeRate
+func readRatesFile(path string) ([]ExchangeRate, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var rates []ExchangeRate
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		var entries []struct {
+			Date string  `json:"date"`
+			From string  `json:"from"`
+			To   string  `json:"to"`
+			Rate float64 `json:"rate"`
+		}
+		if err := json.NewDecoder(file).Decode(&entries); err != nil {
+			return nil, err
+		}
+		for i, e := range entries {
+			rate, err := newExchangeRate(e.Date, e.From, e.To, e.Rate)
+			if err != nil {
+				return nil, fmt.Errorf("entry %d: %v", i+1, err)
+			}
+			rates = append(rates, rate)
+		}
+		return rates, nil
+	}
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = 4
+	reader.TrimLeadingSpace = true
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if line == 1 && strings.EqualFold(record[0], "date") {
+			continue // Header
+		}
+		value, err := strconv.ParseFloat(record[3], 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid rate %q", line, record[3])
+		}
+		rate, err := newExchangeRate(record[0], record[1], record[2], value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		rates = append(rates, rate)
+	}
+	return rates, nil
+}
+
+// newExchangeRate validates one entry of a rate file
+func newExchangeRate(date, from, to string, rate float64) (ExchangeRate, error) {
+	day, err := time.Parse("2006-01-02", strings.TrimSpace(date))
+	if err != nil {
+		return ExchangeRate{}, fmt.Errorf("invalid date %q, use YYYY-MM-DD", date)
+	}
+	r := ExchangeRate{Date: day, From: normalizeCurrency(from), To: normalizeCurrency(to), Rate: rate}
+	if r.From == "" || r.To == "" || r.From == r.To {
+		return ExchangeRate{}, fmt.Errorf("invalid currencies %q and %q", from, to)
+	}
+	if rate <= 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+		return ExchangeRate{}, fmt.Errorf("invalid rate %v", rate)
+	}
+	return r, nil
+}
+
+// defaultRatesFileInterval is how often EXCHANGE_RATES_FILE is checked for
+// changes unless EXCHANGE_RATES_INTERVAL says otherwise
+const defaultRatesFileInterval = time.Minute
+
+// watchRatesFile stores the rates of the file at EXCHANGE_RATES_FILE at startup
+// and again whenever the file changes, so a new day's rates need no restart.
+// Rates removed from the file stay stored.
+func watchRatesFile() {
+	path := os.Getenv("EXCHANGE_RATES_FILE")
+	if path == "" {
+		return
+	}
+	interval := defaultRatesFileInterval
+	if value := os.Getenv("EXCHANGE_RATES_INTERVAL"); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil && parsed > 0 {
+			interval = parsed
+		} else {
+			log.Printf("Warning: Invalid EXCHANGE_RATES_INTERVAL %q, using %v", value, interval)
+		}
+	}
+
+	var loaded os.FileInfo // The file as last read, to read it again only once it changes
+	lastErr := ""
+	for ; ; time.Sleep(interval) {
+		info, err := os.Stat(path)
+		if err != nil {
+			// Logged once, the file may be missing until it is first written
+			if err.Error() != lastErr {
+				log.Printf("Warning: Failed to read exchange rates from %s: %v", path, err)
+				lastErr = err.Error()
+			}
+			continue
+		}
+		lastErr = ""
+		if loaded != nil && info.ModTime().Equal(loaded.ModTime()) && info.Size() == loaded.Size() {
+			continue
+		}
+
+		rates, err := readRatesFile(path)
+		if err != nil {
+			// Read again once the file is fixed
+			log.Printf("Warning: Failed to read exchange rates from %s: %v", path, err)
+			loaded = info
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err = storeRates(ctx, rates)
+		cancel()
+		if err != nil {
+			// Tried again at the next check
+			log.Printf("Warning: Failed to store exchange rates from %s: %v", path, err)
+			continue
+		}
+		loaded = info
+		log.Printf("Loaded %d exchange rates from %s", len(rates), path)
+	}
+}
+
+// storeRates stores exchange rates, replacing those of the same currencies and date
+func storeRates(ctx context.Context, rates []ExchangeRate) error {
+	if len(rates) == 0 {
+		return nil
+	}
+
+	models := make([]mongo.WriteModel, 0, len(rates))
+	for _, rate := range rates {
+		models = append(models, mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"from": rate.From, "to": rate.To, "date": rate.Date}).
+			SetReplacement(rate).
+			SetUpsert(true))
+	}
+	_, err := rateCollection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// rateTable converts amounts between currencies with the stored rates. The
+// export service converts through convertHandler rather than keeping its own.
+type rateTable struct {
+	// pairs holds the rates of each currency pair, oldest first, under both
+	// directions with the inverse rate for the reverse one
+	pairs map[[2]string][]ExchangeRate
+	// currencies are those with a rate, the candidates to convert through
+	currencies []string
+}
+
+// loadRateTable reads every stored exchange rate
+func loadRateTable(ctx context.Context) (*rateTable, error) {
+	cursor, err := rateCollection.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"date": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var rates []ExchangeRate
+	if err := cursor.All(ctx, &rates); err != nil {
+		return nil, err
+	}
+	return newRateTable(rates), nil
+}
+
+// newRateTable indexes rates sorted by date
+func newRateTable(rates []ExchangeRate) *rateTable {
+	table := &rateTable{pairs: make(map[[2]string][]ExchangeRate)}
+	known := make(map[string]bool)
+	for _, rate := range rates {
+		table.pairs[[2]string{rate.From, rate.To}] = append(table.pairs[[2]string{rate.From, rate.To}], rate)
+		inverse := ExchangeRate{Date: rate.Date, From: rate.To, To: rate.From, Rate: 1 / rate.Rate}
+		table.pairs[[2]string{rate.To, rate.From}] = append(table.pairs[[2]string{rate.To, rate.From}], inverse)
+		for _, currency := range []string{rate.From, rate.To} {
+			if !known[currency] {
+				known[currency] = true
+				table.currencies = append(table.currencies, currency)
+			}
+		}
+	}
+	for pair := range table.pairs {
+		rates := table.pairs[pair]
+		sort.SliceStable(rates, func(i, j int) bool { return rates[i].Date.Before(rates[j].Date) })
+	}
+	sort.Strings(table.currencies)
+	return table
+}
+
+// maxRateAge is how long a rate is used for the days after it before the
+// conversion is flagged as out of range
+const maxRateAge = 7 * 24 * time.Hour
+
+// appliedRate is the rate a conversion used and the day it is from
+type appliedRate struct {
+	Rate float64
+	Date time.Time
+	// OutOfRange is set when no rate is close to the converted day: the day
+	// is before the first rate of the pair or more than maxRateAge after the
+	// latest one before it
+	OutOfRange bool
+}
+
+// pairRate is the latest rate of the pair on or before date, or the oldest
+// one for dates before the table starts
+func (t *rateTable) pairRate(from, to string, date time.Time) (appliedRate, bool) {
+	rates := t.pairs[[2]string{from, to}]
+	if len(rates) == 0 {
+		return appliedRate{}, false
+	}
+	i := sort.Search(len(rates), func(i int) bool { return rates[i].Date.After(date) })
+	if i == 0 {
+		return appliedRate{Rate: rates[0].Rate, Date: rates[0].Date, OutOfRange: true}, true
+	}
+	used := rates[i-1]
+	return appliedRate{Rate: used.Rate, Date: used.Date, OutOfRange: date.Sub(used.Date) > maxRateAge}, true
+}
+
+// rate is the value of one unit of from in to on date. Without a rate between
+// the two, it converts through a currency both have a rate with, dated as the
+// older of the two rates.
+func (t *rateTable) rate(from, to string, date time.Time) (appliedRate, bool) {
+	if from == to {
+		return appliedRate{Rate: 1, Date: date}, true
+	}
+	if rate, ok := t.pairRate(from, to, date); ok {
+		return rate, true
+	}
+	for _, pivot := range t.currencies {
+		if pivot == from || pivot == to {
+			continue
+		}
+		first, ok := t.pairRate(from, pivot, date)
+		if !ok {
+			continue
+		}
+		if second, ok := t.pairRate(pivot, to, date); ok {
+			combined := appliedRate{Rate: first.Rate * second.Rate, Date: first.Date, OutOfRange: first.OutOfRange || second.OutOfRange}
+			if second.Date.Before(first.Date) {
+				combined.Date = second.Date
+			}
+			return combined, true
+		}
+	}
+	return appliedRate{}, false
+}
+
+// convert expresses amount in to, rounded to cents, along with the rate used
+func (t *rateTable) convert(amount float64, from, to string, date time.Time) (float64, appliedRate, bool) {
+	rate, ok := t.rate(from, to, date)
+	if !ok {
+		return 0, appliedRate{}, false
+	}
+	return math.Round(amount*rate.Rate*100) / 100, rate, true
+}
+
+// baseCurrency is the currency the user's amounts are converted to. The
+// "currency" query parameter overrides the user's setting; ok is false when
+// it is not a currency code.
+func baseCurrency(ctx context.Context, r *http.Request, userID string) (string, bool) {
+	if value := r.URL.Query().Get("currency"); value != "" {
+		currency := normalizeCurrency(value)
+		return currency, currency != ""
+	}
+
+	var settings CurrencySettings
+	if err := currencySettingsCollection.FindOne(ctx, bson.M{"userId": userID}).Decode(&settings); err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Printf("Error loading currency settings for %s: %v", userID, err)
+		}
+		return defaultCurrency, true
+	}
+	return settings.BaseCurrency, true
+}
+
+// ConversionRequest lists amounts to convert to the user's base currency,
+// each in its currency on its day
+type ConversionRequest struct {
+	Amounts []struct {
+		Amount   float64   `json:"amount"`
+		Currency string    `json:"currency"` // Empty for defaultCurrency
+		Date     time.Time `json:"date"`
+	} `json:"amounts"`
+}
+
+// ConvertedAmount is one amount of a ConversionRequest in the base currency.
+// Amount is nil when there is no exchange rate; RateDate is the day of the
+// rate used, left out for amounts already in the base currency, and
+// OutOfRange is set when it is far from the amount's day.
+type ConvertedAmount struct {
+	Amount     *float64   `json:"amount"`
+	RateDate   *time.Time `json:"rateDate,omitempty"`
+	OutOfRange bool       `json:"outOfRange,omitempty"`
+}
+
+// ConversionResponse holds the amounts of a ConversionRequest in order
+type ConversionResponse struct {
+	Currency string            `json:"currency"`
+	Amounts  []ConvertedAmount `json:"amounts"`
+}
+
+// convertHandler converts amounts to the user's base currency for the export
+// service, which doesn't load the rates itself
+func convertHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	var request ConversionRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	currency, ok := baseCurrency(ctx, r, userID)
+	if !ok {
+		http.Error(w, "Currency must be an ISO 4217 code such as BRL or USD", http.StatusBadRequest)
+		return
+	}
+	rates, err := loadRateTable(ctx)
+	if err != nil {
+		log.Printf("Error loading exchange rates: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	response := ConversionResponse{Currency: currency, Amounts: make([]ConvertedAmount, len(request.Amounts))}
+	for i, a := range request.Amounts {
+		from := defaultCurrency
+		if a.Currency != "" {
+			from = normalizeCurrency(a.Currency)
+		}
+		amount, rate, ok := rates.convert(a.Amount, from, currency, a.Date)
+		if !ok {
+			continue
+		}
+		response.Amounts[i] = ConvertedAmount{Amount: &amount, OutOfRange: rate.OutOfRange}
+		if from != currency {
+			response.Amounts[i].RateDate = &rate.Date
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func getRatesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	filter := bson.M{}
+	if currency := normalizeCurrency(r.URL.Query().Get("currency")); currency != "" {
+		filter["$or"] = bson.A{bson.M{"from": currency}, bson.M{"to": currency}}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "from", Value: 1}, {Key: "to", Value: 1}, {Key: "date", Value: -1}})
+	cursor, err := rateCollection.Find(ctx, filter, opts)
+	if err != nil {
+		log.Printf("Error finding exchange rates: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	rates := []ExchangeRate{}
+	if err := cursor.All(ctx, &rates); err != nil {
+		log.Printf("Error parsing exchange rates: %v", err)
+		http.Error(w, "Error parsing results", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rates)
+}
+
+func getCurrencySettingsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	settings := CurrencySettings{UserID: userID, BaseCurrency: defaultCurrency}
+	if err := currencySettingsCollection.FindOne(ctx, bson.M{"userId": userID}).Decode(&settings); err != nil && err != mongo.ErrNoDocuments {
+		log.Printf("Error loading currency settings: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+func updateCurrencySettingsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	var settings CurrencySettings
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if settings.BaseCurrency = normalizeCurrency(settings.BaseCurrency); settings.BaseCurrency == "" {
+		http.Error(w, "Base currency must be an ISO 4217 code such as BRL or USD", http.StatusBadRequest)
+		return
+	}
+	settings.UserID = userID
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := options.Update().SetUpsert(true)
+	update := bson.M{"$set": bson.M{"baseCurrency": settings.BaseCurrency}}
+	if _, err := currencySettingsCollection.UpdateOne(ctx, bson.M{"userId": userID}, update, opts); err != nil {
+		log.Printf("Error saving currency settings: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestRateDates checks conversions report the day of the rate they used and
+// flag the days before the first rate or long after the latest one
+func TestRateDates(t *testing.T) {
+	day := func(s string) time.Time {
+		d, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	rates := newRateTable([]ExchangeRate{
+		{Date: day("2024-03-01"), From: "USD", To: "BRL", Rate: 5},
+		{Date: day("2024-03-04"), From: "USD", To: "BRL", Rate: 4},
+		{Date: day("2024-03-01"), From: "EUR", To: "BRL", Rate: 6},
+	})
+
+	tests := []struct {
+		name       string
+		from, to   string
+		date       string
+		amount     float64
+		rateDate   string
+		outOfRange bool
+	}{
+		{"rate of the day", "USD", "BRL", "2024-03-01", 50, "2024-03-01", false},
+		{"latest rate before", "USD", "BRL", "2024-03-11", 40, "2024-03-04", false},
+		{"stale rate", "USD", "BRL", "2024-03-12", 40, "2024-03-04", true},
+		{"before the first rate", "USD", "BRL", "2024-02-01", 50, "2024-03-01", true},
+		{"inverse", "BRL", "USD", "2024-03-04", 2.5, "2024-03-04", false},
+		// Through BRL, dated as the older of the two rates
+		{"pivot", "USD", "EUR", "2024-03-05", 6.67, "2024-03-01", false},
+		{"pivot with a stale leg", "USD", "EUR", "2024-03-09", 6.67, "2024-03-01", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			amount, rate, ok := rates.convert(10, tt.from, tt.to, day(tt.date))
+			if !ok {
+				t.Fatal("no rate")
+			}
+			if amount != tt.amount || rate.Date.Format("2006-01-02") != tt.rateDate || rate.OutOfRange != tt.outOfRange {
+				t.Errorf("got %.2f with the rate of %s (out of range %v), want %.2f with the rate of %s (%v)",
+					amount, rate.Date.Format("2006-01-02"), rate.OutOfRange, tt.amount, tt.rateDate, tt.outOfRange)
+			}
+		})
+	}
+
+	if _, _, ok := rates.convert(10, "GBP", "BRL", day("2024-03-01")); ok {
+		t.Error("GBP converted without a rate")
+	}
+}
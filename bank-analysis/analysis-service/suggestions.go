@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Category suggestions come from a naive Bayes classifier trained on the
+// transactions the user already categorized. Each transaction is described
+// by the words of its description, the order of magnitude of its amount, its
+// type and its source. The model is small enough to be trained on every
+// request, so it always reflects the latest categories and needs nothing
+// outside the database.
+
+const (
+	// maxTrainingTransactions bounds the categorized transactions a model is trained on, the most recent first
+	maxTrainingTransactions = 5000
+	// minTrainingTransactions is how many categorized transactions a user needs before anything is suggested
+	minTrainingTransactions = 10
+	// maxSuggestedTransactions bounds the uncategorized transactions looked at per request or auto-apply run
+	maxSuggestedTransactions = 5000
+	// defaultAutoApplyThreshold is the confidence suggestions need to be applied unless the user picks another
+	defaultAutoApplyThreshold = 0.9
+	// defaultSuggestionInterval is how often suggestions are auto-applied unless SUGGESTION_INTERVAL says otherwise
+	defaultSuggestionInterval = 10 * time.Minute
+)
+
+// CategorySuggestion is the category the classifier expects for an uncategorized transaction
+type CategorySuggestion struct {
+	TransactionID primitive.ObjectID `json:"transactionId"`
+	Description   string             `json:"description"`
+	Date          time.Time          `json:"date"`
+	Amount        float64            `json:"amount"`
+	Type          string             `json:"type"`
+	Category      string             `json:"category"`
+	Confidence    float64            `json:"confidence"` // Probability of the category according to the model, 0 to 1
+}
+
+// SuggestionSettings controls whether suggestions are applied without the user reviewing them
+type SuggestionSettings struct {
+	UserID    string    `json:"userId" bson:"userId"`
+	AutoApply bool      `json:"autoApply" bson:"autoApply"`
+	Threshold float64   `json:"threshold" bson:"threshold"` // Minimum confidence of an applied suggestion
+	UpdatedAt time.Time `json:"updatedAt" bson:"updatedAt"`
+}
+
+var suggestionSettingsCollection *mongo.Collection
+
+// uncategorized matches transactions that still wait for a category
+var uncategorized = bson.M{"$in": bson.A{"", "Uncategorized", nil}}
+
+// accentReplacer strips the accents of Portuguese descriptions so spellings with and without them match
+var accentReplacer = strings.NewReplacer(
+	"á", "a", "à", "a", "â", "a", "ã", "a",
+	"é", "e", "ê", "e", "í", "i",
+	"ó", "o", "ô", "o", "õ", "o", "ú", "u", "ü", "u", "ç", "c",
+)
+
+// features describes a transaction to the classifier. Every feature counts
+// once, repeated words add nothing on descriptions this short.
+func features(t Transaction) []string {
+	seen := make(map[string]bool)
+	var result []string
+	add := func(feature string) {
+		if !seen[feature] {
+			seen[feature] = true
+			result = append(result, feature)
+		}
+	}
+
+	words := strings.FieldsFunc(accentReplacer.Replace(strings.ToLower(t.Description)), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	for _, word := range words {
+		if len(word) >= 2 {
+			add("word:" + word)
+		}
+	}
+	add(fmt.Sprintf("amount:%d", int(math.Log2(math.Abs(t.Amount)+1))))
+	add("type:" + t.Type)
+	if t.Source != "" {
+		add("source:" + t.Source)
+	}
+	return result
+}
+
+// categoryModel is a multinomial naive Bayes classifier over transaction features
+type categoryModel struct {
+	documents  int
+	classes    map[string]*categoryClass
+	vocabulary map[string]bool
+}
+
+type categoryClass struct {
+	documents int
+	features  int
+	counts    map[string]int
+}
+
+// trainCategoryModel learns the categories of the given transactions
+func trainCategoryModel(transactions []Transaction) *categoryModel {
+	model := &categoryModel{classes: make(map[string]*categoryClass), vocabulary: make(map[string]bool)}
+	for _, t := range transactions {
+		class, ok := model.classes[t.Category]
+		if !ok {
+			class = &categoryClass{counts: make(map[string]int)}
+			model.classes[t.Category] = class
+		}
+		class.documents++
+		model.documents++
+		for _, feature := range features(t) {
+			class.counts[feature]++
+			class.features++
+			model.vocabulary[feature] = true
+		}
+	}
+	return model
+}
+
+// predict returns the most likely category of a transaction and its
+// probability. Features the model never saw carry no information and are
+// left out; without a known word in the description nothing is suggested.
+func (m *categoryModel) predict(t Transaction) (string, float64) {
+	var known []string
+	words := 0
+	for _, feature := range features(t) {
+		if m.vocabulary[feature] {
+			known = append(known, feature)
+			if strings.HasPrefix(feature, "word:") {
+				words++
+			}
+		}
+	}
+	if words == 0 || len(m.classes) < 2 {
+		return "", 0
+	}
+
+	// Log probabilities with Laplace smoothing, then normalized into probabilities
+	vocabulary := float64(len(m.vocabulary))
+	scores := make(map[string]float64, len(m.classes))
+	best, bestScore := "", math.Inf(-1)
+	for category, class := range m.classes {
+		score := math.Log(float64(class.documents) / float64(m.documents))
+		for _, feature := range known {
+			score += math.Log((float64(class.counts[feature]) + 1) / (float64(class.features) + vocabulary))
+		}
+		scores[category] = score
+		if score > bestScore || (score == bestScore && category < best) {
+			best, bestScore = category, score
+		}
+	}
+
+	var total float64
+	for _, score := range scores {
+		total += math.Exp(score - bestScore)
+	}
+	return best, 1 / total
+}
+
+// loadCategoryModel trains a model on the transactions the user or a rule
+// categorized. It returns nil while the user has too few of them.
+func loadCategoryModel(ctx context.Context, userID string) (*categoryModel, error) {
+	filter := bson.M{
+		"userId":          userID,
+		"category":        bson.M{"$nin": bson.A{"", "Uncategorized", nil}},
+		"duplicateStatus": notMerged,
+		// Applied suggestions would only teach the model what it already believes
+		"categoryConfidence": bson.M{"$exists": false},
+	}
+	findOptions := options.Find().
+		SetSort(bson.M{"date": -1}).
+		SetLimit(maxTrainingTransactions).
+		SetProjection(bson.M{"description": 1, "category": 1, "amount": 1, "type": 1, "source": 1})
+
+	cursor, err := collection.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var transactions []Transaction
+	if err := cursor.All(ctx, &transactions); err != nil {
+		return nil, err
+	}
+	if len(transactions) < minTrainingTransactions {
+		return nil, nil
+	}
+	return trainCategoryModel(transactions), nil
+}
+
+// suggestCategories trains the user's model and suggests categories for up to
+// limit uncategorized transactions, keeping those at or above minConfidence
+func suggestCategories(ctx context.Context, userID string, limit int, minConfidence float64) ([]CategorySuggestion, error) {
+	suggestions := []CategorySuggestion{}
+	model, err := loadCategoryModel(ctx, userID)
+	if err != nil || model == nil {
+		return suggestions, err
+	}
+
+	filter := bson.M{
+		"userId":          userID,
+		"category":        uncategorized,
+		"categoryManual":  bson.M{"$ne": true},
+		"duplicateStatus": notMerged,
+	}
+	findOptions := options.Find().SetSort(bson.M{"date": -1}).SetLimit(int64(limit))
+	cursor, err := collection.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var transactions []Transaction
+	if err := cursor.All(ctx, &transactions); err != nil {
+		return nil, err
+	}
+
+	for _, t := range transactions {
+		category, confidence := model.predict(t)
+		if category == "" || confidence < minConfidence {
+			continue
+		}
+		suggestions = append(suggestions, CategorySuggestion{
+			TransactionID: t.ID,
+			Description:   t.Description,
+			Date:          t.Date,
+			Amount:        t.Amount,
+			Type:          t.Type,
+			Category:      category,
+			Confidence:    confidence,
+		})
+	}
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		return suggestions[i].Confidence > suggestions[j].Confidence
+	})
+	return suggestions, nil
+}
+
+// applySuggestions categorizes the user's uncategorized transactions whose
+// suggestion reaches the threshold. The confidence is stored with the
+// category so suggested categories can be told apart from picked ones.
+func applySuggestions(ctx context.Context, userID string, threshold float64) (int, error) {
+	suggestions, err := suggestCategories(ctx, userID, maxSuggestedTransactions, threshold)
+	if err != nil || len(suggestions) == 0 {
+		return 0, err
+	}
+
+	models := make([]mongo.WriteModel, 0, len(suggestions))
+	for _, s := range suggestions {
+		// The category may have been picked in the meantime
+		filter := bson.M{"_id": s.TransactionID, "category": uncategorized, "categoryManual": bson.M{"$ne": true}}
+		update := bson.M{"$set": bson.M{"category": s.Category, "categoryConfidence": s.Confidence}}
+		models = append(models, mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update))
+	}
+	result, err := collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return 0, err
+	}
+	return int(result.ModifiedCount), nil
+}
+
+// parseThreshold reads a confidence threshold between 0 and 1
+func parseThreshold(value string, fallback float64) (float64, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	threshold, err := strconv.ParseFloat(value, 64)
+	if err != nil || threshold < 0 || threshold > 1 {
+		return 0, fmt.Errorf("Threshold must be a number between 0 and 1")
+	}
+	return threshold, nil
+}
+
+// loadSuggestionSettings returns the user's settings, or the defaults
+func loadSuggestionSettings(ctx context.Context, userID string) (SuggestionSettings, error) {
+	settings := SuggestionSettings{UserID: userID, Threshold: defaultAutoApplyThreshold}
+	err := suggestionSettingsCollection.FindOne(ctx, bson.M{"userId": userID}).Decode(&settings)
+	if err == mongo.ErrNoDocuments {
+		return settings, nil
+	}
+	return settings, err
+}
+
+// autoApplySuggestions periodically applies the suggestions of the users who
+// turned auto-apply on, categorizing transactions imported since the last run
+func autoApplySuggestions() {
+	interval := defaultSuggestionInterval
+	if value := os.Getenv("SUGGESTION_INTERVAL"); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil && parsed > 0 {
+			interval = parsed
+		} else {
+			log.Printf("Warning: Invalid SUGGESTION_INTERVAL %q, using %v", value, interval)
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		cursor, err := suggestionSettingsCollection.Find(ctx, bson.M{"autoApply": true})
+		if err != nil {
+			log.Printf("Error finding suggestion settings: %v", err)
+			cancel()
+			continue
+		}
+		var users []SuggestionSettings
+		err = cursor.All(ctx, &users)
+		cursor.Close(ctx)
+		if err != nil {
+			log.Printf("Error parsing suggestion settings: %v", err)
+		}
+
+		for _, settings := range users {
+			applied, err := applySuggestions(ctx, settings.UserID, settings.Threshold)
+			if err != nil {
+				log.Printf("Error applying category suggestions for %s: %v", settings.UserID, err)
+				continue
+			}
+			if applied > 0 {
+				log.Printf("Applied %d category suggestions for %s", applied, settings.UserID)
+			}
+		}
+		cancel()
+	}
+}
+
+// getSuggestionsHandler lists category suggestions for uncategorized
+// transactions, the most confident first
+func getSuggestionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	limit := 100 // Default limit
+	if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+		if val, err := strconv.Atoi(limitParam); err == nil && val > 0 && val <= maxSuggestedTransactions {
+			limit = val
+		}
+	}
+	minConfidence, err := parseThreshold(r.URL.Query().Get("minConfidence"), 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	suggestions, err := suggestCategories(ctx, userID, limit, minConfidence)
+	if err != nil {
+		log.Printf("Error suggesting categories: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(suggestions)
+}
+
+// applySuggestionsHandler applies the suggestions reaching the threshold in
+// the request, or the user's configured threshold
+func applySuggestionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	settings, err := loadSuggestionSettings(ctx, userID)
+	if err != nil {
+		log.Printf("Error loading suggestion settings: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	threshold, err := parseThreshold(r.URL.Query().Get("threshold"), settings.Threshold)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	applied, err := applySuggestions(ctx, userID, threshold)
+	if err != nil {
+		log.Printf("Error applying category suggestions: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := struct {
+		Message      string `json:"message"`
+		UpdatedCount int    `json:"updatedCount"`
+	}{
+		Message:      fmt.Sprintf("Applied %d category suggestions", applied),
+		UpdatedCount: applied,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func getSuggestionSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	settings, err := loadSuggestionSettings(ctx, userID)
+	if err != nil {
+		log.Printf("Error loading suggestion settings: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+func updateSuggestionSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	settings := SuggestionSettings{Threshold: defaultAutoApplyThreshold}
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if settings.Threshold <= 0 || settings.Threshold > 1 {
+		http.Error(w, "Threshold must be a number between 0 and 1", http.StatusBadRequest)
+		return
+	}
+	settings.UserID = userID
+	settings.UpdatedAt = time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := suggestionSettingsCollection.ReplaceOne(ctx, bson.M{"userId": userID}, settings, options.Replace().SetUpsert(true))
+	if err != nil {
+		log.Printf("Error saving suggestion settings: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
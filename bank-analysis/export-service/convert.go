@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// defaultCurrency is the currency of transactions imported without one
+const defaultCurrency = "BRL"
+
+// analysisServiceURL is where amounts are converted to the user's base
+// currency, with the exchange rates and currency settings it keeps
+var analysisServiceURL = func() string {
+	if value := os.Getenv("ANALYSIS_SERVICE_URL"); value != "" {
+		return strings.TrimSuffix(value, "/")
+	}
+	return "http://analysis-service:8083"
+}()
+
+// convertedAmount is an amount in the base currency as the analysis service
+// returns it: Amount is nil without an exchange rate, RateDate is the day of
+// the rate used and OutOfRange is set when that day is far from the amount's
+type convertedAmount struct {
+	Amount     *float64   `json:"amount"`
+	RateDate   *time.Time `json:"rateDate"`
+	OutOfRange bool       `json:"outOfRange"`
+}
+
+// conversionError is an answer of the analysis service other than 200, whose
+// 400 messages are passed on to the user
+type conversionError struct {
+	status  int
+	message string
+}
+
+func (e *conversionError) Error() string {
+	return fmt.Sprintf("analysis service answered %d: %s", e.status, e.message)
+}
+
+// convertTransactions converts the signed amounts of the transactions to the
+// user's base currency, or to the currency asked for, through the analysis
+// service. It returns the base currency and one result per transaction.
+func convertTransactions(ctx context.Context, userID, currency string, transactions []Transaction, amounts []float64) (string, []convertedAmount, error) {
+	type amount struct {
+		Amount   float64   `json:"amount"`
+		Currency string    `json:"currency"`
+		Date     time.Time `json:"date"`
+	}
+	request := struct {
+		Amounts []amount `json:"amounts"`
+	}{Amounts: make([]amount, len(transactions))}
+	for i, t := range transactions {
+		request.Amounts[i] = amount{Amount: amounts[i], Currency: t.Currency, Date: t.Date}
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return "", nil, err
+	}
+
+	target := analysisServiceURL + "/convert"
+	if currency != "" {
+		target += "?currency=" + url.QueryEscape(currency)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-User-ID", userID)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", nil, &conversionError{status: resp.StatusCode, message: strings.TrimSpace(string(message))}
+	}
+	var response struct {
+		Currency string            `json:"currency"`
+		Amounts  []convertedAmount `json:"amounts"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return "", nil, err
+	}
+	if len(response.Amounts) != len(transactions) {
+		return "", nil, fmt.Errorf("analysis service converted %d amounts, want %d", len(response.Amounts), len(transactions))
+	}
+	return response.Currency, response.Amounts, nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -26,6 +27,7 @@ type Transaction struct {
 	Amount      float64   `json:"amount" bson:"amount"`
 	Type        string    `json:"type" bson:"type"` // "credit" or "debit"
 	Source      string    `json:"source" bson:"source"`
+	Currency    string    `json:"currency,omitempty" bson:"currency,omitempty"` // Empty for transactions imported before currencies were recorded
 }
 
 var client *mongo.Client
@@ -93,8 +95,8 @@ func exportCSVHandler(w http.ResponseWriter, r *http.Request) {
 	startStr := r.URL.Query().Get("start")
 	endStr := r.URL.Query().Get("end")
 
-	// Create filter
-	filter := bson.M{"userId": userID}
+	// Create filter, leaving out transactions merged into a duplicate
+	filter := bson.M{"userId": userID, "duplicateStatus": bson.M{"$ne": "merged"}}
 
 	// Add date range if provided
 	if startStr != "" || endStr != "" {
@@ -149,6 +151,30 @@ func exportCSVHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Amounts are also converted to the user's base currency by the analysis
+	// service, which keeps the exchange rates
+	amounts := make([]float64, len(transactions))
+	for i, t := range transactions {
+		amounts[i] = t.Amount
+		if t.Type == "debit" {
+			amounts[i] = -t.Amount
+		}
+		if t.Currency == "" {
+			transactions[i].Currency = defaultCurrency
+		}
+	}
+	currency, converted, err := convertTransactions(ctx, userID, r.URL.Query().Get("currency"), transactions, amounts)
+	if err != nil {
+		log.Printf("Error converting amounts: %v", err)
+		var conversionErr *conversionError
+		if errors.As(err, &conversionErr) && conversionErr.status == http.StatusBadRequest {
+			http.Error(w, conversionErr.message, http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Failed to convert amounts", http.StatusBadGateway)
+		return
+	}
+
 	// Set response headers for CSV download
 	filename := fmt.Sprintf("bank_transactions_%s.csv", time.Now().Format("2006-01-02"))
 	w.Header().Set("Content-Type", "text/csv")
@@ -159,7 +185,7 @@ func exportCSVHandler(w http.ResponseWriter, r *http.Request) {
 	defer csvWriter.Flush()
 
 	// Write CSV header
-	header := []string{"Date", "Description", "Category", "Amount", "Type", "Source"}
+	header := []string{"Date", "Description", "Category", "Amount", "Type", "Source", "Currency", "Amount (" + currency + ")", "Rate Date"}
 	if err := csvWriter.Write(header); err != nil {
 		log.Printf("Error writing CSV header: %v", err)
 		http.Error(w, "Error writing CSV", http.StatusInternalServerError)
@@ -167,11 +193,21 @@ func exportCSVHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Write transactions
-	for _, t := range transactions {
+	for i, t := range transactions {
 		// Format amount based on transaction type
-		amount := t.Amount
-		if t.Type == "debit" {
-			amount = -amount
+		amount := amounts[i]
+
+		// The converted amount is left empty when there is no exchange rate,
+		// and the rate date is marked when no rate is close to the transaction
+		convertedAmount, rateDate := "", ""
+		if c := converted[i]; c.Amount != nil {
+			convertedAmount = fmt.Sprintf("%.2f", *c.Amount)
+			if c.RateDate != nil {
+				rateDate = c.RateDate.Format("2006-01-02")
+				if c.OutOfRange {
+					rateDate += " (out of range)"
+				}
+			}
 		}
 
 		row := []string{
@@ -181,6 +217,9 @@ func exportCSVHandler(w http.ResponseWriter, r *http.Request) {
 			fmt.Sprintf("%.2f", amount), // Format to 2 decimal places
 			t.Type,
 			t.Source,
+			t.Currency,
+			convertedAmount,
+			rateDate,
 		}
 
 		if err := csvWriter.Write(row); err != nil {
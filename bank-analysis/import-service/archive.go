@@ -0,0 +1,201 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// maxArchiveEntries bounds the entries of an uploaded zip, directories included
+	maxArchiveEntries = 500
+	// maxArchiveSize bounds the total size of the files extracted from an uploaded zip
+	maxArchiveSize = 256 << 20
+)
+
+// errArchiveTooLarge stops an archive import once the extracted files exceed maxArchiveSize
+var errArchiveTooLarge = fmt.Errorf("Zip archive expands to more than %d MB", maxArchiveSize>>20)
+
+// FileReport is the outcome of one file of an archive upload. The job's
+// counters hold the totals over all files.
+type FileReport struct {
+	FileName        string `json:"fileName" bson:"fileName"`
+	Format          string `json:"format,omitempty" bson:"format,omitempty"`
+	Status          string `json:"status" bson:"status"` // "imported", "empty" or "failed"
+	Error           string `json:"error,omitempty" bson:"error,omitempty"`
+	BatchID         string `json:"batchId,omitempty" bson:"batchId,omitempty"`
+	RowsParsed      int    `json:"rowsParsed" bson:"rowsParsed"`
+	RowsSkipped     int    `json:"rowsSkipped" bson:"rowsSkipped"`
+	RowsWritten     int    `json:"rowsWritten" bson:"rowsWritten"`
+	RowsUnchanged   int    `json:"rowsUnchanged" bson:"rowsUnchanged"`
+	RowsFailed      int    `json:"rowsFailed" bson:"rowsFailed"`
+	DuplicatesFound int    `json:"duplicatesFound" bson:"duplicatesFound"`
+}
+
+// isZipArchive reports whether an upload is a zip of statements. Excel
+// workbooks are zip files too and are left to the workbook parser.
+func isZipArchive(file statementFile) bool {
+	if strings.EqualFold(filepath.Ext(file.Name), ".zip") {
+		return true
+	}
+	head := file.Data
+	if len(head) > detectHeadSize {
+		head = head[:detectHeadSize]
+	}
+	return bytes.HasPrefix(head, []byte("PK\x03\x04")) && !(workbookParser{}).Detect(file.Name, head)
+}
+
+// openArchive opens an uploaded zip and checks its directory against the
+// limits, so an archive that is too large is rejected before anything is
+// extracted. The sizes an archive declares may lie; readArchiveEntry
+// enforces the limit on what is actually extracted.
+func openArchive(data []byte) (*zip.Reader, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open zip archive")
+	}
+	if len(archive.File) > maxArchiveEntries {
+		return nil, fmt.Errorf("Zip archive has more than %d entries", maxArchiveEntries)
+	}
+	var total uint64
+	for _, f := range archive.File {
+		total += f.UncompressedSize64
+		if total > maxArchiveSize {
+			return nil, errArchiveTooLarge
+		}
+	}
+	return archive, nil
+}
+
+// archiveStatements lists the entries of an archive that may be statements,
+// leaving out directories and the metadata macOS and other systems add
+func archiveStatements(archive *zip.Reader) []*zip.File {
+	var files []*zip.File
+	for _, f := range archive.File {
+		name := path.Base(f.Name)
+		if f.FileInfo().IsDir() || strings.HasPrefix(f.Name, "__MACOSX/") || strings.HasPrefix(name, ".") {
+			continue
+		}
+		files = append(files, f)
+	}
+	return files
+}
+
+// readArchiveEntry extracts one entry, failing once more than budget bytes come out
+func readArchiveEntry(f *zip.File, budget int64) ([]byte, error) {
+	reader, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(io.LimitReader(reader, budget+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > budget {
+		return nil, errArchiveTooLarge
+	}
+	return data, nil
+}
+
+// importArchive imports every statement of an uploaded zip as its own batch,
+// parsing each with the options of the upload. A file that can't be read or
+// parsed is reported and skipped; exceeding the size limit stops the import.
+func (run *jobRun) importArchive(ctx context.Context, archiveFile statementFile) error {
+	job := run.job
+	archive, err := openArchive(archiveFile.Data)
+	if err != nil {
+		return err
+	}
+	entries := archiveStatements(archive)
+	job.FilesTotal = len(entries)
+	run.save(true)
+
+	budget := int64(maxArchiveSize)
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		data, err := readArchiveEntry(entry, budget)
+		if errors.Is(err, errArchiveTooLarge) {
+			return err
+		}
+		if err != nil {
+			log.Printf("Error extracting %s from %s: %v", entry.Name, archiveFile.Name, err)
+			run.failFile(entry.Name, "", fmt.Errorf("Failed to extract file from archive"))
+			continue
+		}
+		budget -= int64(len(data))
+		file := statementFile{Name: entry.Name, Hash: hashContent(data), Data: data}
+
+		if isZipArchive(file) {
+			run.failFile(file.Name, "", fmt.Errorf("Archives inside archives are not imported"))
+			continue
+		}
+
+		result, err := parseUploadedFile(ctx, job.UserID, uploadRequest{File: file, Source: job.Source, ProfileID: job.ProfileID, Sheet: job.Sheet})
+		if err != nil {
+			log.Printf("Skipping %s of %s: %v", file.Name, archiveFile.Name, err)
+			run.failFile(file.Name, "", err)
+			continue
+		}
+		if err := run.importArchiveEntry(ctx, file, result); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("Error importing %s of %s: %v", file.Name, archiveFile.Name, err)
+			run.failFile(file.Name, result.Format, err)
+			continue
+		}
+		job.FilesDone++
+		run.save(false)
+	}
+	return nil
+}
+
+// importArchiveEntry imports one parsed file of an archive and reports what
+// it added to the job's counters
+func (run *jobRun) importArchiveEntry(ctx context.Context, file statementFile, result ParseResult) error {
+	job := run.job
+	before := *job
+	report := FileReport{FileName: file.Name, Format: result.Format, Status: "imported"}
+
+	if len(result.Transactions) == 0 {
+		report.Status = "empty"
+		job.RowsSkipped += len(result.Skipped)
+		run.reject(file, result.Header, "parse", result.Skipped)
+	} else {
+		if err := run.importFile(ctx, file, result); err != nil {
+			return err
+		}
+		report.BatchID = job.BatchIDs[len(job.BatchIDs)-1]
+	}
+
+	report.RowsParsed = job.RowsParsed - before.RowsParsed
+	report.RowsSkipped = job.RowsSkipped - before.RowsSkipped
+	report.RowsWritten = job.RowsWritten - before.RowsWritten
+	report.RowsUnchanged = job.RowsUnchanged - before.RowsUnchanged
+	report.RowsFailed = job.RowsFailed - before.RowsFailed
+	report.DuplicatesFound = job.DuplicatesFound - before.DuplicatesFound
+	run.addFileReport(report)
+	return nil
+}
+
+// failFile reports a file of an archive that could not be imported
+func (run *jobRun) failFile(name, format string, err error) {
+	run.addError(fmt.Sprintf("%s: %v", name, err))
+	run.addFileReport(FileReport{FileName: name, Format: format, Status: "failed", Error: err.Error()})
+}
+
+func (run *jobRun) addFileReport(report FileReport) {
+	run.job.Files = append(run.job.Files, report)
+}
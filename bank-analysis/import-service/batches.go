@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ImportBatch records one imported file so it can be listed and rolled back
+type ImportBatch struct {
+	ID           primitive.ObjectID `json:"id" bson:"_id"`
+	UserID       string             `json:"userId" bson:"userId"`
+	JobID        string             `json:"jobId,omitempty" bson:"jobId,omitempty"` // Import job that wrote the batch
+	FileName     string             `json:"fileName" bson:"fileName"`
+	FileHash     string             `json:"fileHash" bson:"fileHash"` // SHA-256 of the file content
+	Format       string             `json:"format" bson:"format"`
+	Status       string             `json:"status" bson:"status"` // "importing", "completed", "interrupted" or "rolled_back"
+	Inserted     int                `json:"inserted" bson:"inserted"`
+	Updated      int                `json:"updated" bson:"updated"`
+	Unchanged    int                `json:"unchanged" bson:"unchanged"`
+	Skipped      int                `json:"skipped" bson:"skipped"` // Rows the parser could not read
+	Failed       int                `json:"failed" bson:"failed"`   // Rows the database rejected
+	CreatedAt    time.Time          `json:"createdAt" bson:"createdAt"`
+	RolledBackAt *time.Time         `json:"rolledBackAt,omitempty" bson:"rolledBackAt,omitempty"`
+}
+
+// BatchChange remembers what a batch did to one transaction document.
+// Previous holds the full document as it was before an update and Written
+// the full document as the batch left it.
+type BatchChange struct {
+	BatchID       string             `bson:"batchId"`
+	TransactionID primitive.ObjectID `bson:"transactionId"`
+	Operation     string             `bson:"operation"` // "insert" or "update"
+	Previous      bson.M             `bson:"previous,omitempty"`
+	Written       bson.M             `bson:"written,omitempty"`
+}
+
+var batchCollection *mongo.Collection
+var batchChangeCollection *mongo.Collection
+
+// hashContent returns the hex SHA-256 of a file's content
+func hashContent(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// startBatch stores a new batch of an import job in the "importing" state
+func startBatch(ctx context.Context, jobID, userID, fileName, fileHash string, result ParseResult) (*ImportBatch, error) {
+	batch := &ImportBatch{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		JobID:     jobID,
+		FileName:  fileName,
+		FileHash:  fileHash,
+		Format:    result.Format,
+		Status:    "importing",
+		Skipped:   len(result.Skipped),
+		CreatedAt: time.Now(),
+	}
+	if _, err := batchCollection.InsertOne(ctx, batch); err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+// finishBatch stores the final counts of a batch and marks it completed
+func finishBatch(ctx context.Context, batch *ImportBatch, stats upsertStats) error {
+	batch.Inserted = stats.Inserted
+	batch.Updated = stats.Updated
+	batch.Unchanged = stats.Unchanged
+	batch.Failed = len(stats.Errors)
+	batch.Status = "completed"
+
+	update := bson.M{"$set": bson.M{
+		"inserted":  batch.Inserted,
+		"updated":   batch.Updated,
+		"unchanged": batch.Unchanged,
+		"failed":    batch.Failed,
+		"status":    batch.Status,
+	}}
+	_, err := batchCollection.UpdateByID(ctx, batch.ID, update)
+	return err
+}
+
+// interruptBatches closes the batches a job left "importing" when the service
+// stopped in the middle of it. They are marked "interrupted" with the counts
+// of the changes they recorded, so the rows they wrote can still be rolled
+// back: a resumed job finds those rows unchanged and leaves them in the
+// interrupted batch.
+func interruptBatches(ctx context.Context, jobID string) error {
+	cursor, err := batchCollection.Find(ctx, bson.M{"jobId": jobID, "status": "importing"})
+	if err != nil {
+		return err
+	}
+	var batches []ImportBatch
+	err = cursor.All(ctx, &batches)
+	cursor.Close(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, batch := range batches {
+		inserted, err := batchChangeCollection.CountDocuments(ctx, bson.M{"batchId": batch.ID.Hex(), "operation": "insert"})
+		if err != nil {
+			return err
+		}
+		updated, err := batchChangeCollection.CountDocuments(ctx, bson.M{"batchId": batch.ID.Hex(), "operation": "update"})
+		if err != nil {
+			return err
+		}
+		update := bson.M{"$set": bson.M{"status": "interrupted", "inserted": inserted, "updated": updated}}
+		if _, err := batchCollection.UpdateOne(ctx, bson.M{"_id": batch.ID, "status": "importing"}, update); err != nil {
+			return err
+		}
+		log.Printf("Batch %s of job %s was interrupted: %d inserted, %d updated", batch.ID.Hex(), jobID, inserted, updated)
+	}
+	return nil
+}
+
+func listBatchesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	findOptions := options.Find().SetSort(bson.M{"createdAt": -1}).SetLimit(100)
+	cursor, err := batchCollection.Find(ctx, bson.M{"userId": userID}, findOptions)
+	if err != nil {
+		log.Printf("Error finding batches: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	batches := []ImportBatch{}
+	if err := cursor.All(ctx, &batches); err != nil {
+		log.Printf("Error parsing batches: %v", err)
+		http.Error(w, "Error parsing results", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(batches)
+}
+
+// rollbackBatchHandler undoes an import: transactions the batch inserted are
+// deleted and transactions it updated are restored to their previous content.
+// Documents changed since the batch wrote them, by a later import, a category
+// edit, a rule or a duplicate merge, are left alone and reported as conflicts.
+func rollbackBatchHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	batchID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid batch ID format", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	var batch ImportBatch
+	if err := batchCollection.FindOne(ctx, bson.M{"_id": batchID, "userId": userID}).Decode(&batch); err != nil {
+		http.Error(w, "Import batch not found", http.StatusNotFound)
+		return
+	}
+	if batch.Status == "rolled_back" {
+		http.Error(w, "Import batch was already rolled back", http.StatusConflict)
+		return
+	}
+	if batch.Status == "importing" {
+		http.Error(w, "Import batch is still being imported", http.StatusConflict)
+		return
+	}
+
+	cursor, err := batchChangeCollection.Find(ctx, bson.M{"batchId": batch.ID.Hex()})
+	if err != nil {
+		log.Printf("Error finding batch changes: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	var changes []BatchChange
+	err = cursor.All(ctx, &changes)
+	cursor.Close(ctx)
+	if err != nil {
+		log.Printf("Error parsing batch changes: %v", err)
+		http.Error(w, "Error parsing results", http.StatusInternalServerError)
+		return
+	}
+
+	deleted, restored, conflicts := 0, 0, 0
+	var deletedIDs []primitive.ObjectID
+	for _, change := range changes {
+		// Only touch documents that still hold what this batch wrote
+		filter := bson.M{"_id": change.TransactionID, "userId": userID, "batchId": batch.ID.Hex()}
+		var current bson.M
+		if err := collection.FindOne(ctx, filter).Decode(&current); err != nil {
+			if err != mongo.ErrNoDocuments {
+				log.Printf("Error finding transaction %s: %v", change.TransactionID.Hex(), err)
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			conflicts++
+			continue
+		}
+		// Changes recorded before the written document was kept can't be checked
+		if change.Written == nil || !sameDocument(current, change.Written) {
+			conflicts++
+			continue
+		}
+
+		switch change.Operation {
+		case "insert":
+			result, err := collection.DeleteOne(ctx, filter)
+			if err != nil {
+				log.Printf("Error deleting transaction %s: %v", change.TransactionID.Hex(), err)
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			if result.DeletedCount > 0 {
+				deleted++
+				deletedIDs = append(deletedIDs, change.TransactionID)
+			} else {
+				conflicts++
+			}
+		case "update":
+			result, err := collection.ReplaceOne(ctx, filter, change.Previous)
+			if err != nil {
+				log.Printf("Error restoring transaction %s: %v", change.TransactionID.Hex(), err)
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			if result.MatchedCount > 0 {
+				restored++
+			} else {
+				conflicts++
+			}
+		}
+	}
+
+	// Duplicate pairs can't be reviewed once one of their transactions is gone
+	if err := forgetDuplicates(ctx, userID, deletedIDs); err != nil {
+		log.Printf("Warning: Failed to drop duplicates of batch %s: %v", batch.ID.Hex(), err)
+	}
+
+	now := time.Now()
+	update := bson.M{"$set": bson.M{"status": "rolled_back", "rolledBackAt": now}}
+	if _, err := batchCollection.UpdateByID(ctx, batch.ID, update); err != nil {
+		log.Printf("Error updating batch status: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := batchChangeCollection.DeleteMany(ctx, bson.M{"batchId": batch.ID.Hex()}); err != nil {
+		log.Printf("Warning: Failed to delete changes of batch %s: %v", batch.ID.Hex(), err)
+	}
+
+	log.Printf("Rolled back batch %s: %d deleted, %d restored, %d conflicts", batch.ID.Hex(), deleted, restored, conflicts)
+
+	resp := struct {
+		Message   string `json:"message"`
+		Deleted   int    `json:"deleted"`
+		Restored  int    `json:"restored"`
+		Conflicts int    `json:"conflicts"`
+	}{
+		Message:   "Import batch rolled back",
+		Deleted:   deleted,
+		Restored:  restored,
+		Conflicts: conflicts,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// TestResumedJobLeavesInterruptedBatchRollbackable stops a job after it wrote
+// part of a file, resumes it and checks the batch of the first run can still
+// be rolled back, taking the rows the resumed run found unchanged with it.
+func TestResumedJobLeavesInterruptedBatchRollbackable(t *testing.T) {
+	db := benchDatabase(t)
+	resetBenchDatabase(t, db)
+	ctx := context.Background()
+
+	transactions := benchTransactions(3)
+	userID := transactions[0].UserID
+	job := newJob(userID, "upload", defaultSource)
+	job.Status = "running"
+	if _, err := jobCollection.InsertOne(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first run stops after writing two of the three rows
+	first, err := startBatch(ctx, job.ID.Hex(), userID, "statement.csv", "hash", ParseResult{Format: "generic"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upsertTransactions(ctx, first.ID.Hex(), transactions[:2], nil)
+
+	if _, err := claimJob(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	var interrupted ImportBatch
+	if err := batchCollection.FindOne(ctx, bson.M{"_id": first.ID}).Decode(&interrupted); err != nil {
+		t.Fatal(err)
+	}
+	if interrupted.Status != "interrupted" || interrupted.Inserted != 2 {
+		t.Fatalf("first batch is %s with %d inserted, want interrupted with 2", interrupted.Status, interrupted.Inserted)
+	}
+
+	// The resumed run imports the whole file again
+	second, err := startBatch(ctx, job.ID.Hex(), userID, "statement.csv", "hash", ParseResult{Format: "generic"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := upsertTransactions(ctx, second.ID.Hex(), transactions, nil)
+	if err := finishBatch(ctx, second, stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Inserted != 1 || stats.Unchanged != 2 {
+		t.Fatalf("resumed run inserted %d and left %d unchanged, want 1 and 2", stats.Inserted, stats.Unchanged)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/batches/"+first.ID.Hex()+"/rollback", nil)
+	req.Header.Set("X-User-ID", userID)
+	req = mux.SetURLVars(req, map[string]string{"id": first.ID.Hex()})
+	rec := httptest.NewRecorder()
+	rollbackBatchHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("rollback answered %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		Deleted   int `json:"deleted"`
+		Conflicts int `json:"conflicts"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Deleted != 2 || resp.Conflicts != 0 {
+		t.Errorf("rollback deleted %d with %d conflicts, want 2 and 0", resp.Deleted, resp.Conflicts)
+	}
+	if left, err := collection.CountDocuments(ctx, bson.M{"userId": userID}); err != nil || left != 1 {
+		t.Errorf("%d transactions left (%v), want the one the resumed run inserted", left, err)
+	}
+}
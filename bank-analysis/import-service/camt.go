@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// StatementBalance records the balances reported by a bank statement so the
+// imported entries can be checked against them later
+type StatementBalance struct {
+	UserID         string    `json:"userId" bson:"userId"`
+	StatementID    string    `json:"statementId" bson:"statementId"`
+	Format         string    `json:"format" bson:"format"` // "camt.053" or "camt.052"
+	Account        string    `json:"account" bson:"account"`
+	Currency       string    `json:"currency" bson:"currency"`
+	OpeningBalance float64   `json:"openingBalance" bson:"openingBalance"`
+	OpeningDate    time.Time `json:"openingDate" bson:"openingDate"`
+	ClosingBalance float64   `json:"closingBalance" bson:"closingBalance"`
+	ClosingDate    time.Time `json:"closingDate" bson:"closingDate"`
+	EntriesTotal   float64   `json:"entriesTotal" bson:"entriesTotal"` // Net sum of the booked entries
+	Reconciled     bool      `json:"reconciled" bson:"reconciled"`     // Opening + entries == closing
+	ImportedAt     time.Time `json:"importedAt" bson:"importedAt"`
+}
+
+// camtDocument covers both camt.053 (BkToCstmrStmt) and camt.052 (BkToCstmrAcctRpt).
+// Element names are matched without namespace so every schema version is accepted.
+type camtDocument struct {
+	XMLName    xml.Name        `xml:"Document"`
+	Statements []camtStatement `xml:"BkToCstmrStmt>Stmt"`
+	Reports    []camtStatement `xml:"BkToCstmrAcctRpt>Rpt"`
+}
+
+type camtStatement struct {
+	ID       string        `xml:"Id"`
+	IBAN     string        `xml:"Acct>Id>IBAN"`
+	OtherID  string        `xml:"Acct>Id>Othr>Id"`
+	Currency string        `xml:"Acct>Ccy"`
+	Balances []camtBalance `xml:"Bal"`
+	Entries  []camtEntry   `xml:"Ntry"`
+}
+
+type camtAmount struct {
+	Currency string `xml:"Ccy,attr"`
+	Value    string `xml:",chardata"`
+}
+
+type camtDate struct {
+	Date     string `xml:"Dt"`
+	DateTime string `xml:"DtTm"`
+}
+
+type camtBalance struct {
+	Code      string     `xml:"Tp>CdOrPrtry>Cd"`
+	Amount    camtAmount `xml:"Amt"`
+	CdtDbtInd string     `xml:"CdtDbtInd"`
+	Date      camtDate   `xml:"Dt"`
+}
+
+// camtStatus is a plain code up to camt.05x.001.07 and wrapped in <Cd> from version 08 on
+type camtStatus struct {
+	Value string `xml:",chardata"`
+	Code  string `xml:"Cd"`
+}
+
+type camtEntry struct {
+	Amount         camtAmount      `xml:"Amt"`
+	CdtDbtInd      string          `xml:"CdtDbtInd"`
+	Status         camtStatus      `xml:"Sts"`
+	BookingDate    camtDate        `xml:"BookgDt"`
+	ValueDate      camtDate        `xml:"ValDt"`
+	AcctSvcrRef    string          `xml:"AcctSvcrRef"`
+	Details        []camtTxDetails `xml:"NtryDtls>TxDtls"`
+	AdditionalInfo string          `xml:"AddtlNtryInf"`
+}
+
+type camtTxDetails struct {
+	AcctSvcrRef     string   `xml:"Refs>AcctSvcrRef"`
+	DebtorName      string   `xml:"RltdPties>Dbtr>Nm"`
+	DebtorPtyName   string   `xml:"RltdPties>Dbtr>Pty>Nm"`
+	CreditorName    string   `xml:"RltdPties>Cdtr>Nm"`
+	CreditorPtyName string   `xml:"RltdPties>Cdtr>Pty>Nm"`
+	Unstructured    []string `xml:"RmtInf>Ustrd"`
+	StructuredRefs  []string `xml:"RmtInf>Strd>CdtrRefInf>Ref"`
+	AdditionalInfo  string   `xml:"AddtlTxInf"`
+}
+
+// parseCAMT reads camt.053 end-of-day statements and camt.052 intraday reports.
+// Each booked Ntry becomes one transaction and each statement's balances are returned
+// alongside so they can be stored and checked against the entries.
+func parseCAMT(file io.Reader, userID string) (ParseResult, error) {
+	// Keep the content so entries can be reported as they appear in the file
+	data, err := io.ReadAll(file)
+	if err != nil {
+		log.Printf("ERROR: Failed to read CAMT file: %v", err)
+		return ParseResult{}, fmt.Errorf("Failed to read CAMT file")
+	}
+
+	var doc camtDocument
+	if err := xml.NewDecoder(bytes.NewReader(data)).Decode(&doc); err != nil {
+		return ParseResult{}, fmt.Errorf("Failed to read CAMT XML: %v", err)
+	}
+
+	format, container := "camt.053", "Stmt"
+	statements := doc.Statements
+	if len(statements) == 0 {
+		format, container = "camt.052", "Rpt"
+		statements = doc.Reports
+	}
+	if len(statements) == 0 {
+		return ParseResult{}, fmt.Errorf("CAMT format not recognized. Requires BkToCstmrStmt or BkToCstmrAcctRpt")
+	}
+
+	result := ParseResult{Format: format}
+	spans := camtEntrySpans(data, container)
+	entry := 0 // Index of the statement's entries within spans
+
+	for _, stmt := range statements {
+		account := stmt.IBAN
+		if account == "" {
+			account = stmt.OtherID
+		}
+
+		entriesTotal := 0.0
+		for i, e := range stmt.Entries {
+			var span camtEntrySpan
+			if entry < len(spans) {
+				span = spans[entry]
+			}
+			entry++
+			raw := string(data[span.Start:span.End])
+
+			status := strings.TrimSpace(e.Status.Value)
+			if e.Status.Code != "" {
+				status = e.Status.Code
+			}
+			if status == "PDNG" || status == "INFO" {
+				// Pending and informational entries are not part of the booked balance
+				continue
+			}
+
+			t, err := e.toTransaction(userID)
+			if err != nil {
+				log.Printf("Skipping CAMT entry %d of statement %s: %v", i+1, stmt.ID, err)
+				result.Skipped = append(result.Skipped, skippedRow(span.Line, raw, fmt.Errorf("Entry %d of statement %s: %w", i+1, stmt.ID, err)))
+				continue
+			}
+			t.Account = account
+			t.Line = span.Line
+			t.Raw = raw
+
+			if t.Type == "credit" {
+				entriesTotal += t.Amount
+			} else {
+				entriesTotal -= t.Amount
+			}
+			result.Transactions = append(result.Transactions, t)
+		}
+
+		balance := StatementBalance{
+			UserID:       userID,
+			StatementID:  stmt.ID,
+			Format:       format,
+			Account:      account,
+			Currency:     stmt.Currency,
+			EntriesTotal: math.Round(entriesTotal*100) / 100,
+		}
+
+		hasOpening, hasClosing := false, false
+		for _, bal := range stmt.Balances {
+			amount, err := bal.Amount.value(bal.CdtDbtInd)
+			if err != nil {
+				continue
+			}
+			date, _ := bal.Date.parse()
+			if balance.Currency == "" {
+				balance.Currency = bal.Amount.Currency
+			}
+
+			switch bal.Code {
+			case "OPBD", "PRCD":
+				balance.OpeningBalance, balance.OpeningDate, hasOpening = amount, date, true
+			case "CLBD", "ITBD":
+				balance.ClosingBalance, balance.ClosingDate, hasClosing = amount, date, true
+			}
+		}
+
+		if hasOpening && hasClosing {
+			expected := balance.OpeningBalance + entriesTotal
+			balance.Reconciled = math.Abs(expected-balance.ClosingBalance) < 0.005
+			if !balance.Reconciled {
+				log.Printf("WARNING: Statement %s does not reconcile: opening %.2f + entries %.2f != closing %.2f",
+					stmt.ID, balance.OpeningBalance, entriesTotal, balance.ClosingBalance)
+			}
+		}
+
+		result.Statements = append(result.Statements, balance)
+	}
+
+	return result, nil
+}
+
+// camtEntrySpan is where an Ntry element sits in the file
+type camtEntrySpan struct {
+	Line       int // Line the element starts on
+	Start, End int64
+}
+
+// camtEntrySpans finds the Ntry elements of every statement ("Stmt") or
+// report ("Rpt") in document order, which is the order they decode in.
+func camtEntrySpans(data []byte, container string) []camtEntrySpan {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	var spans []camtEntrySpan
+	var path []string
+	line, counted := 1, int64(0)
+	for {
+		offset := decoder.InputOffset()
+		token, err := decoder.Token()
+		if err != nil {
+			return spans
+		}
+
+		switch el := token.(type) {
+		case xml.StartElement:
+			if el.Name.Local == "Ntry" && len(path) > 0 && path[len(path)-1] == container {
+				line += bytes.Count(data[counted:offset], []byte("\n"))
+				counted = offset
+				spans = append(spans, camtEntrySpan{Line: line, Start: offset})
+			}
+			path = append(path, el.Name.Local)
+		case xml.EndElement:
+			path = path[:len(path)-1]
+			if el.Name.Local == "Ntry" && len(path) > 0 && path[len(path)-1] == container {
+				spans[len(spans)-1].End = decoder.InputOffset()
+			}
+		}
+	}
+}
+
+// value returns the amount signed according to the credit/debit indicator
+func (a camtAmount) value(cdtDbtInd string) (float64, error) {
+	amount, err := strconv.ParseFloat(strings.TrimSpace(a.Value), 64)
+	if err != nil {
+		return 0, err
+	}
+	if cdtDbtInd == "DBIT" {
+		amount = -amount
+	}
+	return amount, nil
+}
+
+// parse returns the date of a Dt/DtTm choice
+func (d camtDate) parse() (time.Time, error) {
+	value := strings.TrimSpace(d.Date)
+	if value == "" {
+		value = strings.TrimSpace(d.DateTime)
+	}
+	if len(value) < 10 {
+		return time.Time{}, fmt.Errorf("missing date")
+	}
+	return time.Parse("2006-01-02", value[:10])
+}
+
+// toTransaction converts a booked CAMT entry into a Transaction
+func (e camtEntry) toTransaction(userID string) (Transaction, error) {
+	date, err := e.BookingDate.parse()
+	if err != nil {
+		if date, err = e.ValueDate.parse(); err != nil {
+			return Transaction{}, invalidField("date", "missing booking date")
+		}
+	}
+
+	amount, err := strconv.ParseFloat(strings.TrimSpace(e.Amount.Value), 64)
+	if err != nil {
+		return Transaction{}, invalidField("amount", "invalid amount %q", e.Amount.Value)
+	}
+
+	var transType string
+	switch e.CdtDbtInd {
+	case "CRDT":
+		transType = "credit"
+	case "DBIT":
+		transType = "debit"
+	default:
+		return Transaction{}, invalidField("type", "invalid CdtDbtInd %q", e.CdtDbtInd)
+	}
+
+	externalID := e.AcctSvcrRef
+	var counterparty, remittance string
+	if len(e.Details) > 0 {
+		tx := e.Details[0]
+		if externalID == "" {
+			externalID = tx.AcctSvcrRef
+		}
+
+		// The counterparty is whoever is on the other side of the money flow
+		if transType == "credit" {
+			counterparty = firstNonEmpty(tx.DebtorName, tx.DebtorPtyName)
+		} else {
+			counterparty = firstNonEmpty(tx.CreditorName, tx.CreditorPtyName)
+		}
+
+		remittance = strings.Join(tx.Unstructured, " ")
+		if remittance == "" {
+			remittance = strings.Join(tx.StructuredRefs, " ")
+		}
+		if remittance == "" {
+			remittance = tx.AdditionalInfo
+		}
+	}
+	if remittance == "" {
+		remittance = e.AdditionalInfo
+	}
+
+	description := strings.TrimSpace(counterparty)
+	if remittance = strings.TrimSpace(remittance); remittance != "" {
+		if description == "" {
+			description = remittance
+		} else {
+			description += " - " + remittance
+		}
+	}
+
+	return Transaction{
+		UserID:      userID,
+		Date:        date,
+		Description: description,
+		Category:    "Uncategorized",
+		Amount:      math.Abs(amount),
+		Type:        transType,
+		Source:      "checking",
+		ExternalID:  externalID,
+		Currency:    e.Amount.Currency,
+	}, nil
+}
+
+// firstNonEmpty returns the first of the values that isn't blank
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
+
+// saveStatements upserts statement balances keyed by user, account and statement ID
+func saveStatements(ctx context.Context, balances []StatementBalance) error {
+	for _, b := range balances {
+		b.ImportedAt = time.Now()
+		filter := bson.D{
+			{Key: "userId", Value: b.UserID},
+			{Key: "account", Value: b.Account},
+			{Key: "statementId", Value: b.StatementID},
+		}
+		update := bson.D{{Key: "$set", Value: b}}
+		if _, err := statementCollection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// TestCAMTFixtures parses the camt.053 and camt.052 files of testdata/camt and
+// checks only booked entries become transactions and the balances are checked
+// against them.
+func TestCAMTFixtures(t *testing.T) {
+	type row struct {
+		line        int
+		date        string
+		description string
+		amount      float64
+		transType   string
+		ref         string
+	}
+	tests := []struct {
+		fixture      string
+		format       string
+		account      string
+		rows         []row
+		entriesTotal float64
+		reconciled   bool
+	}{
+		{
+			fixture: "statement_053.xml",
+			format:  "camt.053",
+			account: "DE89370400440532013000",
+			rows: []row{
+				{26, "2024-03-05", "ACME GmbH - Invoice 2024-017", 2500, "credit", "2024030500001"},
+				{40, "2024-03-05", "Stadtwerke Berlin - Strom Maerz", 120.50, "debit", "2024030500002"},
+			},
+			// The pending 99.00 is not counted, otherwise the statement would not reconcile
+			entriesTotal: 2379.50,
+			reconciled:   true,
+		},
+		{
+			fixture: "report_052.xml",
+			format:  "camt.052",
+			account: "0532013001",
+			rows: []row{
+				{26, "2024-03-06", "Backerei Schmidt - RF18539007547034", 50, "debit", "2024030600101"},
+			},
+			// 500.00 - 50.00 is not the interim balance of 420.00
+			entriesTotal: -50,
+			reconciled:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			data, err := os.ReadFile("testdata/camt/" + tt.fixture)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := parseStatement(tt.fixture, bytes.NewReader(data), "user@example.com", "", "", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Format != tt.format {
+				t.Errorf("format %s, want %s", result.Format, tt.format)
+			}
+
+			if len(result.Transactions) != len(tt.rows) {
+				t.Fatalf("%d transactions, want the %d booked entries", len(result.Transactions), len(tt.rows))
+			}
+			for i, w := range tt.rows {
+				got := result.Transactions[i]
+				if got.Line != w.line || got.Date.Format("2006-01-02") != w.date || got.Description != w.description ||
+					got.Amount != w.amount || got.Type != w.transType || got.ExternalID != w.ref {
+					t.Errorf("row %d: line %d %s %q %.2f %s %s, want line %d %s %q %.2f %s %s", i+1,
+						got.Line, got.Date.Format("2006-01-02"), got.Description, got.Amount, got.Type, got.ExternalID,
+						w.line, w.date, w.description, w.amount, w.transType, w.ref)
+				}
+				if got.Account != tt.account || got.Currency != "EUR" {
+					t.Errorf("row %d: account %s and currency %s, want %s and EUR", i+1, got.Account, got.Currency, tt.account)
+				}
+			}
+			// Pending and informational entries are left out, not reported as skipped
+			for _, skipped := range result.Skipped {
+				t.Errorf("line %d skipped: %s", skipped.Line, skipped.Reason)
+			}
+
+			if len(result.Statements) != 1 {
+				t.Fatalf("%d statements, want 1", len(result.Statements))
+			}
+			balance := result.Statements[0]
+			if balance.Account != tt.account || balance.Format != tt.format || balance.Currency != "EUR" {
+				t.Errorf("statement of %s in %s %s, want %s in EUR %s", balance.Account, balance.Currency, balance.Format, tt.account, tt.format)
+			}
+			if balance.EntriesTotal != tt.entriesTotal || balance.Reconciled != tt.reconciled {
+				t.Errorf("entries total %.2f, reconciled %v; want %.2f and %v", balance.EntriesTotal, balance.Reconciled, tt.entriesTotal, tt.reconciled)
+			}
+		})
+	}
+}
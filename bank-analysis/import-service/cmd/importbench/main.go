@@ -0,0 +1,148 @@
+// importbench measures import throughput against a running import service.
+// It uploads a generated CSV, follows the import job until it finishes and
+// reports rows per second. Run it against a build of each revision to compare
+// them, e.g.
+//
+//	go run ./cmd/importbench -url http://localhost:8082 -rows 50000
+//
+// The batches it created are rolled back afterwards unless -keep is set. The
+// write path alone is measured against a local MongoDB, without the service,
+// by the benchmarks of store_test.go:
+//
+//	MONGO_BENCH_URI=mongodb://localhost:27017 go test -run '^$' -bench Upsert -benchtime 1x
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"time"
+)
+
+// job holds the fields of an import job the benchmark reports on
+type job struct {
+	ID            string   `json:"id"`
+	Status        string   `json:"status"`
+	Message       string   `json:"message"`
+	RowsParsed    int      `json:"rowsParsed"`
+	RowsWritten   int      `json:"rowsWritten"`
+	RowsUnchanged int      `json:"rowsUnchanged"`
+	ErrorCount    int      `json:"errorCount"`
+	BatchIDs      []string `json:"batchIds"`
+}
+
+func main() {
+	baseURL := flag.String("url", "http://localhost:8082", "import service address")
+	userID := flag.String("user", "importbench@example.com", "user the rows are imported for")
+	rows := flag.Int("rows", 50000, "number of rows in the generated file")
+	keep := flag.Bool("keep", false, "keep the imported rows instead of rolling them back")
+	flag.Parse()
+
+	file := generateCSV(*rows)
+	log.Printf("Generated %d rows (%d bytes)", *rows, len(file))
+
+	// The second run finds every row already stored, which measures the lookup path
+	var batches []string
+	for _, run := range []string{"insert", "re-import"} {
+		start := time.Now()
+		result, err := importFile(*baseURL, *userID, file)
+		if err != nil {
+			log.Fatalf("%s: %v", run, err)
+		}
+		elapsed := time.Since(start)
+		batches = append(batches, result.BatchIDs...)
+
+		fmt.Printf("%-10s %s in %v: %d parsed, %d written, %d unchanged, %d errors (%.0f rows/s)\n",
+			run, result.Status, elapsed.Round(time.Millisecond), result.RowsParsed, result.RowsWritten,
+			result.RowsUnchanged, result.ErrorCount, float64(result.RowsParsed)/elapsed.Seconds())
+	}
+
+	if *keep {
+		return
+	}
+	// Undo the newest batch first so every rollback finds its own writes
+	for i := len(batches) - 1; i >= 0; i-- {
+		req, _ := http.NewRequest(http.MethodDelete, *baseURL+"/batches/"+batches[i], nil)
+		req.Header.Set("X-User-ID", *userID)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			log.Printf("Failed to roll back batch %s: %v", batches[i], err)
+			continue
+		}
+		resp.Body.Close()
+	}
+}
+
+// generateCSV builds a statement in the generic CSV layout with unique rows
+func generateCSV(rows int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("data;descricao;valor;categoria\n")
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < rows; i++ {
+		date := day.AddDate(0, 0, i%365)
+		amount := float64(i%10000)/100 + 1
+		if i%3 == 0 {
+			amount = -amount
+		}
+		fmt.Fprintf(&buf, "%s;Benchmark purchase %d;%.2f;Benchmark\n", date.Format("02/01/2006"), i, amount)
+	}
+	return bytes.ReplaceAll(buf.Bytes(), []byte("."), []byte(","))
+}
+
+// importFile uploads the file and polls its job until it finishes
+func importFile(baseURL, userID string, file []byte) (*job, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", "importbench.csv")
+	if err != nil {
+		return nil, err
+	}
+	part.Write(file)
+	form.Close()
+
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/upload", &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("X-User-ID", userID)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	var started struct {
+		JobID string `json:"jobId"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&started)
+	resp.Body.Close()
+	if err != nil || started.JobID == "" {
+		return nil, fmt.Errorf("upload failed with status %s", resp.Status)
+	}
+
+	for {
+		time.Sleep(200 * time.Millisecond)
+
+		req, _ := http.NewRequest(http.MethodGet, baseURL+"/jobs/"+started.JobID, nil)
+		req.Header.Set("X-User-ID", userID)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		var current job
+		err = json.NewDecoder(resp.Body).Decode(&current)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		switch current.Status {
+		case "completed", "partial", "failed", "cancelled":
+			return &current, nil
+		}
+	}
+}
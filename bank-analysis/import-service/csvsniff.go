@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// maxPreambleLines bounds how many lines before the header are searched. Bank
+// exports put the account number, holder or period there.
+const maxPreambleLines = 20
+
+// csvDelimiters are the field separators bank exports use, most common first
+var csvDelimiters = []rune{';', ',', '\t', '|'}
+
+var (
+	utf8BOM    = []byte{0xEF, 0xBB, 0xBF}
+	utf16LEBOM = []byte{0xFF, 0xFE}
+	utf16BEBOM = []byte{0xFE, 0xFF}
+)
+
+// decodeCSV returns the content of a CSV export as UTF-8 without a byte order
+// mark, and the name of the encoding it was read with. UTF-16 is recognized by
+// its BOM; anything else that isn't valid UTF-8 is read as Windows-1252, which
+// covers Latin-1 exports too. The whole content is checked, so a file whose
+// first lines are plain ASCII is still read right.
+func decodeCSV(data []byte) ([]byte, string) {
+	switch {
+	case bytes.HasPrefix(data, utf8BOM):
+		data = data[len(utf8BOM):]
+		if utf8.Valid(data) {
+			return data, "UTF-8"
+		}
+		return decodeWith(charmap.Windows1252.NewDecoder().Bytes, data), "Windows-1252"
+	case bytes.HasPrefix(data, utf16LEBOM):
+		return decodeUTF16(unicode.LittleEndian, "UTF-16LE", data[2:])
+	case bytes.HasPrefix(data, utf16BEBOM):
+		return decodeUTF16(unicode.BigEndian, "UTF-16BE", data[2:])
+	case utf8.Valid(data):
+		return data, "UTF-8"
+	}
+	return decodeWith(charmap.Windows1252.NewDecoder().Bytes, data), "Windows-1252"
+}
+
+// decodeUTF16 decodes a file that starts with a UTF-16 byte order mark. If the
+// rest doesn't decode, the mark was a coincidence and the encoding is detected
+// again without it.
+func decodeUTF16(order unicode.Endianness, name string, data []byte) ([]byte, string) {
+	decoded, err := unicode.UTF16(order, unicode.IgnoreBOM).NewDecoder().Bytes(data)
+	if err != nil {
+		return decodeCSV(data)
+	}
+	return decoded, name
+}
+
+// decodeWith runs a decoder, keeping the original bytes if it fails
+func decodeWith(decode func([]byte) ([]byte, error), data []byte) []byte {
+	decoded, err := decode(data)
+	if err != nil {
+		return data
+	}
+	return decoded
+}
+
+// decodeCSVHead decodes the start of a file handed to Detect. The head may end
+// in the middle of a character, so it is cut after its last complete line;
+// UTF-16 heads are cut to whole characters first, since a newline byte may be
+// half of one there.
+func decodeCSVHead(head []byte) []byte {
+	if len(head) < detectHeadSize {
+		decoded, _ := decodeCSV(head)
+		return decoded
+	}
+	if bytes.HasPrefix(head, utf16LEBOM) || bytes.HasPrefix(head, utf16BEBOM) {
+		head = head[:len(head)&^1]
+	} else if i := bytes.LastIndexByte(head, '\n'); i != -1 {
+		head = head[:i+1]
+	}
+	decoded, _ := decodeCSV(head)
+	if i := bytes.LastIndexByte(decoded, '\n'); i != -1 {
+		decoded = decoded[:i+1]
+	}
+	return decoded
+}
+
+// csvDelimiter picks the field separator used by a header line
+func csvDelimiter(line string) rune {
+	best, bestCount := ',', 0
+	for _, d := range csvDelimiters {
+		if n := strings.Count(line, string(d)); n > bestCount {
+			best, bestCount = d, n
+		}
+	}
+	return best
+}
+
+// csvHeader is where the header row of a CSV export was found
+type csvHeader struct {
+	Offset int  // Byte offset of the header line
+	Line   int  // Lines before the header, to report rows by their line in the file
+	Comma  rune // Field separator the header was read with
+	Row    []string
+	Cols   csvColumns
+}
+
+// findHeader looks for the first of the leading lines that is a header the
+// profile understands, skipping preamble lines before it. Each line is read
+// with the delimiter it uses most and then with the others, so a banner such
+// as "Conta: 1234-5, Agência: 0001" can't decide the delimiter.
+func (p *BankProfile) findHeader(data []byte) (csvHeader, bool) {
+	offset := 0
+	for line := 0; line < maxPreambleLines && offset < len(data); line++ {
+		end := bytes.IndexByte(data[offset:], '\n')
+		if end == -1 {
+			end = len(data) - offset
+		}
+		text := strings.TrimRight(string(data[offset:offset+end]), "\r")
+
+		if strings.TrimSpace(text) != "" {
+			candidates := []rune{csvDelimiter(text)}
+			for _, d := range csvDelimiters {
+				if d != candidates[0] && strings.ContainsRune(text, d) {
+					candidates = append(candidates, d)
+				}
+			}
+			for _, comma := range candidates {
+				reader := csv.NewReader(strings.NewReader(text))
+				reader.Comma = comma
+				row, err := reader.Read()
+				if err != nil {
+					continue
+				}
+				if cols, ok := p.resolveColumns(row); ok {
+					return csvHeader{Offset: offset, Line: line, Comma: comma, Row: row, Cols: cols}, true
+				}
+			}
+		}
+		offset += end + 1
+	}
+	return csvHeader{}, false
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// TestCSVFixtures checks every export of testdata/csv is detected by its bank
+// profile, read with the right encoding and delimiter, and parses whole.
+func TestCSVFixtures(t *testing.T) {
+	tests := []struct {
+		fixture    string
+		profile    string
+		encoding   string
+		comma      rune
+		headerLine int // Lines before the header
+		rows       int // Transactions parsed
+	}{
+		{fixture: "nubank_utf8_bom.csv", profile: "nubank_checking", encoding: "UTF-8", comma: ',', rows: 3},
+		{fixture: "itau_windows1252.csv", profile: "itau", encoding: "Windows-1252", comma: ';', rows: 3},
+		// The SALDO ANTERIOR balance line has neither a credit nor a debit and is left out
+		{fixture: "bradesco_preamble.csv", profile: "bradesco", encoding: "Windows-1252", comma: ';', headerLine: 3, rows: 2},
+		{fixture: "c6_utf16_tab.csv", profile: "c6", encoding: "UTF-16LE", comma: '\t', rows: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			data, err := os.ReadFile("testdata/csv/" + tt.fixture)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			head := data
+			if len(head) > detectHeadSize {
+				head = head[:detectHeadSize]
+			}
+			parser := detectParser(tt.fixture, head, nil)
+			if parser == nil || parser.Name() != tt.profile {
+				t.Fatalf("detected %v, want profile %s", parser, tt.profile)
+			}
+
+			decoded, encoding := decodeCSV(data)
+			if encoding != tt.encoding {
+				t.Errorf("encoding %s, want %s", encoding, tt.encoding)
+			}
+			header, ok := parser.(*BankProfile).findHeader(decoded)
+			if !ok {
+				t.Fatal("header not found")
+			}
+			if header.Comma != tt.comma {
+				t.Errorf("delimiter %q, want %q", header.Comma, tt.comma)
+			}
+			if header.Line != tt.headerLine {
+				t.Errorf("header after %d lines, want %d", header.Line, tt.headerLine)
+			}
+
+			result, err := parseStatement(tt.fixture, bytes.NewReader(data), "user@example.com", defaultSource, "", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result.Transactions) != tt.rows {
+				t.Errorf("%d transactions parsed, want %d", len(result.Transactions), tt.rows)
+			}
+			for _, row := range result.Skipped {
+				t.Errorf("line %d skipped: %s (%s)", row.Line, row.Reason, row.Raw)
+			}
+		})
+	}
+}
+
+// TestDecodeCSVReadsWholeFile checks the encoding is decided by the whole file,
+// not by ASCII lines at its start.
+func TestDecodeCSVReadsWholeFile(t *testing.T) {
+	data := append(bytes.Repeat([]byte("01/03/2024;PADARIA;;-1,00\r\n"), detectHeadSize/26+1), "02/03/2024;SAL\xc1RIO;;5.000,00\r\n"...)
+
+	decoded, encoding := decodeCSV(data)
+	if encoding != "Windows-1252" {
+		t.Fatalf("encoding %s, want Windows-1252", encoding)
+	}
+	if !bytes.Contains(decoded, []byte("SALÁRIO")) {
+		t.Error("last line not decoded as Windows-1252")
+	}
+}
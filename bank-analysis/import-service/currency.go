@@ -0,0 +1,70 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// defaultCurrency is the currency of statements that don't state one and
+// were not uploaded with another
+const defaultCurrency = "BRL"
+
+// currencySymbols are the symbols amounts are written with, longest first so
+// "US$" isn't taken for "$". A bare "$" is stripped but names no currency.
+var currencySymbols = []struct {
+	Symbol   string
+	Currency string
+}{
+	{"US$", "USD"},
+	{"U$", "USD"},
+	{"R$", "BRL"},
+	{"€", "EUR"},
+	{"£", "GBP"},
+	{"$", ""},
+}
+
+// currencyCode matches an ISO 4217 code
+var currencyCode = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// amountCurrencyCode matches an ISO 4217 code written before or after an amount, as in "USD 12.30"
+var amountCurrencyCode = regexp.MustCompile(`^([A-Za-z]{3})\s*|\s*([A-Za-z]{3})$`)
+
+// normalizeCurrency returns the ISO 4217 code in upper case, or "" when value isn't one
+func normalizeCurrency(value string) string {
+	code := strings.ToUpper(strings.TrimSpace(value))
+	if !currencyCode.MatchString(code) {
+		return ""
+	}
+	return code
+}
+
+// splitCurrency separates an amount from the currency symbol or code written
+// with it. The currency is "" when the amount has none or only a bare "$".
+func splitCurrency(amount string) (string, string) {
+	currency := ""
+	for _, symbol := range currencySymbols {
+		if strings.Contains(amount, symbol.Symbol) {
+			amount = strings.Replace(amount, symbol.Symbol, "", 1)
+			currency = symbol.Currency
+			break
+		}
+	}
+	if match := amountCurrencyCode.FindStringSubmatch(strings.TrimSpace(amount)); match != nil {
+		amount = amountCurrencyCode.ReplaceAllString(strings.TrimSpace(amount), "")
+		currency = strings.ToUpper(match[1] + match[2])
+	}
+	return amount, currency
+}
+
+// applyCurrency sets the currency of the transactions whose statement didn't
+// state one: the currency of the upload, or defaultCurrency
+func applyCurrency(transactions []Transaction, currency string) {
+	if currency == "" {
+		currency = defaultCurrency
+	}
+	for i := range transactions {
+		if transactions[i].Currency == "" {
+			transactions[i].Currency = currency
+		}
+	}
+}
@@ -0,0 +1,596 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DuplicateCandidate pairs two stored transactions that are probably the same
+// real-world transaction imported from different statements, such as a card
+// purchase found in both the checking and the credit card export
+type DuplicateCandidate struct {
+	ID            primitive.ObjectID  `json:"id" bson:"_id"`
+	UserID        string              `json:"userId" bson:"userId"`
+	PairKey       string              `json:"-" bson:"pairKey"`                   // Both transaction IDs in order, so a pair is queued once
+	TransactionID primitive.ObjectID  `json:"transactionId" bson:"transactionId"` // The transaction stored last
+	MatchID       primitive.ObjectID  `json:"matchId" bson:"matchId"`             // The transaction it was matched against
+	Similarity    float64             `json:"similarity" bson:"similarity"`       // Description similarity between 0 and 1
+	DaysApart     int                 `json:"daysApart" bson:"daysApart"`
+	Status        string              `json:"status" bson:"status"`                     // "pending", "merged" or "kept"
+	KeptID        *primitive.ObjectID `json:"keptId,omitempty" bson:"keptId,omitempty"` // Transaction that survived a merge
+	CreatedAt     time.Time           `json:"createdAt" bson:"createdAt"`
+	ResolvedAt    *time.Time          `json:"resolvedAt,omitempty" bson:"resolvedAt,omitempty"`
+}
+
+// storedTransaction is a transaction read back together with the fields only
+// the database knows about
+type storedTransaction struct {
+	Transaction     `bson:",inline"`
+	ID              primitive.ObjectID  `json:"id" bson:"_id"`
+	DuplicateStatus string              `json:"duplicateStatus,omitempty" bson:"duplicateStatus,omitempty"` // "pending" or "merged"
+	MergedInto      *primitive.ObjectID `json:"mergedInto,omitempty" bson:"mergedInto,omitempty"`
+}
+
+const (
+	// duplicateDateTolerance is how far apart the dates of a duplicate may be;
+	// card purchases often post a day or two after they were made
+	duplicateDateTolerance = 3 * 24 * time.Hour
+	// duplicateMinSimilarity is the description similarity a duplicate needs
+	duplicateMinSimilarity = 0.5
+)
+
+var duplicateCollection *mongo.Collection
+
+// notMerged matches the transactions that still count, i.e. were not merged into another one
+var notMerged = bson.M{"$ne": "merged"}
+
+// duplicatePair is a match found by matchDuplicates, not yet queued
+type duplicatePair struct {
+	Later      storedTransaction
+	Earlier    storedTransaction
+	Similarity float64
+	DaysApart  int
+}
+
+// descriptionTokens splits a description into lowercase words without accents,
+// dropping single characters such as the "-" banks put between fields
+func descriptionTokens(description string) map[string]bool {
+	normalized := headerReplacer.Replace(strings.ToLower(description))
+	tokens := make(map[string]bool)
+	for _, word := range strings.FieldsFunc(normalized, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len(word) > 1 {
+			tokens[word] = true
+		}
+	}
+	return tokens
+}
+
+// descriptionSimilarity scores how alike two descriptions are, from 0 to 1.
+// It is the Dice coefficient of their words, or the share of the shorter
+// description found in the longer one, so "PADARIA X" still matches
+// "Compra no débito - PADARIA X".
+func descriptionSimilarity(a, b string) float64 {
+	ta, tb := descriptionTokens(a), descriptionTokens(b)
+	if len(ta) == 0 || len(tb) == 0 {
+		return 0
+	}
+	common := 0
+	for word := range ta {
+		if tb[word] {
+			common++
+		}
+	}
+
+	score := 2 * float64(common) / float64(len(ta)+len(tb))
+	// A single shared word is too weak to say one description contains the other
+	if shorter := int(math.Min(float64(len(ta)), float64(len(tb)))); shorter > 1 {
+		score = math.Max(score, float64(common)/float64(shorter))
+	}
+	return score
+}
+
+// matchDuplicates finds, for each fresh transaction, the candidate most likely
+// to be the same real-world transaction: same type and amount, dates within
+// duplicateDateTolerance and similar descriptions. Transactions written by the
+// same batch are never paired, since identical rows of one file are genuine.
+func matchDuplicates(fresh, candidates []storedTransaction) []duplicatePair {
+	amountKey := func(t storedTransaction) string {
+		return fmt.Sprintf("%s|%.2f", t.Type, t.Amount)
+	}
+	byAmount := make(map[string][]int)
+	for i, c := range candidates {
+		byAmount[amountKey(c)] = append(byAmount[amountKey(c)], i)
+	}
+
+	var pairs []duplicatePair
+	seen := make(map[string]bool)
+	for _, f := range fresh {
+		var best *duplicatePair
+		for _, i := range byAmount[amountKey(f)] {
+			c := candidates[i]
+			if c.ID == f.ID {
+				continue
+			}
+			// Transactions imported before batches existed have none; of those only
+			// the ones from another account can be told to come from another file
+			if c.BatchID == f.BatchID && (c.BatchID != "" || c.Source == f.Source) {
+				continue
+			}
+			// Different bank-assigned IDs of one account are different transactions
+			if c.Source == f.Source && c.Account == f.Account && c.ExternalID != "" && f.ExternalID != "" {
+				continue
+			}
+			apart := f.Date.Sub(c.Date)
+			if apart < 0 {
+				apart = -apart
+			}
+			if apart > duplicateDateTolerance {
+				continue
+			}
+			similarity := descriptionSimilarity(f.Description, c.Description)
+			if similarity < duplicateMinSimilarity {
+				continue
+			}
+
+			days := int(apart.Hours() / 24)
+			if best == nil || similarity > best.Similarity || (similarity == best.Similarity && days < best.DaysApart) {
+				pair := duplicatePair{Later: f, Earlier: c, Similarity: similarity, DaysApart: days}
+				// ObjectIDs grow over time, so the larger one was stored last
+				if c.ID.Hex() > f.ID.Hex() {
+					pair.Later, pair.Earlier = c, f
+				}
+				best = &pair
+			}
+		}
+		if best == nil {
+			continue
+		}
+		key := pairKey(best.Later.ID, best.Earlier.ID)
+		if !seen[key] {
+			seen[key] = true
+			pairs = append(pairs, *best)
+		}
+	}
+	return pairs
+}
+
+// pairKey identifies a pair of transactions regardless of their order
+func pairKey(a, b primitive.ObjectID) string {
+	ids := []string{a.Hex(), b.Hex()}
+	sort.Strings(ids)
+	return ids[0] + "|" + ids[1]
+}
+
+// loadStoredTransactions reads the transactions matching filter
+func loadStoredTransactions(ctx context.Context, filter bson.M) ([]storedTransaction, error) {
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	transactions := []storedTransaction{}
+	if err := cursor.All(ctx, &transactions); err != nil {
+		return nil, err
+	}
+	return transactions, nil
+}
+
+// detectBatchDuplicates compares the transactions a batch wrote with the ones
+// other imports stored around the same dates and queues the likely duplicates.
+// It returns how many new pairs were queued.
+func detectBatchDuplicates(ctx context.Context, userID, batchID string) (int, error) {
+	fresh, err := loadStoredTransactions(ctx, bson.M{"userId": userID, "batchId": batchID, "duplicateStatus": notMerged})
+	if err != nil || len(fresh) == 0 {
+		return 0, err
+	}
+
+	first, last := fresh[0].Date, fresh[0].Date
+	amounts := bson.A{}
+	for _, t := range fresh {
+		if t.Date.Before(first) {
+			first = t.Date
+		}
+		if t.Date.After(last) {
+			last = t.Date
+		}
+		amounts = append(amounts, t.Amount)
+	}
+
+	candidates, err := loadStoredTransactions(ctx, bson.M{
+		"userId":          userID,
+		"batchId":         bson.M{"$ne": batchID},
+		"duplicateStatus": notMerged,
+		"amount":          bson.M{"$in": amounts},
+		"date": bson.M{
+			"$gte": first.Add(-duplicateDateTolerance),
+			"$lte": last.Add(duplicateDateTolerance),
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return queueDuplicates(ctx, userID, matchDuplicates(fresh, candidates))
+}
+
+// detectAllDuplicates runs the detection over every transaction of the user,
+// for history imported before the detection existed
+func detectAllDuplicates(ctx context.Context, userID string) (int, error) {
+	transactions, err := loadStoredTransactions(ctx, bson.M{"userId": userID, "duplicateStatus": notMerged})
+	if err != nil {
+		return 0, err
+	}
+	return queueDuplicates(ctx, userID, matchDuplicates(transactions, transactions))
+}
+
+// queueDuplicates stores the pairs that are not queued yet, including pairs the
+// user already resolved, and flags their later transaction as a pending duplicate
+func queueDuplicates(ctx context.Context, userID string, pairs []duplicatePair) (int, error) {
+	queued := 0
+	for _, pair := range pairs {
+		candidate := DuplicateCandidate{
+			ID:            primitive.NewObjectID(),
+			UserID:        userID,
+			PairKey:       pairKey(pair.Later.ID, pair.Earlier.ID),
+			TransactionID: pair.Later.ID,
+			MatchID:       pair.Earlier.ID,
+			Similarity:    pair.Similarity,
+			DaysApart:     pair.DaysApart,
+			Status:        "pending",
+			CreatedAt:     time.Now(),
+		}
+		filter := bson.M{"userId": userID, "pairKey": candidate.PairKey}
+		result, err := duplicateCollection.UpdateOne(ctx, filter, bson.M{"$setOnInsert": candidate}, options.Update().SetUpsert(true))
+		if err != nil {
+			return queued, err
+		}
+		if result.UpsertedCount == 0 {
+			continue
+		}
+		queued++
+
+		if _, err := collection.UpdateByID(ctx, pair.Later.ID, bson.M{"$set": bson.M{"duplicateStatus": "pending"}}); err != nil {
+			return queued, err
+		}
+	}
+	return queued, nil
+}
+
+// refreshPendingFlags sets or clears the pending duplicate flag of transactions
+// depending on whether a pending pair still names them as the later transaction
+func refreshPendingFlags(ctx context.Context, userID string, ids []primitive.ObjectID) error {
+	for _, id := range ids {
+		count, err := duplicateCollection.CountDocuments(ctx, bson.M{"userId": userID, "transactionId": id, "status": "pending"})
+		if err != nil {
+			return err
+		}
+		filter := bson.M{"_id": id, "userId": userID, "duplicateStatus": bson.M{"$in": bson.A{nil, "pending"}}}
+		update := bson.M{"$unset": bson.M{"duplicateStatus": ""}}
+		if count > 0 {
+			update = bson.M{"$set": bson.M{"duplicateStatus": "pending"}}
+		}
+		if _, err := collection.UpdateOne(ctx, filter, update); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forgetDuplicates drops the pairs involving transactions that no longer
+// exist. Transactions that were merged into a deleted one count again.
+func forgetDuplicates(ctx context.Context, userID string, deleted []primitive.ObjectID) error {
+	if len(deleted) == 0 {
+		return nil
+	}
+	involving := bson.M{"userId": userID, "$or": bson.A{
+		bson.M{"transactionId": bson.M{"$in": deleted}},
+		bson.M{"matchId": bson.M{"$in": deleted}},
+	}}
+
+	cursor, err := duplicateCollection.Find(ctx, involving)
+	if err != nil {
+		return err
+	}
+	var candidates []DuplicateCandidate
+	err = cursor.All(ctx, &candidates)
+	cursor.Close(ctx)
+	if err != nil {
+		return err
+	}
+
+	gone := make(map[primitive.ObjectID]bool, len(deleted))
+	for _, id := range deleted {
+		gone[id] = true
+	}
+
+	var affected []primitive.ObjectID
+	for _, c := range candidates {
+		affected = append(affected, c.TransactionID, c.MatchID)
+		// Only the transaction this pair merged counts again, and only when
+		// the one it was merged into is gone
+		if c.Status != "merged" || c.KeptID == nil || !gone[*c.KeptID] {
+			continue
+		}
+		dropped := c.TransactionID
+		if dropped == *c.KeptID {
+			dropped = c.MatchID
+		}
+		filter := bson.M{"_id": dropped, "userId": userID, "mergedInto": *c.KeptID}
+		if _, err := collection.UpdateOne(ctx, filter, bson.M{"$unset": bson.M{"duplicateStatus": "", "mergedInto": ""}}); err != nil {
+			return err
+		}
+	}
+
+	if _, err := duplicateCollection.DeleteMany(ctx, involving); err != nil {
+		return err
+	}
+	return refreshPendingFlags(ctx, userID, affected)
+}
+
+// duplicateReview is a queued pair together with both of its transactions
+type duplicateReview struct {
+	DuplicateCandidate
+	Transaction *storedTransaction `json:"transaction"`
+	Match       *storedTransaction `json:"match"`
+}
+
+// listDuplicatesHandler lists the user's duplicate pairs, by default the ones
+// waiting for review. Pass ?status=merged or ?status=kept for resolved pairs.
+func listDuplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = "pending"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	findOptions := options.Find().SetSort(bson.M{"createdAt": -1}).SetLimit(200)
+	cursor, err := duplicateCollection.Find(ctx, bson.M{"userId": userID, "status": status}, findOptions)
+	if err != nil {
+		log.Printf("Error finding duplicates: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	candidates := []DuplicateCandidate{}
+	err = cursor.All(ctx, &candidates)
+	cursor.Close(ctx)
+	if err != nil {
+		log.Printf("Error parsing duplicates: %v", err)
+		http.Error(w, "Error parsing results", http.StatusInternalServerError)
+		return
+	}
+
+	ids := bson.A{}
+	for _, c := range candidates {
+		ids = append(ids, c.TransactionID, c.MatchID)
+	}
+	transactions, err := loadStoredTransactions(ctx, bson.M{"userId": userID, "_id": bson.M{"$in": ids}})
+	if err != nil {
+		log.Printf("Error finding duplicate transactions: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	byID := make(map[primitive.ObjectID]*storedTransaction)
+	for i := range transactions {
+		byID[transactions[i].ID] = &transactions[i]
+	}
+
+	reviews := make([]duplicateReview, len(candidates))
+	for i, c := range candidates {
+		reviews[i] = duplicateReview{DuplicateCandidate: c, Transaction: byID[c.TransactionID], Match: byID[c.MatchID]}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reviews)
+}
+
+// detectDuplicatesHandler runs the detection over the user's whole history
+func detectDuplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	queued, err := detectAllDuplicates(ctx, userID)
+	if err != nil {
+		log.Printf("Error detecting duplicates: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Response{
+		Message: fmt.Sprintf("Found %d possible duplicates", queued),
+		Count:   queued,
+	})
+}
+
+// loadDuplicate reads the pair named in the URL, reporting errors to the client
+func loadDuplicate(ctx context.Context, w http.ResponseWriter, r *http.Request, userID string) (*DuplicateCandidate, bool) {
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid duplicate ID format", http.StatusBadRequest)
+		return nil, false
+	}
+	var candidate DuplicateCandidate
+	if err := duplicateCollection.FindOne(ctx, bson.M{"_id": id, "userId": userID}).Decode(&candidate); err != nil {
+		http.Error(w, "Duplicate not found", http.StatusNotFound)
+		return nil, false
+	}
+	return &candidate, true
+}
+
+// mergeDuplicateHandler resolves a pending pair by keeping one transaction and
+// marking the other as merged into it, which takes it out of the totals. The
+// earlier transaction is kept unless the body names another with "keepId". A
+// category set on the merged transaction is carried over to an uncategorized
+// survivor.
+func mergeDuplicateHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		KeepID string `json:"keepId"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	candidate, ok := loadDuplicate(ctx, w, r, userID)
+	if !ok {
+		return
+	}
+	if candidate.Status != "pending" {
+		http.Error(w, "Duplicate was already resolved", http.StatusConflict)
+		return
+	}
+
+	kept, dropped := candidate.MatchID, candidate.TransactionID
+	switch req.KeepID {
+	case "", kept.Hex():
+	case dropped.Hex():
+		kept, dropped = dropped, kept
+	default:
+		http.Error(w, "keepId must be one of the pair's transactions", http.StatusBadRequest)
+		return
+	}
+
+	var survivor, merged storedTransaction
+	if err := collection.FindOne(ctx, bson.M{"_id": kept, "userId": userID}).Decode(&survivor); err != nil {
+		http.Error(w, "Transaction not found", http.StatusNotFound)
+		return
+	}
+	if err := collection.FindOne(ctx, bson.M{"_id": dropped, "userId": userID}).Decode(&merged); err != nil {
+		http.Error(w, "Transaction not found", http.StatusNotFound)
+		return
+	}
+
+	update := bson.M{"$set": bson.M{"duplicateStatus": "merged", "mergedInto": kept}}
+	if _, err := collection.UpdateByID(ctx, dropped, update); err != nil {
+		log.Printf("Error merging transaction %s: %v", dropped.Hex(), err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if (survivor.Category == "" || survivor.Category == "Uncategorized") && merged.Category != "" && merged.Category != "Uncategorized" {
+		if _, err := collection.UpdateByID(ctx, kept, bson.M{"$set": bson.M{"category": merged.Category}}); err != nil {
+			log.Printf("Warning: Failed to carry category over to %s: %v", kept.Hex(), err)
+		}
+	}
+
+	now := time.Now()
+	resolve := bson.M{"$set": bson.M{"status": "merged", "keptId": kept, "resolvedAt": now}}
+	if _, err := duplicateCollection.UpdateByID(ctx, candidate.ID, resolve); err != nil {
+		log.Printf("Error resolving duplicate %s: %v", candidate.ID.Hex(), err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Other pairs offering the merged transaction no longer make sense
+	others := bson.M{"userId": userID, "status": "pending", "$or": bson.A{
+		bson.M{"transactionId": dropped},
+		bson.M{"matchId": dropped},
+	}}
+	if _, err := duplicateCollection.DeleteMany(ctx, others); err != nil {
+		log.Printf("Warning: Failed to drop pairs of merged transaction %s: %v", dropped.Hex(), err)
+	}
+	if err := refreshPendingFlags(ctx, userID, []primitive.ObjectID{kept}); err != nil {
+		log.Printf("Warning: Failed to refresh duplicate flags: %v", err)
+	}
+
+	candidate.Status = "merged"
+	candidate.KeptID = &kept
+	candidate.ResolvedAt = &now
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(candidate)
+}
+
+// keepDuplicateHandler resolves a pair as two genuine transactions. On a
+// merged pair it undoes the merge, so the merged transaction counts again.
+func keepDuplicateHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	candidate, ok := loadDuplicate(ctx, w, r, userID)
+	if !ok {
+		return
+	}
+	if candidate.Status == "kept" {
+		http.Error(w, "Duplicate was already resolved", http.StatusConflict)
+		return
+	}
+
+	if candidate.Status == "merged" && candidate.KeptID != nil {
+		dropped := candidate.TransactionID
+		if dropped == *candidate.KeptID {
+			dropped = candidate.MatchID
+		}
+		filter := bson.M{"_id": dropped, "userId": userID, "mergedInto": *candidate.KeptID}
+		if _, err := collection.UpdateOne(ctx, filter, bson.M{"$unset": bson.M{"duplicateStatus": "", "mergedInto": ""}}); err != nil {
+			log.Printf("Error restoring transaction %s: %v", dropped.Hex(), err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	now := time.Now()
+	resolve := bson.M{
+		"$set":   bson.M{"status": "kept", "resolvedAt": now},
+		"$unset": bson.M{"keptId": ""},
+	}
+	if _, err := duplicateCollection.UpdateByID(ctx, candidate.ID, resolve); err != nil {
+		log.Printf("Error resolving duplicate %s: %v", candidate.ID.Hex(), err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := refreshPendingFlags(ctx, userID, []primitive.ObjectID{candidate.TransactionID, candidate.MatchID}); err != nil {
+		log.Printf("Warning: Failed to refresh duplicate flags: %v", err)
+	}
+
+	candidate.Status = "kept"
+	candidate.KeptID = nil
+	candidate.ResolvedAt = &now
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(candidate)
+}
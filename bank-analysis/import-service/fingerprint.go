@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// legacyIndexes are the unique indexes the fingerprint index replaced. The
+// description/date/amount one merged genuine identical transactions.
+var legacyIndexes = []string{"userId_1_description_1_date_1_amount_1", "userId_1_externalId_1"}
+
+// nubankIdentifierPattern matches the UUIDs of Nubank's "Identificador" column,
+// which older imports stored as the category
+var nubankIdentifierPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// defaultSource is the account type of statements that don't state theirs
+// and were imported without one
+const defaultSource = "checking"
+
+// transactionSources are the account types transactions are stored with.
+// Rules and profiles can only match these, so uploads are limited to them.
+var transactionSources = []string{"checking", "credit_card"}
+
+// checkSource rejects an account type transactions are never stored with.
+// An empty source is left for the caller to default.
+func checkSource(source string) error {
+	if source == "" {
+		return nil
+	}
+	for _, s := range transactionSources {
+		if source == s {
+			return nil
+		}
+	}
+	return fmt.Errorf("Source must be %s", strings.Join(transactionSources, " or "))
+}
+
+// legacySources are account types older imports stored for statements that
+// don't state theirs: "nubank" by the original Nubank upload and "import" by
+// folder scans. Fingerprints include the source, so they are stored as
+// defaultSource for a re-import to match them.
+var legacySources = []string{"nubank", "import"}
+
+// upgradeLegacyTransaction moves a Nubank identifier out of the category and
+// replaces a legacy source, as transactions are stored today
+func upgradeLegacyTransaction(t *Transaction) {
+	if t.ExternalID == "" && nubankIdentifierPattern.MatchString(t.Category) {
+		t.ExternalID = t.Category
+		t.Category = "Uncategorized"
+	}
+	t.Source = currentSource(t.Source)
+}
+
+// currentSource replaces a legacy account type with the one stored today
+func currentSource(source string) string {
+	for _, legacy := range legacySources {
+		if source == legacy {
+			return defaultSource
+		}
+	}
+	return source
+}
+
+// contentKey describes what a transaction without a bank-assigned ID is made of
+func contentKey(t Transaction) string {
+	return fmt.Sprintf("%s|%s|%s|%.2f|%s", t.Source, t.Description, t.Date.UTC().Format("2006-01-02"), t.Amount, t.Type)
+}
+
+// fingerprint identifies a transaction across imports. Bank-assigned IDs are
+// used when the format has one, together with the account the statement
+// lists since banks only keep them unique within an account; otherwise the
+// content is combined with the ordinal of the transaction among identical
+// ones of the same file, so two equal coffees on one day stay two
+// transactions while re-importing the file still matches both.
+func fingerprint(t Transaction, ordinal int) string {
+	key := "id|" + t.Source + "|" + t.ExternalID
+	if t.Account != "" {
+		key = "id|" + t.Source + "|" + t.Account + "|" + t.ExternalID
+	}
+	if t.ExternalID == "" {
+		key = fmt.Sprintf("tx|%s|%d", contentKey(t), ordinal)
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// assignFingerprints sets the fingerprint of the transactions parsed from one file
+func assignFingerprints(transactions []Transaction) {
+	ordinals := make(map[string]int)
+	for i := range transactions {
+		t := &transactions[i]
+		ordinal := 0
+		if t.ExternalID == "" {
+			key := contentKey(*t)
+			ordinals[key]++
+			ordinal = ordinals[key]
+		}
+		t.Fingerprint = fingerprint(*t, ordinal)
+	}
+}
+
+// accountlessFingerprint is the fingerprint older versions stored a
+// transaction with a bank-assigned ID under, before the account was part of
+// it. It is empty when the account makes no difference.
+func accountlessFingerprint(t Transaction) string {
+	if t.Account == "" || t.ExternalID == "" {
+		return ""
+	}
+	t.Account = ""
+	return fingerprint(t, 0)
+}
+
+// findAccountless adds to existing the documents older versions stored
+// without an account for the transactions that have one and matched nothing.
+// The stored document only tells the bank-assigned ID, which another account
+// may share, so it is taken over only when its date and amount agree; the
+// import then writes the account and the fingerprint with it.
+func findAccountless(ctx context.Context, transactions []Transaction, existing map[string]bson.M) error {
+	var legacy []Transaction
+	for _, t := range transactions {
+		if _, found := existing[t.Fingerprint]; found {
+			continue
+		}
+		if fp := accountlessFingerprint(t); fp != "" {
+			t.Fingerprint = fp
+			legacy = append(legacy, t)
+		}
+	}
+	if len(legacy) == 0 {
+		return nil
+	}
+
+	stored, err := findExisting(ctx, legacy, nil)
+	if err != nil {
+		return err
+	}
+	taken := make(map[interface{}]bool)
+	for _, t := range transactions {
+		doc, ok := stored[accountlessFingerprint(t)]
+		if !ok || doc["account"] != nil || taken[doc["_id"]] {
+			continue
+		}
+		if _, found := existing[t.Fingerprint]; found {
+			continue
+		}
+		fields, err := transactionFields(t)
+		if err != nil || !reflect.DeepEqual(doc["date"], fields["date"]) || !reflect.DeepEqual(doc["amount"], fields["amount"]) {
+			continue
+		}
+		existing[t.Fingerprint] = doc
+		taken[doc["_id"]] = true
+	}
+	return nil
+}
+
+// migrateFingerprints brings transactions stored by older versions up to
+// date: it drops the legacy unique indexes, upgrades the documents with
+// upgradeLegacyTransaction and fingerprints every document that has none or
+// had a legacy source. A document whose new fingerprint is already taken was
+// imported again under the new source; the pair is queued for duplicate
+// review and the document is retried on the next start. It is safe to run on
+// every start.
+//
+// Documents with a bank-assigned ID stored before the account was recorded
+// keep the fingerprint without it, the account isn't known until their
+// statement is imported again and findAccountless adds it.
+func migrateFingerprints(ctx context.Context) error {
+	for _, name := range legacyIndexes {
+		if _, err := collection.Indexes().DropOne(ctx, name); err != nil && !isNotFound(err) {
+			return fmt.Errorf("dropping index %s: %v", name, err)
+		}
+	}
+
+	// Documents are read per user in insertion order so identical ones get ordinals as a file would give them
+	filter := bson.M{"$or": bson.A{
+		bson.M{"fingerprint": bson.M{"$exists": false}},
+		bson.M{"source": bson.M{"$in": legacySources}},
+	}}
+	findOptions := options.Find().SetSort(bson.D{{Key: "userId", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := collection.Find(ctx, filter, findOptions)
+	if err != nil {
+		return fmt.Errorf("finding transactions without fingerprint: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	var models []mongo.WriteModel
+	var upgraded []storedTransaction // The document of each model
+	migrated, collisions := 0, 0
+	flush := func() error {
+		if len(models) == 0 {
+			return nil
+		}
+		_, err := collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		failed := make(map[int]bool)
+		var bulkErr mongo.BulkWriteException
+		if errors.As(err, &bulkErr) && bulkErr.WriteConcernError == nil {
+			for _, writeErr := range bulkErr.WriteErrors {
+				if !mongo.IsDuplicateKeyError(writeErr) {
+					return err
+				}
+				failed[writeErr.Index] = true
+				if queueErr := queueFingerprintCollision(ctx, upgraded[writeErr.Index]); queueErr != nil {
+					return queueErr
+				}
+			}
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+		migrated += len(models) - len(failed)
+		collisions += len(failed)
+		models, upgraded = models[:0], upgraded[:0]
+		return nil
+	}
+
+	userID := ""
+	ordinals := make(map[string]int)
+	for cursor.Next(ctx) {
+		var t storedTransaction
+		if err := cursor.Decode(&t); err != nil {
+			return fmt.Errorf("decoding transaction: %v", err)
+		}
+		if t.UserID != userID {
+			userID = t.UserID
+			ordinals = make(map[string]int)
+		}
+		upgradeLegacyTransaction(&t.Transaction)
+
+		ordinal := 0
+		if t.ExternalID == "" {
+			key := contentKey(t.Transaction)
+			ordinals[key]++
+			ordinal = ordinals[key]
+		}
+		t.Fingerprint = fingerprint(t.Transaction, ordinal)
+
+		update := bson.M{
+			"fingerprint": t.Fingerprint,
+			"source":      t.Source,
+			"category":    t.Category,
+		}
+		if t.ExternalID != "" {
+			update["externalId"] = t.ExternalID
+		}
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": t.ID}).
+			SetUpdate(bson.M{"$set": update}))
+		upgraded = append(upgraded, t)
+		if len(models) == bulkWriteBatch {
+			if err := flush(); err != nil {
+				return fmt.Errorf("storing fingerprints: %v", err)
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return fmt.Errorf("reading transactions: %v", err)
+	}
+	if err := flush(); err != nil {
+		return fmt.Errorf("storing fingerprints: %v", err)
+	}
+
+	if migrated > 0 {
+		log.Printf("Fingerprinted %d existing transactions", migrated)
+	}
+	if collisions > 0 {
+		log.Printf("Queued %d transactions imported again under a new source for duplicate review", collisions)
+	}
+	return nil
+}
+
+// queueFingerprintCollision queues an upgraded document and the transaction
+// already holding its fingerprint as a duplicate pair
+func queueFingerprintCollision(ctx context.Context, t storedTransaction) error {
+	var holder storedTransaction
+	filter := bson.M{"userId": t.UserID, "fingerprint": t.Fingerprint}
+	if err := collection.FindOne(ctx, filter).Decode(&holder); err != nil {
+		return fmt.Errorf("finding transaction with fingerprint of %s: %v", t.ID.Hex(), err)
+	}
+	pair := duplicatePair{Later: t, Earlier: holder, Similarity: 1}
+	_, err := queueDuplicates(ctx, t.UserID, []duplicatePair{pair})
+	return err
+}
+
+// isNotFound reports whether a command failed because the index or collection doesn't exist
+func isNotFound(err error) bool {
+	var cmdErr mongo.CommandError
+	return errors.As(err, &cmdErr) && (cmdErr.Code == 26 || cmdErr.Code == 27)
+}
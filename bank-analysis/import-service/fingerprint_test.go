@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// parseFixture parses a file of testdata/csv as an upload without a source would be
+func parseFixture(t *testing.T, name, source string) ParseResult {
+	t.Helper()
+	data, err := os.ReadFile("testdata/csv/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := parseStatement(name, bytes.NewReader(data), "user@example.com", source, "", nil)
+	if err != nil {
+		t.Fatalf("parsing %s: %v", name, err)
+	}
+	return result
+}
+
+// TestReimportMatchesMigratedTransactions re-imports statements that older
+// versions stored and checks the fresh transactions get the fingerprints the
+// migration gives the stored ones, so the re-import updates them.
+func TestReimportMatchesMigratedTransactions(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture string
+		legacy  func(Transaction) Transaction // How an older version stored the transaction
+	}{
+		{
+			name:    "nubank upload with the identifier as category",
+			fixture: "nubank_utf8_bom.csv",
+			legacy: func(t Transaction) Transaction {
+				t.Source = "nubank"
+				t.Category = t.ExternalID
+				t.ExternalID = ""
+				t.Fingerprint = ""
+				return t
+			},
+		},
+		{
+			name:    "folder scan without a source",
+			fixture: "itau_windows1252.csv",
+			legacy: func(t Transaction) Transaction {
+				t.Source = "import"
+				t.Fingerprint = fingerprint(t, 0)
+				return t
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fresh := parseFixture(t, tt.fixture, defaultSource).Transactions
+			if len(fresh) == 0 {
+				t.Fatal("no transactions parsed")
+			}
+
+			stored := make([]Transaction, len(fresh))
+			for i, tx := range fresh {
+				stored[i] = tt.legacy(tx)
+				upgradeLegacyTransaction(&stored[i])
+			}
+			assignFingerprints(stored)
+
+			for i := range fresh {
+				if stored[i].Fingerprint != fresh[i].Fingerprint {
+					t.Errorf("row %d: migrated fingerprint %s, re-import gives %s", i+1, stored[i].Fingerprint, fresh[i].Fingerprint)
+				}
+				if stored[i].Source != fresh[i].Source || stored[i].ExternalID != fresh[i].ExternalID {
+					t.Errorf("row %d: migrated to source %q and ID %q, re-import has %q and %q",
+						i+1, stored[i].Source, stored[i].ExternalID, fresh[i].Source, fresh[i].ExternalID)
+				}
+			}
+		})
+	}
+}
+
+// TestSameBankIDInTwoAccounts parses statements of two accounts whose bank
+// reused a transaction ID and checks both transactions are kept apart, while
+// an account's transaction still matches what older versions stored for it.
+func TestSameBankIDInTwoAccounts(t *testing.T) {
+	ofx := `OFXHEADER:100
+<OFX><BANKMSGSRSV1>
+<STMTTRNRS><STMTRS><CURDEF>BRL<BANKACCTFROM><BANKID>0341<ACCTID>12345-6</BANKACCTFROM>
+<BANKTRANLIST><STMTTRN><TRNTYPE>DEBIT<DTPOSTED>20240305<TRNAMT>-50.00<FITID>202403050001<NAME>PADARIA</STMTTRN></BANKTRANLIST>
+</STMTRS></STMTTRNRS>
+<STMTTRNRS><STMTRS><CURDEF>BRL<BANKACCTFROM><BANKID>0341<ACCTID>98765-4</BANKACCTFROM>
+<BANKTRANLIST><STMTTRN><TRNTYPE>DEBIT<DTPOSTED>20240305<TRNAMT>-50.00<FITID>202403050001<NAME>PADARIA</STMTTRN></BANKTRANLIST>
+</STMTRS></STMTTRNRS>
+</BANKMSGSRSV1></OFX>`
+
+	camt := `<?xml version="1.0" encoding="UTF-8"?>
+<Document xmlns="urn:iso:std:iso:20022:tech:xsd:camt.053.001.02"><BkToCstmrStmt>
+<Stmt><Id>S1</Id><Acct><Id><IBAN>DE89370400440532013000</IBAN></Id><Ccy>EUR</Ccy></Acct>
+<Ntry><Amt Ccy="EUR">50.00</Amt><CdtDbtInd>DBIT</CdtDbtInd><Sts>BOOK</Sts><BookgDt><Dt>2024-03-05</Dt></BookgDt><AcctSvcrRef>REF1</AcctSvcrRef><AddtlNtryInf>BAECKEREI</AddtlNtryInf></Ntry></Stmt>
+<Stmt><Id>S2</Id><Acct><Id><Othr><Id>0532013001</Id></Othr></Id><Ccy>EUR</Ccy></Acct>
+<Ntry><Amt Ccy="EUR">50.00</Amt><CdtDbtInd>DBIT</CdtDbtInd><Sts>BOOK</Sts><BookgDt><Dt>2024-03-05</Dt></BookgDt><AcctSvcrRef>REF1</AcctSvcrRef><AddtlNtryInf>BAECKEREI</AddtlNtryInf></Ntry></Stmt>
+</BkToCstmrStmt></Document>`
+
+	tests := []struct {
+		name     string
+		file     string
+		data     string
+		accounts []string
+	}{
+		{"ofx", "extrato.ofx", ofx, []string{"0341/12345-6", "0341/98765-4"}},
+		{"camt", "statement.xml", camt, []string{"DE89370400440532013000", "0532013001"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := parseStatement(tt.file, strings.NewReader(tt.data), "user@example.com", "", "", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result.Transactions) != 2 {
+				t.Fatalf("%d transactions, want 2", len(result.Transactions))
+			}
+			first, second := result.Transactions[0], result.Transactions[1]
+			if first.Account != tt.accounts[0] || second.Account != tt.accounts[1] {
+				t.Errorf("accounts %q and %q, want %q", first.Account, second.Account, tt.accounts)
+			}
+			if first.ExternalID != second.ExternalID {
+				t.Fatalf("bank IDs %q and %q, want them equal", first.ExternalID, second.ExternalID)
+			}
+			if first.Fingerprint == second.Fingerprint {
+				t.Error("transactions of two accounts share a fingerprint")
+			}
+
+			// Both would have matched a transaction older versions stored without the account
+			legacy := first
+			legacy.Account = ""
+			if accountlessFingerprint(first) != fingerprint(legacy, 0) || accountlessFingerprint(second) != fingerprint(legacy, 0) {
+				t.Error("accountless fingerprint differs from the one stored without an account")
+			}
+		})
+	}
+}
+
+// TestImportTakesOverAccountlessTransaction stores a transaction as older
+// versions did, without its account, and imports it again from each of two
+// accounts sharing the bank ID: the matching one takes the document over,
+// the other is stored on its own.
+func TestImportTakesOverAccountlessTransaction(t *testing.T) {
+	db := benchDatabase(t)
+	resetBenchDatabase(t, db)
+	ctx := context.Background()
+
+	day := time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)
+	ours := Transaction{UserID: "user@example.com", Date: day, Description: "PADARIA", Category: "Uncategorized",
+		Amount: 50, Type: "debit", Source: defaultSource, ExternalID: "202403050001", Account: "0341/12345-6"}
+	theirs := ours
+	theirs.Account, theirs.Amount = "0341/98765-4", 75
+
+	legacy := ours
+	legacy.Account = ""
+	legacy.Fingerprint = fingerprint(legacy, 0)
+	if _, err := collection.InsertOne(ctx, legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	transactions := []Transaction{ours, theirs}
+	assignFingerprints(transactions)
+	stats := upsertTransactions(ctx, "batch", transactions, nil)
+	if stats.Updated != 1 || stats.Inserted != 1 || len(stats.Errors) != 0 {
+		t.Fatalf("updated %d and inserted %d (%v), want 1 and 1", stats.Updated, stats.Inserted, stats.Errors)
+	}
+
+	var stored Transaction
+	if err := collection.FindOne(ctx, bson.M{"fingerprint": transactions[0].Fingerprint}).Decode(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Account != ours.Account {
+		t.Errorf("taken over document has account %q, want %q", stored.Account, ours.Account)
+	}
+	if n, err := collection.CountDocuments(ctx, bson.M{"userId": ours.UserID}); err != nil || n != 2 {
+		t.Errorf("%d transactions stored (%v), want 2", n, err)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxInstallments is the most installments a card purchase is split into;
+// larger counts are taken for something else, such as a date
+const maxInstallments = 48
+
+// installmentMarker matches an explicit installment marker anywhere in a
+// description: "Parcela 3/10", "PARC 03/10" or "parcela 3 de 10"
+var installmentMarker = regexp.MustCompile(`(?i)\b(?:parcela|parc)\.?\s*(\d{1,2})\s*(?:/|de)\s*(\d{1,2})\b`)
+
+// installmentSuffixMarker matches the bare "03/10" card statements append to a
+// description. Elsewhere it is too easily a date to be trusted.
+var installmentSuffixMarker = regexp.MustCompile(`\s(\d{1,2})/(\d{1,2})$`)
+
+// detectInstallments recognizes installment purchases and links their
+// installments. Statements charge the same amount every month and only give
+// the installment number, so the purchase is identified by what stays the
+// same across installments: merchant, count and the month of the first
+// installment, its purchase key, and the amount. The cents a total doesn't
+// divide into go to the first or last installment, so installments whose
+// amounts are within sameInstallmentAmount of each other share a purchase;
+// linkStoredInstallments does the same with those imported before. The total
+// value is the installment amount times the count.
+func detectInstallments(transactions []Transaction) {
+	type purchase struct {
+		id     string
+		amount float64
+	}
+	purchases := make(map[string][]purchase) // By purchase key
+
+	for i := range transactions {
+		t := &transactions[i]
+		installment, count, ok := parseInstallment(t.Description, t.Source)
+		if !ok {
+			continue
+		}
+
+		merchant := t.Merchant
+		if merchant == "" {
+			merchant = t.Description
+		}
+		merchant = installmentMarker.ReplaceAllString(merchant, "")
+		first := time.Date(t.Date.Year(), t.Date.Month()-time.Month(installment-1), 1, 0, 0, 0, 0, time.UTC)
+		key := fmt.Sprintf("%s|%s|%s|%s", t.UserID, t.Source, merchantKey(merchant), first.Format("2006-01"))
+		keySum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d", key, count)))
+
+		t.Installment = installment
+		t.Installments = count
+		t.PurchaseKey = hex.EncodeToString(keySum[:12])
+		t.PurchaseTotal = math.Round(t.Amount*float64(count)*100) / 100
+
+		for _, p := range purchases[t.PurchaseKey] {
+			if sameInstallmentAmount(p.amount, t.Amount, count) {
+				t.PurchaseID = p.id
+				break
+			}
+		}
+		if t.PurchaseID == "" {
+			// A new purchase, with the ID it had when the amount was part of the key
+			sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%.0f|%d", key, math.Round(t.Amount), count)))
+			t.PurchaseID = hex.EncodeToString(sum[:12])
+			purchases[t.PurchaseKey] = append(purchases[t.PurchaseKey], purchase{t.PurchaseID, t.Amount})
+		}
+	}
+}
+
+// sameInstallmentAmount reports whether two installments of a purchase split
+// into count can be a and b: the cents left over when dividing the total are
+// fewer than count and all charged in one installment.
+func sameInstallmentAmount(a, b float64, count int) bool {
+	return math.Round(math.Abs(a-b)*100) < float64(count)
+}
+
+// linkStoredInstallments gives parsed installments the purchase ID of the
+// stored installments of their purchase, found by purchase key and amount
+// like detectInstallments does within a file. A failure to look them up
+// leaves the IDs as parsed.
+func linkStoredInstallments(ctx context.Context, userID string, transactions []Transaction) {
+	var keys bson.A
+	seen := make(map[string]bool)
+	for _, t := range transactions {
+		if t.PurchaseKey != "" && !seen[t.PurchaseKey] {
+			seen[t.PurchaseKey] = true
+			keys = append(keys, t.PurchaseKey)
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+
+	linkCtx, linkCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer linkCancel()
+	projection := bson.M{"purchaseKey": 1, "purchaseId": 1, "amount": 1, "installments": 1}
+	cursor, err := collection.Find(linkCtx, bson.M{"userId": userID, "purchaseKey": bson.M{"$in": keys}}, options.Find().SetProjection(projection))
+	if err != nil {
+		log.Printf("Error loading stored installments for %s: %v", userID, err)
+		return
+	}
+	var stored []Transaction
+	if err := cursor.All(linkCtx, &stored); err != nil {
+		log.Printf("Error loading stored installments for %s: %v", userID, err)
+		return
+	}
+
+	// The parsed IDs are replaced everywhere, so installments of one purchase
+	// in the file stay together
+	linked := make(map[string]string)
+	for _, t := range transactions {
+		if t.PurchaseKey == "" {
+			continue
+		}
+		best := -1
+		for i, s := range stored {
+			if s.PurchaseKey != t.PurchaseKey || !sameInstallmentAmount(s.Amount, t.Amount, t.Installments) {
+				continue
+			}
+			if best == -1 || math.Abs(s.Amount-t.Amount) < math.Abs(stored[best].Amount-t.Amount) {
+				best = i
+			}
+		}
+		if best != -1 {
+			if _, ok := linked[t.PurchaseID]; !ok {
+				linked[t.PurchaseID] = stored[best].PurchaseID
+			}
+		}
+	}
+	for i := range transactions {
+		if id, ok := linked[transactions[i].PurchaseID]; ok {
+			transactions[i].PurchaseID = id
+		}
+	}
+}
+
+// parseInstallment reads the installment number and count of a description
+func parseInstallment(description, source string) (installment, count int, ok bool) {
+	match := installmentMarker.FindStringSubmatch(description)
+	if match == nil && source == "credit_card" {
+		match = installmentSuffixMarker.FindStringSubmatch(description)
+	}
+	if match == nil {
+		return 0, 0, false
+	}
+	installment, _ = strconv.Atoi(match[1])
+	count, _ = strconv.Atoi(match[2])
+	if count < 2 || count > maxInstallments || installment < 1 || installment > count {
+		return 0, 0, false
+	}
+	return installment, count, true
+}
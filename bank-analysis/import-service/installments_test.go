@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// installmentRow is a card purchase installment as parsed, before detection
+func installmentRow(date string, description string, amount float64) Transaction {
+	day, _ := time.Parse("2006-01-02", date)
+	t := Transaction{UserID: "user@example.com", Date: day, Description: description, Amount: amount, Type: "debit", Source: "credit_card"}
+	t.Merchant, t.Method, t.CounterpartyDocument = parseCounterparty(t.Description, t.Source, t.Type)
+	return t
+}
+
+// TestInstallmentsWithUnevenCents splits totals whose cents don't divide by
+// the count, so one installment differs across a whole unit or a .5 boundary,
+// and checks the installments still share a purchase while another purchase
+// of the merchant that month keeps its own
+func TestInstallmentsWithUnevenCents(t *testing.T) {
+	transactions := []Transaction{
+		// 299.98 in 3: the cent left over goes to the last installment
+		installmentRow("2024-01-10", "LOJA X - Parcela 1/3", 99.99),
+		installmentRow("2024-02-10", "LOJA X - Parcela 2/3", 99.99),
+		installmentRow("2024-03-10", "LOJA X - Parcela 3/3", 100.00),
+		// 1004.99 in 10: the 9 cents left over go to the first installment
+		installmentRow("2024-01-15", "MAGAZINE Y PARC 01/10", 100.58),
+		installmentRow("2024-02-15", "MAGAZINE Y PARC 02/10", 100.49),
+		// Bought the same month, split the same way, for another value
+		installmentRow("2024-01-20", "LOJA X - Parcela 1/3", 150.00),
+	}
+	detectInstallments(transactions)
+
+	for i, want := range []struct{ installment, count int }{{1, 3}, {2, 3}, {3, 3}, {1, 10}, {2, 10}, {1, 3}} {
+		if got := transactions[i]; got.Installment != want.installment || got.Installments != want.count {
+			t.Errorf("row %d: installment %d/%d, want %d/%d", i+1, got.Installment, got.Installments, want.installment, want.count)
+		}
+	}
+	if a, b, c := transactions[0].PurchaseID, transactions[1].PurchaseID, transactions[2].PurchaseID; a == "" || a != b || b != c {
+		t.Errorf("LOJA X installments have purchases %q, %q and %q, want one", a, b, c)
+	}
+	if transactions[3].PurchaseID != transactions[4].PurchaseID {
+		t.Error("MAGAZINE Y installments of 100.58 and 100.49 have different purchases")
+	}
+	if transactions[5].PurchaseID == transactions[0].PurchaseID {
+		t.Error("the second LOJA X purchase shares the first one's ID")
+	}
+	if transactions[0].PurchaseKey != transactions[5].PurchaseKey {
+		t.Error("the LOJA X purchases of the same month have different purchase keys")
+	}
+}
+
+// TestSameInstallmentAmount checks the tolerance grows with the count
+func TestSameInstallmentAmount(t *testing.T) {
+	tests := []struct {
+		a, b  float64
+		count int
+		want  bool
+	}{
+		{100.50, 100.49, 2, true},
+		{99.99, 100.00, 3, true},
+		{100.58, 100.49, 10, true},
+		{100.58, 100.48, 10, false},
+		{100.02, 100.00, 2, false},
+		{150.00, 99.99, 3, false},
+	}
+	for _, tt := range tests {
+		if got := sameInstallmentAmount(tt.a, tt.b, tt.count); got != tt.want {
+			t.Errorf("sameInstallmentAmount(%.2f, %.2f, %d) = %v, want %v", tt.a, tt.b, tt.count, got, tt.want)
+		}
+	}
+}
+
+// TestLinkStoredInstallments imports the installments of a purchase one
+// statement at a time, the amount crossing a whole unit between them, and
+// checks every import links to the purchase stored first
+func TestLinkStoredInstallments(t *testing.T) {
+	db := benchDatabase(t)
+	resetBenchDatabase(t, db)
+	ctx := context.Background()
+
+	var ids []string
+	for i, row := range []Transaction{
+		installmentRow("2024-01-10", "LOJA X - Parcela 1/3", 99.99),
+		installmentRow("2024-02-10", "LOJA X - Parcela 2/3", 99.99),
+		installmentRow("2024-03-10", "LOJA X - Parcela 3/3", 100.00),
+	} {
+		statement := []Transaction{row}
+		assignFingerprints(statement)
+		detectInstallments(statement)
+		linkStoredInstallments(ctx, row.UserID, statement)
+		if stats := upsertTransactions(ctx, "batch", statement, nil); stats.Inserted != 1 {
+			t.Fatalf("statement %d: inserted %d (%v), want 1", i+1, stats.Inserted, stats.Errors)
+		}
+		ids = append(ids, statement[0].PurchaseID)
+	}
+	if ids[0] != ids[1] || ids[1] != ids[2] {
+		t.Errorf("installments stored under purchases %v, want one", ids)
+	}
+}
@@ -0,0 +1,692 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ImportJob tracks an upload, folder scan or watched folder check that is
+// imported in the background
+type ImportJob struct {
+	ID              primitive.ObjectID  `json:"id" bson:"_id"`
+	UserID          string              `json:"userId" bson:"userId"`
+	Kind            string              `json:"kind" bson:"kind"`     // "upload", "scan" or "watch"
+	Status          string              `json:"status" bson:"status"` // "queued", "running", "completed", "partial", "failed" or "cancelled"
+	FileName        string              `json:"fileName,omitempty" bson:"fileName,omitempty"`
+	FileHash        string              `json:"fileHash,omitempty" bson:"fileHash,omitempty"`
+	FileID          *primitive.ObjectID `json:"-" bson:"fileId,omitempty"` // Uploaded content, kept in GridFS until the job ends
+	FolderPath      string              `json:"folderPath,omitempty" bson:"folderPath,omitempty"`
+	Source          string              `json:"source" bson:"source"`
+	ProfileID       string              `json:"profileId,omitempty" bson:"profileId,omitempty"`
+	Sheet           string              `json:"sheet,omitempty" bson:"sheet,omitempty"`       // Worksheet picked for an Excel upload
+	Currency        string              `json:"currency,omitempty" bson:"currency,omitempty"` // Currency of statements that don't state one
+	Format          string              `json:"format,omitempty" bson:"format,omitempty"`
+	FilesTotal      int                 `json:"filesTotal" bson:"filesTotal"`
+	FilesDone       int                 `json:"filesDone" bson:"filesDone"`
+	FilesUnchanged  int                 `json:"filesUnchanged,omitempty" bson:"filesUnchanged,omitempty"` // Watched files whose content was already processed
+	RowsParsed      int                 `json:"rowsParsed" bson:"rowsParsed"`
+	RowsSkipped     int                 `json:"rowsSkipped" bson:"rowsSkipped"` // Rows the parser could not read
+	RowsWritten     int                 `json:"rowsWritten" bson:"rowsWritten"` // Inserted or updated transactions
+	RowsUnchanged   int                 `json:"rowsUnchanged" bson:"rowsUnchanged"`
+	RowsFailed      int                 `json:"rowsFailed" bson:"rowsFailed"`           // Rows the database rejected
+	DuplicatesFound int                 `json:"duplicatesFound" bson:"duplicatesFound"` // Likely duplicates of other imports queued for review
+	Files           []FileReport        `json:"files,omitempty" bson:"files,omitempty"` // One report per file of a zip upload
+	ErrorCount      int                 `json:"errorCount" bson:"errorCount"`
+	Errors          []string            `json:"errors" bson:"errors"` // The first maxJobErrors messages
+	BatchIDs        []string            `json:"batchIds" bson:"batchIds"`
+	Message         string              `json:"message,omitempty" bson:"message,omitempty"`
+	CancelRequested bool                `json:"cancelRequested" bson:"cancelRequested"`
+	CreatedAt       time.Time           `json:"createdAt" bson:"createdAt"`
+	UpdatedAt       time.Time           `json:"updatedAt" bson:"updatedAt"`
+	FinishedAt      *time.Time          `json:"finishedAt,omitempty" bson:"finishedAt,omitempty"`
+}
+
+const (
+	// maxJobErrors bounds the error messages stored on a job; ErrorCount keeps the total
+	maxJobErrors = 100
+	// jobProgressInterval is how often a running job writes its progress to Mongo
+	jobProgressInterval = time.Second
+	// defaultImportWorkers is how many jobs run at once unless IMPORT_WORKERS says otherwise
+	defaultImportWorkers = 2
+)
+
+var jobCollection *mongo.Collection
+var uploadBucket *gridfs.Bucket
+
+// jobSlots bounds how many jobs run at the same time
+var jobSlots chan struct{}
+
+// runningJobs holds the cancel functions of the jobs running in this process
+var runningJobs = struct {
+	sync.Mutex
+	cancels map[primitive.ObjectID]context.CancelFunc
+}{cancels: make(map[primitive.ObjectID]context.CancelFunc)}
+
+// importWorkers reads the number of concurrent jobs from IMPORT_WORKERS
+func importWorkers() int {
+	if n, err := strconv.Atoi(os.Getenv("IMPORT_WORKERS")); err == nil && n > 0 {
+		return n
+	}
+	return defaultImportWorkers
+}
+
+// enqueueUploadJob keeps the uploaded content in GridFS so the job can still
+// run after a restart, then stores the job and starts it
+func enqueueUploadJob(ctx context.Context, userID string, upload uploadRequest) (*ImportJob, error) {
+	fileID, err := uploadBucket.UploadFromStream(upload.File.Name, bytes.NewReader(upload.File.Data))
+	if err != nil {
+		return nil, err
+	}
+
+	job := newJob(userID, "upload", upload.Source)
+	job.FileName = upload.File.Name
+	job.FileHash = upload.File.Hash
+	job.FileID = &fileID
+	job.ProfileID = upload.ProfileID
+	job.Sheet = upload.Sheet
+	job.Currency = upload.Currency
+	job.FilesTotal = 1
+
+	if err := enqueueJob(ctx, job); err != nil {
+		if delErr := uploadBucket.Delete(fileID); delErr != nil {
+			log.Printf("Warning: Failed to delete upload %s: %v", fileID.Hex(), delErr)
+		}
+		return nil, err
+	}
+	return job, nil
+}
+
+// enqueueScanJob stores a folder scan job and starts it
+func enqueueScanJob(ctx context.Context, userID, folderPath, source string) (*ImportJob, error) {
+	job := newJob(userID, "scan", source)
+	job.FolderPath = folderPath
+	if err := enqueueJob(ctx, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func newJob(userID, kind, source string) *ImportJob {
+	now := time.Now()
+	return &ImportJob{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		Kind:      kind,
+		Status:    "queued",
+		Source:    source,
+		Errors:    []string{},
+		BatchIDs:  []string{},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+}
+
+func enqueueJob(ctx context.Context, job *ImportJob) error {
+	if _, err := jobCollection.InsertOne(ctx, job); err != nil {
+		return err
+	}
+	go runJob(job.ID)
+	return nil
+}
+
+// resumeJobs restarts the jobs a previous run of the service left unfinished.
+// Imports are idempotent, so an interrupted job simply starts over.
+func resumeJobs(ctx context.Context) {
+	filter := bson.M{"status": bson.M{"$in": []string{"queued", "running"}}}
+	cursor, err := jobCollection.Find(ctx, filter, options.Find().SetSort(bson.M{"createdAt": 1}))
+	if err != nil {
+		log.Printf("Warning: Failed to load unfinished import jobs: %v", err)
+		return
+	}
+	var jobs []ImportJob
+	err = cursor.All(ctx, &jobs)
+	cursor.Close(ctx)
+	if err != nil {
+		log.Printf("Warning: Failed to parse unfinished import jobs: %v", err)
+		return
+	}
+
+	for _, job := range jobs {
+		log.Printf("Resuming import job %s (%s)", job.ID.Hex(), job.Status)
+		go runJob(job.ID)
+	}
+}
+
+// jobRun is the in-memory state of a running job. Progress is written to
+// Mongo at most every jobProgressInterval.
+type jobRun struct {
+	job       *ImportJob
+	lastSaved time.Time
+}
+
+// runJob waits for a free slot, claims the job and imports it
+func runJob(id primitive.ObjectID) {
+	jobSlots <- struct{}{}
+	defer func() { <-jobSlots }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Register before claiming so a cancel request can't slip in between
+	runningJobs.Lock()
+	runningJobs.cancels[id] = cancel
+	runningJobs.Unlock()
+	defer func() {
+		runningJobs.Lock()
+		delete(runningJobs.cancels, id)
+		runningJobs.Unlock()
+	}()
+
+	job, err := claimJob(id)
+	if err == mongo.ErrNoDocuments {
+		// The job was cancelled before it got to run
+		var pending ImportJob
+		findCtx, findCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		filter := bson.M{"_id": id, "status": bson.M{"$in": []string{"queued", "running"}}}
+		err := jobCollection.FindOne(findCtx, filter).Decode(&pending)
+		findCancel()
+		if err == nil {
+			(&jobRun{job: &pending}).finish("cancelled", "Import cancelled")
+		}
+		return
+	}
+	if err != nil {
+		log.Printf("Error claiming import job %s: %v", id.Hex(), err)
+		return
+	}
+
+	run := &jobRun{job: job, lastSaved: time.Now()}
+	switch job.Kind {
+	case "upload":
+		err = run.importUpload(ctx)
+	case "scan":
+		err = run.importFolder(ctx)
+	case "watch":
+		err = run.importWatchedFolder(ctx)
+	default:
+		err = fmt.Errorf("Unknown import job kind %q", job.Kind)
+	}
+
+	// Rejected rows or files make the import a partial success
+	status := "completed"
+	rejected := job.RowsSkipped + job.RowsFailed
+	if rejected > 0 || job.ErrorCount > 0 {
+		status = "partial"
+	}
+
+	switch {
+	case ctx.Err() != nil:
+		run.finish("cancelled", "Import cancelled")
+	case err != nil:
+		run.finish("failed", err.Error())
+	case job.Kind == "scan" || job.Kind == "watch" || job.Format == "zip":
+		run.finish(status, fmt.Sprintf("Successfully processed %d of %d files and imported %d transactions, %d rows rejected",
+			job.FilesDone, job.FilesTotal, job.RowsWritten, rejected))
+	default:
+		run.finish(status, fmt.Sprintf("Successfully imported %d of %d transactions, %d rows rejected",
+			job.RowsWritten, job.RowsParsed+job.RowsSkipped, rejected))
+	}
+}
+
+// claimJob moves a job that was not cancelled to "running" and resets its
+// progress, since a resumed job starts over. Batches an interrupted run left
+// open are closed so they can be rolled back.
+func claimJob(id primitive.ObjectID) (*ImportJob, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{
+		"_id":             id,
+		"status":          bson.M{"$in": []string{"queued", "running"}},
+		"cancelRequested": false,
+	}
+	update := bson.M{"$set": bson.M{
+		"status":          "running",
+		"filesDone":       0,
+		"filesUnchanged":  0,
+		"rowsParsed":      0,
+		"rowsSkipped":     0,
+		"rowsWritten":     0,
+		"rowsUnchanged":   0,
+		"rowsFailed":      0,
+		"duplicatesFound": 0,
+		"files":           []FileReport{},
+		"errorCount":      0,
+		"errors":          []string{},
+		"updatedAt":       time.Now(),
+	}}
+
+	var job ImportJob
+	err := jobCollection.FindOneAndUpdate(ctx, filter, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&job)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rows rejected by an interrupted run are found again
+	if _, err := rejectedCollection.DeleteMany(ctx, bson.M{"jobId": id}); err != nil {
+		log.Printf("Warning: Failed to clear rejected rows of job %s: %v", id.Hex(), err)
+	}
+	if err := interruptBatches(ctx, id.Hex()); err != nil {
+		log.Printf("Warning: Failed to close interrupted batches of job %s: %v", id.Hex(), err)
+	}
+	return &job, nil
+}
+
+// importUpload parses the uploaded file kept in GridFS and imports it, or
+// each statement in it when it is a zip archive
+func (run *jobRun) importUpload(ctx context.Context) error {
+	job := run.job
+	if job.FileID == nil {
+		return fmt.Errorf("Uploaded file is no longer available")
+	}
+
+	var data bytes.Buffer
+	if _, err := uploadBucket.DownloadToStream(*job.FileID, &data); err != nil {
+		log.Printf("Error reading upload of job %s: %v", job.ID.Hex(), err)
+		return fmt.Errorf("Uploaded file is no longer available")
+	}
+	file := statementFile{Name: job.FileName, Hash: job.FileHash, Data: data.Bytes()}
+
+	// Every statement of a zip is imported as if it was uploaded on its own
+	if isZipArchive(file) {
+		job.Format = "zip"
+		return run.importArchive(ctx, file)
+	}
+
+	result, err := parseUploadedFile(ctx, job.UserID, uploadRequest{File: file, Source: job.Source, ProfileID: job.ProfileID, Sheet: job.Sheet})
+	if err != nil {
+		return err
+	}
+	job.Format = result.Format
+
+	if len(result.Transactions) == 0 {
+		job.RowsSkipped = len(result.Skipped)
+		run.reject(file, result.Header, "parse", result.Skipped)
+		return fmt.Errorf("No valid transactions found in file")
+	}
+	if err := run.importFile(ctx, file, result); err != nil {
+		return err
+	}
+	job.FilesDone++
+	return nil
+}
+
+// importFolder imports every statement file of the job's folder. Files that
+// can't be read or parsed are reported and skipped.
+func (run *jobRun) importFolder(ctx context.Context) error {
+	job := run.job
+	folder, err := checkImportFolder(job.UserID, job.FolderPath)
+	if err != nil {
+		return err
+	}
+	files, err := listStatementFiles(folder)
+	if err != nil {
+		log.Printf("Error scanning folder %s: %v", job.FolderPath, err)
+		return fmt.Errorf("Failed to scan folder")
+	}
+	job.FilesTotal = len(files)
+	run.save(true)
+
+	userParsers := loadJobParsers(ctx, job.UserID)
+	for _, filePath := range files {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		file, err := readStatementFile(job.UserID, filePath)
+		if err != nil {
+			log.Printf("Error reading file %s: %v", filePath, err)
+			run.addError(fmt.Sprintf("%s: %v", filepath.Base(filePath), err))
+			continue
+		}
+		if _, err := run.importStatementFile(ctx, filePath, file, userParsers); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			run.addError(fmt.Sprintf("%s: %v", file.Name, err))
+			continue
+		}
+		job.FilesDone++
+		run.save(false)
+	}
+	return nil
+}
+
+// loadJobParsers loads the user's saved mappings, which take part in format
+// detection of folder files. A failure only costs the user's own profiles.
+func loadJobParsers(ctx context.Context, userID string) []StatementParser {
+	profileCtx, profileCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer profileCancel()
+	userParsers, err := loadUserParsers(profileCtx, userID)
+	if err != nil {
+		log.Printf("Error loading import profiles for %s: %v", userID, err)
+	}
+	return userParsers
+}
+
+// readStatementFile reads a file found in a folder of the user. Any part of
+// its path may have been replaced by a symlink since the folder was checked,
+// so the path is resolved and checked before opening the file, and again
+// after: the file read must be the one an allowed path leads to.
+func readStatementFile(userID, filePath string) (statementFile, error) {
+	resolved, err := checkImportPath(userID, filePath)
+	if err != nil {
+		return statementFile{}, err
+	}
+	f, err := os.Open(resolved)
+	if err != nil {
+		return statementFile{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return statementFile{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return statementFile{}, fmt.Errorf("not a regular file")
+	}
+	again, err := checkImportPath(userID, filePath)
+	if err != nil {
+		return statementFile{}, err
+	}
+	if current, err := os.Stat(again); err != nil || !os.SameFile(info, current) {
+		return statementFile{}, fmt.Errorf("file was replaced while being opened")
+	}
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return statementFile{}, err
+	}
+	return statementFile{Name: filepath.Base(filePath), Hash: hashContent(data), Data: data}, nil
+}
+
+// importStatementFile detects the format of a folder file and imports it. The
+// returned format is empty when the file could not be parsed.
+func (run *jobRun) importStatementFile(ctx context.Context, filePath string, file statementFile, userParsers []StatementParser) (string, error) {
+	job := run.job
+	result, err := parseStatement(filePath, bytes.NewReader(file.Data), job.UserID, job.Source, "", userParsers)
+	if err != nil {
+		log.Printf("Skipping file %s: %v", filePath, err)
+		return "", err
+	}
+	log.Printf("Detected format %s for %s", result.Format, filePath)
+
+	if len(result.Transactions) == 0 {
+		job.RowsSkipped += len(result.Skipped)
+		run.reject(file, result.Header, "parse", result.Skipped)
+		return result.Format, nil
+	}
+	if err := run.importFile(ctx, file, result); err != nil {
+		log.Printf("Error importing %s: %v", filePath, err)
+		return result.Format, err
+	}
+	return result.Format, nil
+}
+
+// importFile stores one parsed file as its own batch, reporting progress as
+// rows are written. A cancelled job may have left rows out, so the file is
+// not reported as imported: the context's error is returned.
+func (run *jobRun) importFile(ctx context.Context, file statementFile, result ParseResult) error {
+	job := run.job
+	job.RowsParsed += len(result.Transactions)
+	job.RowsSkipped += len(result.Skipped)
+	run.reject(file, result.Header, "parse", result.Skipped)
+	run.save(true)
+
+	applyCurrency(result.Transactions, job.Currency)
+	applyMerchantAliases(ctx, job.UserID, result.Transactions)
+	linkStoredInstallments(ctx, job.UserID, result.Transactions)
+	categorize(ctx, job.UserID, result.Transactions)
+
+	// Keep the reported balances so the statement can be reconciled later
+	if err := saveStatements(ctx, result.Statements); err != nil {
+		log.Printf("Error saving statement balances for %s: %v", file.Name, err)
+	}
+
+	// Record the import so it can be listed and rolled back
+	batch, err := startBatch(ctx, job.ID.Hex(), job.UserID, file.Name, file.Hash, result)
+	if err != nil {
+		return err
+	}
+	job.BatchIDs = append(job.BatchIDs, batch.ID.Hex())
+
+	written, unchanged, failed := job.RowsWritten, job.RowsUnchanged, job.RowsFailed
+	reported := 0
+	stats := upsertTransactions(ctx, batch.ID.Hex(), result.Transactions, func(stats upsertStats) {
+		job.RowsWritten = written + stats.Inserted + stats.Updated
+		job.RowsUnchanged = unchanged + stats.Unchanged
+		job.RowsFailed = failed + len(stats.Failed)
+		run.reject(file, result.Header, "write", stats.Failed[reported:])
+		for ; reported < len(stats.Errors); reported++ {
+			run.addError(stats.Errors[reported])
+		}
+		run.save(false)
+	})
+
+	// The batch is closed even when the job was cancelled so the rows written so far can be rolled back
+	finishCtx, finishCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer finishCancel()
+	if err := finishBatch(finishCtx, batch, stats); err != nil {
+		log.Printf("Error finishing import batch %s: %v", batch.ID.Hex(), err)
+	}
+	log.Printf("Batch %s: %d inserted, %d updated, %d unchanged, %d failed",
+		batch.ID.Hex(), stats.Inserted, stats.Updated, stats.Unchanged, len(stats.Errors))
+
+	// Look for the same transactions stored by imports of other statements
+	if ctx.Err() == nil && stats.Inserted+stats.Updated > 0 {
+		queued, err := detectBatchDuplicates(ctx, job.UserID, batch.ID.Hex())
+		if err != nil {
+			log.Printf("Error detecting duplicates of batch %s: %v", batch.ID.Hex(), err)
+		}
+		job.DuplicatesFound += queued
+	}
+	return ctx.Err()
+}
+
+func (run *jobRun) addError(message string) {
+	run.job.ErrorCount++
+	if len(run.job.Errors) < maxJobErrors {
+		run.job.Errors = append(run.job.Errors, message)
+	}
+}
+
+// save writes the job's progress, skipping the write when the last one was
+// recent unless force is set
+func (run *jobRun) save(force bool) {
+	if !force && time.Since(run.lastSaved) < jobProgressInterval {
+		return
+	}
+	run.lastSaved = time.Now()
+	run.update(bson.M{"$set": run.progress()})
+}
+
+// finish stores the final state of the job and drops its uploaded content
+func (run *jobRun) finish(status, message string) {
+	job := run.job
+	now := time.Now()
+	job.Status = status
+	job.Message = message
+	job.FinishedAt = &now
+
+	fields := run.progress()
+	fields["status"] = status
+	fields["message"] = message
+	fields["finishedAt"] = now
+	update := bson.M{"$set": fields}
+
+	if job.FileID != nil {
+		if err := uploadBucket.Delete(*job.FileID); err != nil && err != gridfs.ErrFileNotFound {
+			log.Printf("Warning: Failed to delete upload of job %s: %v", job.ID.Hex(), err)
+		}
+		job.FileID = nil
+		update["$unset"] = bson.M{"fileId": ""}
+	}
+
+	run.update(update)
+	log.Printf("Import job %s %s: %s", job.ID.Hex(), status, message)
+}
+
+func (run *jobRun) progress() bson.M {
+	job := run.job
+	job.UpdatedAt = time.Now()
+	return bson.M{
+		"format":          job.Format,
+		"filesTotal":      job.FilesTotal,
+		"filesDone":       job.FilesDone,
+		"filesUnchanged":  job.FilesUnchanged,
+		"rowsParsed":      job.RowsParsed,
+		"rowsSkipped":     job.RowsSkipped,
+		"rowsWritten":     job.RowsWritten,
+		"rowsUnchanged":   job.RowsUnchanged,
+		"rowsFailed":      job.RowsFailed,
+		"duplicatesFound": job.DuplicatesFound,
+		"files":           job.Files,
+		"errorCount":      job.ErrorCount,
+		"errors":          job.Errors,
+		"batchIds":        job.BatchIDs,
+		"updatedAt":       job.UpdatedAt,
+	}
+}
+
+// update writes to the job document with its own context, so progress is
+// still saved after the job's context was cancelled
+func (run *jobRun) update(update bson.M) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := jobCollection.UpdateByID(ctx, run.job.ID, update); err != nil {
+		log.Printf("Error saving import job %s: %v", run.job.ID.Hex(), err)
+	}
+}
+
+func listJobsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	findOptions := options.Find().SetSort(bson.M{"createdAt": -1}).SetLimit(50)
+	cursor, err := jobCollection.Find(ctx, bson.M{"userId": userID}, findOptions)
+	if err != nil {
+		log.Printf("Error finding import jobs: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	jobs := []ImportJob{}
+	if err := cursor.All(ctx, &jobs); err != nil {
+		log.Printf("Error parsing import jobs: %v", err)
+		http.Error(w, "Error parsing results", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jobs)
+}
+
+func getJobHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	jobID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid job ID format", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var job ImportJob
+	if err := jobCollection.FindOne(ctx, bson.M{"_id": jobID, "userId": userID}).Decode(&job); err != nil {
+		http.Error(w, "Import job not found", http.StatusNotFound)
+		return
+	}
+
+	rejected, err := findRejectedRows(ctx, jobID)
+	if err != nil {
+		log.Printf("Error finding rejected rows: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := struct {
+		ImportJob
+		Rejected []RejectedRow `json:"rejected"`
+	}{job, rejected}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// cancelJobHandler asks a queued or running job to stop. Rows written before
+// the job noticed stay imported and can be rolled back through their batch.
+func cancelJobHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	jobID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid job ID format", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"_id": jobID, "userId": userID, "status": bson.M{"$in": []string{"queued", "running"}}}
+	update := bson.M{"$set": bson.M{"cancelRequested": true, "updatedAt": time.Now()}}
+
+	var job ImportJob
+	err = jobCollection.FindOneAndUpdate(ctx, filter, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		count, countErr := jobCollection.CountDocuments(ctx, bson.M{"_id": jobID, "userId": userID})
+		if countErr == nil && count > 0 {
+			http.Error(w, "Import job already finished", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Import job not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error cancelling import job: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	runningJobs.Lock()
+	if cancelRun, ok := runningJobs.cancels[jobID]; ok {
+		cancelRun()
+	}
+	runningJobs.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// csvLocale is how one file writes its dates and amounts. It is decided once
+// from whole columns and applied to every row, so a file is never read with
+// day/month order on some rows and month/day on others.
+type csvLocale struct {
+	DateLayout       string
+	DecimalSeparator string // "," or "."
+}
+
+// displayLayoutReplacer turns a Go time layout back into the DD/MM/YYYY form users know
+var displayLayoutReplacer = strings.NewReplacer("2006", "YYYY", "01", "MM", "02", "DD", "06", "YY")
+
+// detectLocale decides the date layout and decimal separator of a file from
+// the values of its date and amount columns
+func (p *BankProfile) detectLocale(rows [][]string, cols csvColumns) (csvLocale, error) {
+	var dates, amounts []string
+	for _, row := range rows {
+		if s := cell(row, cols.date); s != "" {
+			dates = append(dates, dateOnly(s))
+		}
+		for _, i := range []int{cols.amount, cols.credit, cols.debit} {
+			if s := cell(row, i); s != "" {
+				amounts = append(amounts, s)
+			}
+		}
+	}
+
+	layout, err := detectDateLayout(dates, p.DateLayouts)
+	if err != nil {
+		return csvLocale{}, err
+	}
+	separator, err := detectDecimalSeparator(amounts, p.DecimalSeparator)
+	if err != nil {
+		return csvLocale{}, err
+	}
+	return csvLocale{DateLayout: layout, DecimalSeparator: separator}, nil
+}
+
+// dateOnly drops any time of day written after the date
+func dateOnly(s string) string {
+	if fields := strings.Fields(s); len(fields) > 0 {
+		return fields[0]
+	}
+	return s
+}
+
+// detectDateLayout picks the layout that reads the most dates. Another layout
+// reading just as many of them differently, as DD/MM and MM/DD do when no day
+// is above 12, makes the file ambiguous.
+func detectDateLayout(dates []string, layouts []string) (string, error) {
+	if len(layouts) == 1 {
+		return layouts[0], nil
+	}
+
+	parsed := make([][]time.Time, len(layouts))
+	best := 0
+	for i, layout := range layouts {
+		for _, s := range dates {
+			if date, err := time.Parse(layout, s); err == nil {
+				parsed[i] = append(parsed[i], date)
+			} else {
+				parsed[i] = append(parsed[i], time.Time{})
+			}
+		}
+		if countParsed(parsed[i]) > countParsed(parsed[best]) {
+			best = i
+		}
+	}
+
+	for i := range layouts {
+		if i == best || countParsed(parsed[i]) < countParsed(parsed[best]) {
+			continue
+		}
+		for j := range dates {
+			if !parsed[i][j].Equal(parsed[best][j]) {
+				return "", ambiguousDates(dates[j], displayLayoutReplacer.Replace(layouts[best]), displayLayoutReplacer.Replace(layouts[i]))
+			}
+		}
+	}
+	return layouts[best], nil
+}
+
+// ambiguousDates rejects a file whose dates all read two ways, date being one that does
+func ambiguousDates(date, layout, other string) error {
+	return fmt.Errorf("Ambiguous dates: %q reads as both %s and %s, no date in the file tells them apart", date, layout, other)
+}
+
+func countParsed(dates []time.Time) int {
+	n := 0
+	for _, d := range dates {
+		if !d.IsZero() {
+			n++
+		}
+	}
+	return n
+}
+
+// detectDecimalSeparator decides from a whole amount column whether "," or
+// "." separates the decimals. An amount using both tells by the one that comes
+// last, a separator repeated in one amount is a thousands separator, and a
+// single one followed by one or two digits is the decimal separator. A single
+// separator followed by three digits, as in 1,234, could be either and gives
+// no hint. fallback is used when no amount gives a hint; without one the
+// file is rejected if such amounts exist.
+func detectDecimalSeparator(amounts []string, fallback string) (string, error) {
+	votes := map[string]string{} // Separator voted for, with an amount showing it
+	ambiguous := ""
+	for _, amount := range amounts {
+		s, _ := splitCurrency(amount)
+		s = strings.TrimLeft(s, " (-+")
+		s = strings.TrimRight(s, " )-")
+
+		lastDot, lastComma := strings.LastIndex(s, "."), strings.LastIndex(s, ",")
+		switch {
+		case lastDot != -1 && lastComma != -1:
+			if lastComma > lastDot {
+				votes[","] = amount
+			} else {
+				votes["."] = amount
+			}
+		case lastDot != -1 || lastComma != -1:
+			sep, last := ".", lastDot
+			other := ","
+			if lastComma != -1 {
+				sep, last, other = ",", lastComma, "."
+			}
+			switch {
+			case strings.Count(s, sep) > 1:
+				votes[other] = amount
+			case len(s)-last-1 == 3:
+				ambiguous = amount
+			default:
+				votes[sep] = amount
+			}
+		}
+	}
+
+	switch {
+	case votes[","] != "" && votes["."] != "":
+		return "", fmt.Errorf("Amounts use both \",\" and \".\" as decimal separator, e.g. %q and %q", votes[","], votes["."])
+	case votes[","] != "":
+		return ",", nil
+	case votes["."] != "":
+		return ".", nil
+	case fallback != "":
+		return fallback, nil
+	case ambiguous != "":
+		return "", fmt.Errorf("Ambiguous amounts: %q could use \",\" or \".\" as decimal separator", ambiguous)
+	}
+	return ".", nil
+}
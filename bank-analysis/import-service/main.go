@@ -1,23 +1,22 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"math"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
@@ -27,20 +26,65 @@ type Transaction struct {
 	Date        time.Time `json:"date" bson:"date"`
 	Description string    `json:"description" bson:"description"`
 	Category    string    `json:"category" bson:"category"`
+	CategoryRuleID string `json:"categoryRuleId,omitempty" bson:"categoryRuleId,omitempty"` // Rule that set the category, see CategoryRule
 	Amount      float64   `json:"amount" bson:"amount"`
 	Type        string    `json:"type" bson:"type"` // "credit" or "debit"
 	Source      string    `json:"source" bson:"source"` // "checking" or "credit_card"
+	Merchant    string    `json:"merchant,omitempty" bson:"merchant,omitempty"` // Merchant or counterparty, see parseCounterparty
+	Method      string    `json:"method,omitempty" bson:"method,omitempty"` // "pix", "ted", "doc", "boleto", "debit" or "credit"
+	CounterpartyDocument string `json:"counterpartyDocument,omitempty" bson:"counterpartyDocument,omitempty"` // CPF or CNPJ of the counterparty, masked
+	// Installment purchases, see detectInstallments
+	Installment   int     `json:"installment,omitempty" bson:"installment,omitempty"`     // Number of this installment, from 1
+	Installments  int     `json:"installments,omitempty" bson:"installments,omitempty"`   // Installments the purchase was split into
+	PurchaseID    string  `json:"purchaseId,omitempty" bson:"purchaseId,omitempty"`       // Shared by the installments of one purchase
+	PurchaseKey   string  `json:"-" bson:"purchaseKey,omitempty"`                         // Purchase but for the amount, see detectInstallments
+	PurchaseTotal float64 `json:"purchaseTotal,omitempty" bson:"purchaseTotal,omitempty"` // Value of the whole purchase
+	ExternalID  string    `json:"externalId,omitempty" bson:"externalId,omitempty"` // Bank-assigned ID such as the OFX FITID
+	Account     string    `json:"account,omitempty" bson:"account,omitempty"` // Account the statement lists, the OFX BANKID/ACCTID or the CAMT IBAN
+	Fingerprint string    `json:"fingerprint" bson:"fingerprint"` // Identifies the transaction across imports, see fingerprint
+	Currency    string    `json:"currency,omitempty" bson:"currency,omitempty"` // ISO 4217 code, from the statement or the upload
+	BatchID     string    `json:"batchId,omitempty" bson:"batchId,omitempty"` // Import batch that last wrote the transaction
+	Line        int       `json:"line,omitempty" bson:"-"` // Line of the source file the transaction was read from
+	Raw         string    `json:"-" bson:"-"` // Record of the source file, kept to report rows the database rejects
+}
+
+// statementFile is an uploaded or scanned statement read into memory
+type statementFile struct {
+	Name string
+	Hash string
+	Data []byte
+}
+
+// ParseResult holds everything a statement parser extracted from one file
+type ParseResult struct {
+	Format       string // Name of the parser or bank profile that matched
+	Transactions []Transaction
+	Statements   []StatementBalance
+	Skipped      []SkippedRow
+	Header       string // Raw header line of CSV files, used to rebuild rejected rows
+}
+
+// SkippedRow is a record of the file that could not be turned into a transaction
+type SkippedRow struct {
+	Line   int    `json:"line,omitempty" bson:"line,omitempty"`
+	Raw    string `json:"raw,omitempty" bson:"raw,omitempty"`     // The record as it appears in the file
+	Field  string `json:"field,omitempty" bson:"field,omitempty"` // Field that failed validation, if a single one did
+	Reason string `json:"reason" bson:"reason"`
 }
 
 // Response represents the HTTP response
 type Response struct {
 	Message string `json:"message"`
 	Count   int    `json:"count,omitempty"`
+	Format  string `json:"format,omitempty"` // Detected statement format or bank profile
+	BatchID string `json:"batchId,omitempty"`
+	JobID   string `json:"jobId,omitempty"` // Background job importing the file
 	Errors  []string `json:"errors,omitempty"`
 }
 
 var client *mongo.Client
 var collection *mongo.Collection
+var statementCollection *mongo.Collection
 
 func main() {
 	// MongoDB connection
@@ -60,14 +104,30 @@ func main() {
 
 	collection = client.Database("bank_analysis").Collection("transactions")
 
+	// Fingerprint documents stored by older versions before the unique index is built
+	migrateCtx, migrateCancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	if err := migrateFingerprints(migrateCtx); err != nil {
+		log.Printf("Warning: Failed to migrate transaction fingerprints: %v", err)
+	}
+	migrateCancel()
+
 	// Create indexes for better query performance - FIXED: Use bson.D instead of bson.M
 	indexModels := []mongo.IndexModel{
 		{
 			Keys: bson.D{{Key: "userId", Value: 1}, {Key: "date", Value: -1}},
 		},
 		{
-			Keys: bson.D{{Key: "userId", Value: 1}, {Key: "description", Value: 1}, {Key: "date", Value: 1}, {Key: "amount", Value: 1}},
-			Options: options.Index().SetUnique(true), // Prevent duplicate entries
+			Keys: bson.D{{Key: "userId", Value: 1}, {Key: "fingerprint", Value: 1}},
+			Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.D{
+				{Key: "fingerprint", Value: bson.D{{Key: "$exists", Value: true}}},
+			}), // Prevent duplicate entries
+		},
+		{
+			// Installments are linked to the stored ones of their purchase, see linkStoredInstallments
+			Keys: bson.D{{Key: "userId", Value: 1}, {Key: "purchaseKey", Value: 1}},
+			Options: options.Index().SetPartialFilterExpression(bson.D{
+				{Key: "purchaseKey", Value: bson.D{{Key: "$exists", Value: true}}},
+			}),
 		},
 	}
 
@@ -77,6 +137,125 @@ func main() {
 		// Don't fatal here, just warn and continue
 	}
 
+	statementCollection = client.Database("bank_analysis").Collection("statements")
+	_, err = statementCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "userId", Value: 1}, {Key: "account", Value: 1}, {Key: "statementId", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Printf("Warning: Failed to create statement indexes: %v", err)
+	}
+
+	profileCollection = client.Database("bank_analysis").Collection("import_profiles")
+	_, err = profileCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "userId", Value: 1}, {Key: "name", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Printf("Warning: Failed to create profile indexes: %v", err)
+	}
+
+	batchCollection = client.Database("bank_analysis").Collection("import_batches")
+	_, err = batchCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "userId", Value: 1}, {Key: "createdAt", Value: -1}}},
+		// Batches a restarted job left open are looked up by job
+		{Keys: bson.D{{Key: "jobId", Value: 1}, {Key: "status", Value: 1}}},
+	})
+	if err != nil {
+		log.Printf("Warning: Failed to create batch indexes: %v", err)
+	}
+
+	batchChangeCollection = client.Database("bank_analysis").Collection("import_batch_changes")
+	_, err = batchChangeCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "batchId", Value: 1}},
+	})
+	if err != nil {
+		log.Printf("Warning: Failed to create batch change indexes: %v", err)
+	}
+
+	jobCollection = client.Database("bank_analysis").Collection("import_jobs")
+	_, err = jobCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "userId", Value: 1}, {Key: "createdAt", Value: -1}},
+	})
+	if err != nil {
+		log.Printf("Warning: Failed to create job indexes: %v", err)
+	}
+
+	rejectedCollection = client.Database("bank_analysis").Collection("import_rejected_rows")
+	_, err = rejectedCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "jobId", Value: 1}},
+	})
+	if err != nil {
+		log.Printf("Warning: Failed to create rejected row indexes: %v", err)
+	}
+
+	duplicateCollection = client.Database("bank_analysis").Collection("import_duplicates")
+	_, err = duplicateCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "userId", Value: 1}, {Key: "pairKey", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "userId", Value: 1}, {Key: "status", Value: 1}, {Key: "createdAt", Value: -1}},
+		},
+	})
+	if err != nil {
+		log.Printf("Warning: Failed to create duplicate indexes: %v", err)
+	}
+
+	watchCollection = client.Database("bank_analysis").Collection("import_watches")
+	_, err = watchCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "userId", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Printf("Warning: Failed to create watch indexes: %v", err)
+	}
+
+	watchedFileCollection = client.Database("bank_analysis").Collection("import_watched_files")
+	_, err = watchedFileCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "userId", Value: 1}, {Key: "path", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "userId", Value: 1}, {Key: "hash", Value: 1}},
+		},
+		{
+			Keys: bson.D{{Key: "userId", Value: 1}, {Key: "processedAt", Value: -1}},
+		},
+	})
+	if err != nil {
+		log.Printf("Warning: Failed to create watched file indexes: %v", err)
+	}
+
+	ruleCollection = client.Database("bank_analysis").Collection("category_rules")
+	_, err = ruleCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "userId", Value: 1}, {Key: "priority", Value: -1}},
+	})
+	if err != nil {
+		log.Printf("Warning: Failed to create category rule indexes: %v", err)
+	}
+
+	merchantAliasCollection = client.Database("bank_analysis").Collection("merchant_aliases")
+	_, err = merchantAliasCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "userId", Value: 1}, {Key: "key", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Printf("Warning: Failed to create merchant alias indexes: %v", err)
+	}
+
+	// Uploaded files are kept until their job finishes so it can resume after a restart
+	uploadBucket, err = gridfs.NewBucket(client.Database("bank_analysis"), options.GridFSBucket().SetName("import_uploads"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	jobSlots = make(chan struct{}, importWorkers())
+	resumeJobs(ctx)
+	go watchFolders()
+
 	// HTTP server
 	router := mux.NewRouter()
 	
@@ -89,6 +268,48 @@ func main() {
 	// Routes for import functionality - do NOT include /api/import prefix (the API gateway adds it)
 	router.HandleFunc("/upload", uploadHandler).Methods("POST")
 	router.HandleFunc("/scan", scanFolderHandler).Methods("POST")
+	router.HandleFunc("/folders", listFoldersHandler).Methods("GET")
+	router.HandleFunc("/preview", previewHandler).Methods("POST")
+
+	// Folder imported automatically whenever statement files appear or change in it
+	router.HandleFunc("/watch", getWatchHandler).Methods("GET")
+	router.HandleFunc("/watch", putWatchHandler).Methods("PUT")
+	router.HandleFunc("/watch", deleteWatchHandler).Methods("DELETE")
+
+	// Background import jobs
+	router.HandleFunc("/jobs", listJobsHandler).Methods("GET")
+	router.HandleFunc("/jobs/{id}", getJobHandler).Methods("GET")
+	router.HandleFunc("/jobs/{id}/cancel", cancelJobHandler).Methods("POST")
+	router.HandleFunc("/jobs/{id}/rejected.csv", rejectedRowsCSVHandler).Methods("GET")
+
+	// Import history and rollback
+	router.HandleFunc("/batches", listBatchesHandler).Methods("GET")
+	router.HandleFunc("/batches/{id}", rollbackBatchHandler).Methods("DELETE")
+
+	// Review queue of transactions imported twice from different statements
+	router.HandleFunc("/duplicates", listDuplicatesHandler).Methods("GET")
+	router.HandleFunc("/duplicates/detect", detectDuplicatesHandler).Methods("POST")
+	router.HandleFunc("/duplicates/{id}/merge", mergeDuplicateHandler).Methods("POST")
+	router.HandleFunc("/duplicates/{id}/keep", keepDuplicateHandler).Methods("POST")
+
+	// User-defined rules that categorize transactions as they are imported
+	router.HandleFunc("/rules", listRulesHandler).Methods("GET")
+	router.HandleFunc("/rules", createRuleHandler).Methods("POST")
+	router.HandleFunc("/rules/apply", applyRulesHandler).Methods("POST")
+	router.HandleFunc("/rules/{id}", updateRuleHandler).Methods("PUT")
+	router.HandleFunc("/rules/{id}", deleteRuleHandler).Methods("DELETE")
+
+	// Names the user prefers for merchants spelled differently across statements
+	router.HandleFunc("/merchants/aliases", listMerchantAliasesHandler).Methods("GET")
+	router.HandleFunc("/merchants/aliases", createMerchantAliasHandler).Methods("POST")
+	router.HandleFunc("/merchants/aliases/{id}", deleteMerchantAliasHandler).Methods("DELETE")
+
+	// User-defined column mappings for banks without a built-in profile
+	router.HandleFunc("/profiles", listProfilesHandler).Methods("GET")
+	router.HandleFunc("/profiles", createProfileHandler).Methods("POST")
+	router.HandleFunc("/profiles/{id}", getProfileHandler).Methods("GET")
+	router.HandleFunc("/profiles/{id}", updateProfileHandler).Methods("PUT")
+	router.HandleFunc("/profiles/{id}", deleteProfileHandler).Methods("DELETE")
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -99,6 +320,9 @@ func main() {
 	log.Fatal(http.ListenAndServe(":"+port, router))
 }
 
+// uploadHandler stores the uploaded file and imports it in the background.
+// A zip archive imports each statement it contains. The returned job ID can
+// be polled on /jobs/{id}.
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
     // Extract user ID from the request
     userID := r.Header.Get("X-User-ID")
@@ -110,229 +334,181 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    upload, err := readUpload(w, r)
+    if err != nil {
+        http.Error(w, err.Error(), uploadErrorStatus(err))
+        return
+    }
+
+    // Reject a broken or oversized archive before storing it
+    if isZipArchive(upload.File) {
+        if _, err := openArchive(upload.File.Data); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+    defer cancel()
+    
+    job, err := enqueueUploadJob(ctx, userID, upload)
+    if err != nil {
+        log.Printf("ERROR: Failed to create import job: %v", err)
+        http.Error(w, "Database error", http.StatusInternalServerError)
+        return
+    }
+    
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusAccepted)
+    json.NewEncoder(w).Encode(Response{
+        Message: "Import started",
+        JobID:   job.ID.Hex(),
+    })
+}
+
+// uploadRequest is a statement file received by the upload endpoints together
+// with the form fields that control how it is parsed
+type uploadRequest struct {
+    File      statementFile
+    Source    string
+    ProfileID string
+    Sheet     string // Worksheet of an Excel workbook, empty picks one
+    Currency  string // Currency of the transactions whose statement doesn't state one
+}
+
+// parseUpload reads the multipart "file" field and parses it, honoring the
+// optional "source", "profileId", "sheet" and "currency" form fields. It returns the file name and
+// errors whose message can be shown to the client.
+func parseUpload(ctx context.Context, w http.ResponseWriter, r *http.Request, userID string) (ParseResult, statementFile, error) {
+    upload, err := readUpload(w, r)
+    if err != nil {
+        return ParseResult{}, statementFile{}, err
+    }
+    if isZipArchive(upload.File) {
+        return ParseResult{}, statementFile{}, fmt.Errorf("Zip archives can't be previewed, upload them to import each statement")
+    }
+    result, err := parseUploadedFile(ctx, userID, upload)
+    applyCurrency(result.Transactions, upload.Currency)
+    return result, upload.File, err
+}
+
+// maxUploadSize bounds the request body of an upload, the file and the form
+// fields together. The file is held in memory while it is parsed or stored.
+const maxUploadSize = 64 << 20
+
+// errUploadTooLarge is returned for request bodies over maxUploadSize
+var errUploadTooLarge = fmt.Errorf("File is too large, uploads are limited to %d MB", maxUploadSize>>20)
+
+// uploadErrorStatus is the status an error of readUpload is answered with
+func uploadErrorStatus(err error) int {
+    if errors.Is(err, errUploadTooLarge) {
+        return http.StatusRequestEntityTooLarge
+    }
+    return http.StatusBadRequest
+}
+
+// readUpload reads the multipart "file" field and the form fields that go with it
+func readUpload(w http.ResponseWriter, r *http.Request) (uploadRequest, error) {
+    if r.ContentLength > maxUploadSize {
+        return uploadRequest{}, errUploadTooLarge
+    }
+    r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+
     // Parse multipart form with 32MB max memory
     if err := r.ParseMultipartForm(32 << 20); err != nil {
+        var tooLarge *http.MaxBytesError
+        if errors.As(err, &tooLarge) {
+            log.Printf("ERROR: Upload exceeds %d bytes", maxUploadSize)
+            return uploadRequest{}, errUploadTooLarge
+        }
         log.Printf("ERROR: Failed to parse form: %v", err)
-        http.Error(w, "Failed to parse form", http.StatusBadRequest)
-        return
+        return uploadRequest{}, fmt.Errorf("Failed to parse form")
     }
 
     // Get uploaded file
     file, header, err := r.FormFile("file")
     if err != nil {
         log.Printf("ERROR: Failed to get file from form: %v", err)
-        http.Error(w, "Failed to get file from form", http.StatusBadRequest)
-        return
+        return uploadRequest{}, fmt.Errorf("Failed to get file from form")
     }
     log.Printf("Received file: %s, size: %d bytes", header.Filename, header.Size)
     defer file.Close()
-
-    // Process CSV file
-    reader := csv.NewReader(file)
     
-    // Skip header row
-    headerRow, err := reader.Read()
+    // Keep the content in memory so the batch can record its hash
+    data, err := io.ReadAll(file)
     if err != nil {
-        log.Printf("ERROR: Failed to read CSV header: %v", err)
-        http.Error(w, "Failed to read CSV header", http.StatusBadRequest)
-        return
+        log.Printf("ERROR: Failed to read uploaded file: %v", err)
+        return uploadRequest{}, fmt.Errorf("Failed to read uploaded file")
     }
-    
-    log.Printf("CSV Headers: %v", headerRow)
-    
-    // Determine column indices based on Nubank format
-    dateCol := -1
-    amountCol := -1
-    identifierCol := -1
-    descriptionCol := -1
-    
-    for i, header := range headerRow {
-        header = strings.ToLower(strings.TrimSpace(header))
-        switch header {
-        case "data":
-            dateCol = i
-        case "valor":
-            amountCol = i
-        case "identificador":
-            identifierCol = i
-        case "descrição", "descricao":
-            descriptionCol = i
-        }
+
+    // Source applies to formats that don't identify the account type themselves
+    source := r.FormValue("source")
+    if err := checkSource(source); err != nil {
+        return uploadRequest{}, err
     }
-    
-    // Check if required columns were found
-    if dateCol == -1 || amountCol == -1 || descriptionCol == -1 {
-        log.Printf("Required columns not found. Headers: %v", headerRow)
-        http.Error(w, "CSV format not recognized. Requires Data, Valor, and Descrição columns", http.StatusBadRequest)
-        return
+    if source == "" {
+        source = defaultSource
     }
-    
-    // Process rows
-    var transactions []Transaction
-    lineCount := 1 // Header is line 1
-    
-    for {
-        lineCount++
-        row, err := reader.Read()
-        if err == io.EOF {
-            break
-        }
-        if err != nil {
-            log.Printf("ERROR: Failed to read CSV row: %v", err)
-            http.Error(w, "Failed to read CSV row", http.StatusBadRequest)
-            return
-        }
-        
-        log.Printf("Processing row %d: %v", lineCount, row)
-        
-        // Skip if we don't have enough columns
-        if len(row) <= dateCol || len(row) <= amountCol || len(row) <= descriptionCol {
-            log.Printf("Row %d has insufficient columns", lineCount)
-            continue
-        }
-        
-        // Parse date (Nubank format is likely DD/MM/YYYY)
-        dateStr := strings.TrimSpace(row[dateCol])
-        date, err := time.Parse("02/01/2006", dateStr)
-        if err != nil {
-            // Try alternative date formats
-            formats := []string{"2006-01-02", "01/02/2006", "02-01-2006"}
-            parsed := false
-            
-            for _, format := range formats {
-                if date, err = time.Parse(format, dateStr); err == nil {
-                    parsed = true
-                    break
-                }
-            }
-            
-            if !parsed {
-                log.Printf("Row %d: Invalid date format: %s", lineCount, dateStr)
-                continue
-            }
-        }
-        
-        // Parse description
-        description := strings.TrimSpace(row[descriptionCol])
-        
-        // Parse amount
-        amountStr := strings.TrimSpace(row[amountCol])
-        amountStr = strings.ReplaceAll(amountStr, ".", "") // Remove thousand separators
-        amountStr = strings.ReplaceAll(amountStr, ",", ".") // Convert decimal comma to point
-        amountStr = strings.ReplaceAll(amountStr, "R$", "") // Remove currency symbol
-        amountStr = strings.TrimSpace(amountStr)
-        
-        amount, err := strconv.ParseFloat(amountStr, 64)
-        if err != nil {
-            log.Printf("Row %d: Invalid amount format: %s", lineCount, amountStr)
-            continue
-        }
-        
-        // Determine transaction type based on amount
-        transType := "debit"
-        if amount > 0 {
-            transType = "credit"
-        }
-        amount = math.Abs(amount) // Store amount as positive
-        
-        // Get category from identifier or set default
-        category := "Uncategorized"
-        if identifierCol >= 0 && len(row) > identifierCol {
-            identifier := strings.TrimSpace(row[identifierCol])
-            if identifier != "" {
-                category = identifier
-            }
-        }
-        
-        transaction := Transaction{
-            UserID:      userID,
-            Date:        date,
-            Description: description,
-            Category:    category,
-            Amount:      amount,
-            Type:        transType,
-            Source:      "nubank",
+
+    // Currency applies to statements that don't state theirs
+    currency := ""
+    if value := r.FormValue("currency"); value != "" {
+        if currency = normalizeCurrency(value); currency == "" {
+            return uploadRequest{}, fmt.Errorf("Currency must be an ISO 4217 code such as BRL or USD")
         }
-        
-        transactions = append(transactions, transaction)
-        log.Printf("Added transaction: %+v", transaction)
     }
-    
-    // Insert transactions into MongoDB
-    if len(transactions) > 0 {
-        ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-        defer cancel()
-        
-        // Try to insert one by one for better error reporting
-        insertedCount := 0
-        var insertErrors []string
-        
-        for i, t := range transactions {
-            // Create a filter to find existing transactions
-            filter := bson.D{
-                {Key: "userId", Value: t.UserID},
-                {Key: "description", Value: t.Description},
-                {Key: "date", Value: t.Date},
-                {Key: "amount", Value: t.Amount},
-            }
-            
-            // Create an update document
-            update := bson.D{{Key: "$set", Value: t}}
-            
-            // Set upsert option (insert if not exists, update if exists)
-            opts := options.UpdateOptions{}
-            opts.SetUpsert(true)
-            
-            // Perform the upsert operation
-            result, err := collection.UpdateOne(ctx, filter, update, &opts)
-            if err != nil {
-                log.Printf("Error upserting transaction %d: %v", i, err)
-                insertErrors = append(insertErrors, fmt.Sprintf("Row %d: %v", i+1, err))
-            } else {
-                if result.UpsertedCount > 0 {
-                    // New document inserted
-                    insertedCount++
-                    log.Printf("Inserted new transaction for row %d", i+1)
-                } else if result.ModifiedCount > 0 {
-                    // Existing document updated
-                    insertedCount++
-                    log.Printf("Updated existing transaction for row %d", i+1)
-                } else {
-                    // Document already exists and wasn't modified
-                    log.Printf("Transaction already exists and is identical for row %d", i+1)
-                }
-            }
+
+    return uploadRequest{
+        File:      statementFile{Name: header.Filename, Hash: hashContent(data), Data: data},
+        Source:    source,
+        ProfileID: r.FormValue("profileId"),
+        Sheet:     r.FormValue("sheet"),
+        Currency:  currency,
+    }, nil
+}
+
+// parseUploadedFile parses an upload with the profile the user picked, or
+// detects its format when no profile was given
+func parseUploadedFile(ctx context.Context, userID string, upload uploadRequest) (ParseResult, error) {
+    var result ParseResult
+    var err error
+    if upload.ProfileID != "" {
+        profile, loadErr := loadUserProfile(ctx, userID, upload.ProfileID)
+        if loadErr != nil {
+            log.Printf("ERROR: Failed to load profile %s: %v", upload.ProfileID, loadErr)
+            return ParseResult{}, fmt.Errorf("Import profile not found")
         }
-        
-        // Create detailed response
-        resp := Response{
-            Message: fmt.Sprintf("Successfully imported %d of %d transactions", insertedCount, len(transactions)),
-            Count:   insertedCount,
+        var parser StatementParser = profile.toBankProfile()
+        if (workbookParser{}).Detect(upload.File.Name, upload.File.Data) {
+            parser = workbookParser{Sheet: upload.Sheet, Profiles: []*BankProfile{profile.toBankProfile()}}
         }
-        
-        if len(insertErrors) > 0 {
-            // Add error details to the response
-            // Use custom minimum function instead of built-in min
-            maxErrors := 5
-            if len(insertErrors) < maxErrors {
-                maxErrors = len(insertErrors)
-            }
-            
-            resp.Errors = insertErrors[:maxErrors]
-            if len(insertErrors) > maxErrors {
-                resp.Message += fmt.Sprintf(" and %d more errors", len(insertErrors)-maxErrors)
-            }
+        result, err = parseWith(parser, bytes.NewReader(upload.File.Data), userID, upload.Source)
+    } else {
+        userParsers, loadErr := loadUserParsers(ctx, userID)
+        if loadErr != nil {
+            log.Printf("Error loading import profiles for %s: %v", userID, loadErr)
         }
-        
-        w.Header().Set("Content-Type", "application/json")
-        json.NewEncoder(w).Encode(resp)
-        return
+        result, err = parseStatement(upload.File.Name, bytes.NewReader(upload.File.Data), userID, upload.Source, upload.Sheet, userParsers)
+    }
+    if err != nil {
+        log.Printf("ERROR: Failed to parse %s: %v", upload.File.Name, err)
+        return ParseResult{}, err
     }
     
-    // No transactions were processed
-    http.Error(w, "No valid transactions found in CSV", http.StatusBadRequest)
+    log.Printf("Detected format %s for %s", result.Format, upload.File.Name)
+    return result, nil
 }
 
+// dedupFilter builds the filter used to match an already imported transaction
+func dedupFilter(t Transaction) bson.D {
+    return bson.D{
+        {Key: "userId", Value: t.UserID},
+        {Key: "fingerprint", Value: t.Fingerprint},
+    }
+}
+
+// scanFolderHandler imports every statement file of a folder in the background.
+// The folder must lie within the user's import directory or a shared folder, see resolveImportFolder.
 func scanFolderHandler(w http.ResponseWriter, r *http.Request) {
     // Extract user ID from the request
     userID := r.Header.Get("X-User-ID")
@@ -357,198 +533,69 @@ func scanFolderHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
     
+    if err := checkSource(req.Source); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
     // Use default source if not provided
     if req.Source == "" {
-        req.Source = "import"
+        req.Source = defaultSource
+    }
+    
+    folder, err := resolveImportFolder(userID, req.FolderPath)
+    if err == errFolderNotAllowed {
+        http.Error(w, err.Error(), http.StatusForbidden)
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
     }
     
-    // List CSV files in the directory
-    files, err := filepath.Glob(filepath.Join(req.FolderPath, "*.csv"))
+    // Check the folder up front so obvious mistakes are reported right away
+    files, err := listStatementFiles(folder)
     if err != nil {
         http.Error(w, "Failed to scan folder", http.StatusInternalServerError)
         return
     }
     
     if len(files) == 0 {
-        http.Error(w, "No CSV files found in the specified folder", http.StatusBadRequest)
+        http.Error(w, "No statement files found in the specified folder", http.StatusBadRequest)
         return
     }
     
-    // Process each CSV file
-    totalProcessed := 0
-    totalFiles := 0
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
     
-    for _, filePath := range files {
-        file, err := os.Open(filePath)
-        if err != nil {
-            log.Printf("Error opening file %s: %v", filePath, err)
-            continue
-        }
-        
-        // Process CSV file
-        reader := csv.NewReader(file)
-        
-        // Skip header row
-        headerRow, err := reader.Read()
-        if err != nil {
-            file.Close()
-            continue
-        }
-        
-        // Determine column indices based on headers
-        dateCol := -1
-        amountCol := -1
-        identifierCol := -1
-        descriptionCol := -1
-        
-        for i, header := range headerRow {
-            header = strings.ToLower(strings.TrimSpace(header))
-            switch header {
-            case "data":
-                dateCol = i
-            case "valor":
-                amountCol = i
-            case "identificador":
-                identifierCol = i
-            case "descrição", "descricao":
-                descriptionCol = i
-            }
-        }
-        
-        // Skip if required columns not found
-        if dateCol == -1 || amountCol == -1 || descriptionCol == -1 {
-            file.Close()
-            continue
-        }
-        
-        // Process rows
-        var transactions []Transaction
-        
-        for {
-            row, err := reader.Read()
-            if err == io.EOF {
-                break
-            }
-            if err != nil {
-                break
-            }
-            
-            // Skip if we don't have enough columns
-            if len(row) <= dateCol || len(row) <= amountCol || len(row) <= descriptionCol {
-                continue
-            }
-            
-            // Parse date
-            dateStr := strings.TrimSpace(row[dateCol])
-            date, err := time.Parse("02/01/2006", dateStr)
-            if err != nil {
-                // Try alternative date formats
-                formats := []string{"2006-01-02", "01/02/2006", "02-01-2006"}
-                parsed := false
-                
-                for _, format := range formats {
-                    if date, err = time.Parse(format, dateStr); err == nil {
-                        parsed = true
-                        break
-                    }
-                }
-                
-                if !parsed {
-                    continue
-                }
-            }
-            
-            // Parse description
-            description := strings.TrimSpace(row[descriptionCol])
-            
-            // Parse amount
-            amountStr := strings.TrimSpace(row[amountCol])
-            amountStr = strings.ReplaceAll(amountStr, ".", "") // Remove thousand separators
-            amountStr = strings.ReplaceAll(amountStr, ",", ".") // Convert decimal comma to point
-            amountStr = strings.ReplaceAll(amountStr, "R$", "") // Remove currency symbol
-            amountStr = strings.TrimSpace(amountStr)
-            
-            amount, err := strconv.ParseFloat(amountStr, 64)
-            if err != nil {
-                continue
-            }
-            
-            // Determine transaction type based on amount
-            transType := "debit"
-            if amount > 0 {
-                transType = "credit"
-            }
-            amount = math.Abs(amount) // Store amount as positive
-            
-            // Get category from identifier or set default
-            category := "Uncategorized"
-            if identifierCol >= 0 && len(row) > identifierCol {
-                identifier := strings.TrimSpace(row[identifierCol])
-                if identifier != "" {
-                    category = identifier
-                }
-            }
-            
-            transaction := Transaction{
-                UserID:      userID,
-                Date:        date,
-                Description: description,
-                Category:    category,
-                Amount:      amount,
-                Type:        transType,
-                Source:      req.Source,
-            }
-            
-            transactions = append(transactions, transaction)
-        }
-        
-        file.Close()
-        
-        // Insert transactions into MongoDB
-        if len(transactions) > 0 {
-            ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-            
-            // Use upsert for each transaction
-            insertedCount := 0
-            
-            for _, t := range transactions {
-                // Create a filter to find existing transactions
-                filter := bson.D{
-                    {Key: "userId", Value: t.UserID},
-                    {Key: "description", Value: t.Description},
-                    {Key: "date", Value: t.Date},
-                    {Key: "amount", Value: t.Amount},
-                }
-                
-                // Create an update document
-                update := bson.D{{Key: "$set", Value: t}}
-                
-                // Set upsert option
-                opts := options.UpdateOptions{}
-                opts.SetUpsert(true)
-                
-                // Perform the upsert operation
-                result, err := collection.UpdateOne(ctx, filter, update, &opts)
-                if err == nil {
-                    if result.UpsertedCount > 0 || result.ModifiedCount > 0 {
-                        insertedCount++
-                    }
-                }
-            }
-            
-            cancel()
-            
-            totalProcessed += insertedCount
-            totalFiles++
-        }
+    job, err := enqueueScanJob(ctx, userID, folder, req.Source)
+    if err != nil {
+        log.Printf("ERROR: Failed to create import job: %v", err)
+        http.Error(w, "Database error", http.StatusInternalServerError)
+        return
     }
     
-    // Create response
-    resp := Response{
-        Message: fmt.Sprintf("Successfully processed %d files and imported %d transactions", totalFiles, totalProcessed),
-        Count:   totalProcessed,
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusAccepted)
+    json.NewEncoder(w).Encode(Response{
+        Message: fmt.Sprintf("Scanning %d files", len(files)),
+        JobID:   job.ID.Hex(),
+    })
+}
+
+// listStatementFiles lists the regular files of a folder; the format of each
+// one is detected from its content. Symlinks are left out, they could point
+// outside the import directory.
+func listStatementFiles(folderPath string) ([]string, error) {
+    entries, err := os.ReadDir(folderPath)
+    if err != nil {
+        return nil, err
     }
     
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(resp)
-}
\ No newline at end of file
+    var files []string
+    for _, entry := range entries {
+        if entry.Type().IsRegular() {
+            files = append(files, filepath.Join(folderPath, entry.Name()))
+        }
+    }
+    return files, nil
+}
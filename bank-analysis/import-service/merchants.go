@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Descriptions such as "Transferência enviada pelo Pix - FULANO DE TAL -
+// •••.123.456-•• - BCO XYZ" or "Compra no débito - PADARIA X" are split into
+// the merchant or counterparty, the payment method and the document ID of the
+// counterparty. The description itself is stored untouched.
+
+// paymentMethods maps the operation a description starts with to its method,
+// tried in order. The operation is followed by the counterparty.
+var paymentMethods = []struct {
+	Method    string
+	Operation *regexp.Regexp
+}{
+	{"pix", regexp.MustCompile(`(?i)^(?:transfer[êe]ncia (?:enviada|recebida) pelo pix|pix (?:enviado|recebido|transf(?:er[êe]ncia)?)|pagamento (?:de|via) pix|pix)\b`)},
+	{"ted", regexp.MustCompile(`(?i)^(?:transfer[êe]ncia (?:enviada|recebida)|ted(?: (?:enviad[ao]|recebid[ao]))?)\b`)},
+	{"doc", regexp.MustCompile(`(?i)^doc(?: (?:enviad[ao]|recebid[ao]))?\b`)},
+	{"boleto", regexp.MustCompile(`(?i)^(?:pagamento de boleto(?: efetuado)?|boleto(?: pago)?)\b`)},
+	{"debit", regexp.MustCompile(`(?i)^(?:compra no d[ée]bito|compra d[ée]bito|d[ée]bito)\b`)},
+	{"credit", regexp.MustCompile(`(?i)^(?:compra no cr[ée]dito|compra cr[ée]dito)\b`)},
+}
+
+// refundOperation matches the words a refund starts with, followed by the
+// merchant of the purchase refunded, as in "Estorno Netflix.com"
+var refundOperation = regexp.MustCompile(`(?i)^(?:estorno|reembolso|devolu[çc][ãa]o)(?:\s+(?:de|da|do))?\b`)
+
+// billPayment matches the payments of a card bill, as in "Pagamento em 14
+// FEV" or "Pagamento recebido", which have no counterparty
+var billPayment = regexp.MustCompile(`(?i)^pagamento(?:\s+(?:em|recebido|efetuado|d[ae] fatura|fatura)\b.*)?$`)
+
+// documentPattern matches CPFs and CNPJs, with or without the digits banks mask
+var documentPattern = regexp.MustCompile(`[\d•*xX]{3}\.[\d•*xX]{3}\.[\d•*xX]{3}-[\d•*xX]{2}|[\d•*xX]{2}\.[\d•*xX]{3}\.[\d•*xX]{3}/[\d•*xX]{4}-[\d•*xX]{2}`)
+
+// paymentProcessorPrefix matches the card processors that put their name
+// before the merchant's, as in "PAG*PadariaReal" or "IFD*Restaurante"
+var paymentProcessorPrefix = regexp.MustCompile(`(?i)^(?:pag|pagseguro|mp|mercadopago|mercpago|pg|ec|sumup|iz|picpay|ifd|paypal|pp|ebanx|ebn|dl|google|stone)\s?\*\s*`)
+
+// installmentSuffix matches the installment marker card statements append, as in "Loja X - Parcela 3/10"
+var installmentSuffix = regexp.MustCompile(`(?i)\s*-?\s*(?:(?:parcela|parc)\.?\s*\d{1,2}\s*(?:/|de)\s*\d{1,2}|\d{1,2}\s*/\s*\d{1,2})$`)
+
+// companySuffix matches the legal form companies carry at the end of their name
+var companySuffix = regexp.MustCompile(`(?i)\s+(?:ltda|me|epp|eireli|s/?a|s\.a\.?)\.?$`)
+
+// merchantConnectors stay lowercase in merchant names
+var merchantConnectors = map[string]bool{"de": true, "da": true, "do": true, "das": true, "dos": true, "e": true}
+
+// describeCounterparties fills in the merchant, payment method and document of parsed transactions
+func describeCounterparties(transactions []Transaction) {
+	for i := range transactions {
+		t := &transactions[i]
+		t.Merchant, t.Method, t.CounterpartyDocument = parseCounterparty(t.Description, t.Source, t.Type)
+	}
+}
+
+// parseCounterparty splits a description into the merchant or counterparty,
+// the payment method and the counterparty's document ID. Card purchases
+// without an operation are credit purchases of the merchant in the description.
+// Refunds are of the merchant that follows, and bill payments have none.
+func parseCounterparty(description, source, transType string) (merchant, method, document string) {
+	description = strings.Join(strings.Fields(description), " ")
+	if match := documentPattern.FindString(description); match != "" {
+		document = maskDocument(match)
+	}
+
+	rest := description
+	if loc := refundOperation.FindStringIndex(rest); loc != nil {
+		rest = strings.TrimLeft(rest[loc[1]:], " -:")
+	}
+	for _, candidate := range paymentMethods {
+		if loc := candidate.Operation.FindStringIndex(rest); loc != nil {
+			method = candidate.Method
+			rest = strings.TrimLeft(rest[loc[1]:], " -:")
+			break
+		}
+	}
+	if method == "" && billPayment.MatchString(rest) {
+		return "", "", document
+	}
+	if method == "" && source == "credit_card" && transType == "debit" {
+		method = "credit"
+	}
+
+	// The counterparty comes first; document and bank follow in segments of their own
+	for _, segment := range strings.Split(rest, " - ") {
+		if name := normalizeMerchant(segment); name != "" {
+			return name, method, document
+		}
+	}
+	return "", method, document
+}
+
+// normalizeMerchant cleans a merchant name up for grouping: it drops
+// documents, processor prefixes, installment markers and legal forms, and
+// capitalizes the words
+func normalizeMerchant(name string) string {
+	name = documentPattern.ReplaceAllString(name, "")
+	name = paymentProcessorPrefix.ReplaceAllString(strings.TrimSpace(name), "")
+	// "UBER *TRIP" names the merchant before the asterisk
+	if before, _, found := strings.Cut(name, "*"); found && strings.TrimSpace(before) != "" {
+		name = before
+	}
+	name = installmentSuffix.ReplaceAllString(strings.TrimSpace(name), "")
+	name = strings.Trim(name, " -*.:/")
+	name = companySuffix.ReplaceAllString(name, "")
+	if strings.IndexFunc(name, unicode.IsLetter) == -1 {
+		return ""
+	}
+
+	words := strings.Fields(strings.ToLower(name))
+	for i, word := range words {
+		if i > 0 && merchantConnectors[word] {
+			continue
+		}
+		runes := []rune(word)
+		runes[0] = unicode.ToUpper(runes[0])
+		words[i] = string(runes)
+	}
+	return strings.Join(words, " ")
+}
+
+// maskDocument hides a CPF the statement shows in full the way banks mask
+// them, keeping the middle digits. CNPJs identify companies and are kept.
+func maskDocument(document string) string {
+	if len(document) != len("000.000.000-00") || strings.ContainsAny(document, "•*xX") {
+		return document
+	}
+	return "•••" + document[3:11] + "-••"
+}
+
+// MerchantAlias merges a spelling of a merchant into the name the user prefers
+type MerchantAlias struct {
+	ID        primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	UserID    string             `json:"userId" bson:"userId"`
+	Alias     string             `json:"alias" bson:"alias"`
+	Key       string             `json:"-" bson:"key"` // Alias as compared, see merchantKey
+	Merchant  string             `json:"merchant" bson:"merchant"`
+	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
+}
+
+var merchantAliasCollection *mongo.Collection
+
+// merchantKey compares merchant names ignoring case, accents and punctuation
+func merchantKey(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return ' '
+	}, normalizeHeader(name))
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// loadMerchantAliases returns the merchant each of the user's aliases stands for, by key
+func loadMerchantAliases(ctx context.Context, userID string) (map[string]string, error) {
+	cursor, err := merchantAliasCollection.Find(ctx, bson.M{"userId": userID})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var aliases []MerchantAlias
+	if err := cursor.All(ctx, &aliases); err != nil {
+		return nil, err
+	}
+	merchants := make(map[string]string, len(aliases))
+	for _, alias := range aliases {
+		merchants[alias.Key] = alias.Merchant
+	}
+	return merchants, nil
+}
+
+// applyMerchantAliases renames the merchants of parsed transactions the user
+// gave another name. A failure to load the aliases leaves the names as parsed.
+func applyMerchantAliases(ctx context.Context, userID string, transactions []Transaction) {
+	aliasCtx, aliasCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer aliasCancel()
+	merchants, err := loadMerchantAliases(aliasCtx, userID)
+	if err != nil {
+		log.Printf("Error loading merchant aliases for %s: %v", userID, err)
+		return
+	}
+	for i := range transactions {
+		if merchant, ok := merchants[merchantKey(transactions[i].Merchant)]; ok && transactions[i].Merchant != "" {
+			transactions[i].Merchant = merchant
+		}
+	}
+}
+
+func listMerchantAliasesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	findOptions := options.Find().SetSort(bson.D{{Key: "merchant", Value: 1}, {Key: "alias", Value: 1}})
+	cursor, err := merchantAliasCollection.Find(ctx, bson.M{"userId": userID}, findOptions)
+	if err != nil {
+		log.Printf("Error finding merchant aliases: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	aliases := []MerchantAlias{}
+	if err := cursor.All(ctx, &aliases); err != nil {
+		log.Printf("Error parsing merchant aliases: %v", err)
+		http.Error(w, "Error parsing results", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(aliases)
+}
+
+// createMerchantAliasHandler stores an alias and renames the merchant in the
+// transactions already stored under that spelling
+func createMerchantAliasHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	var alias MerchantAlias
+	if err := json.NewDecoder(r.Body).Decode(&alias); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	alias.Merchant = strings.TrimSpace(alias.Merchant)
+	alias.Key = merchantKey(alias.Alias)
+	if alias.Key == "" || alias.Merchant == "" {
+		http.Error(w, "Alias and merchant are required", http.StatusBadRequest)
+		return
+	}
+	if alias.Key == merchantKey(alias.Merchant) {
+		http.Error(w, "Alias and merchant are the same name", http.StatusBadRequest)
+		return
+	}
+
+	alias.ID = primitive.NewObjectID()
+	alias.UserID = userID
+	alias.CreatedAt = time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if _, err := merchantAliasCollection.InsertOne(ctx, alias); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			http.Error(w, "An alias with this name already exists", http.StatusConflict)
+			return
+		}
+		log.Printf("Error inserting merchant alias: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Stored spellings differ in case and accents, so they are compared by key
+	stored, err := collection.Distinct(ctx, "merchant", bson.M{"userId": userID})
+	if err != nil {
+		log.Printf("Error finding merchants to rename: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	var spellings bson.A
+	for _, value := range stored {
+		if name, ok := value.(string); ok && name != alias.Merchant && merchantKey(name) == alias.Key {
+			spellings = append(spellings, name)
+		}
+	}
+	renamed := 0
+	if len(spellings) > 0 {
+		filter := bson.M{"userId": userID, "merchant": bson.M{"$in": spellings}}
+		result, err := collection.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"merchant": alias.Merchant}})
+		if err != nil {
+			log.Printf("Error renaming merchant %s: %v", alias.Alias, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		renamed = int(result.ModifiedCount)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(Response{
+		Message: fmt.Sprintf("Alias created, %d transactions renamed", renamed),
+		Count:   renamed,
+	})
+}
+
+// deleteMerchantAliasHandler removes an alias. Transactions keep the merchant
+// they were renamed to until their statement is imported again.
+func deleteMerchantAliasHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	objectID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid alias ID format", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := merchantAliasCollection.DeleteOne(ctx, bson.M{"_id": objectID, "userId": userID})
+	if err != nil {
+		log.Printf("Error deleting merchant alias: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if result.DeletedCount == 0 {
+		http.Error(w, "Alias not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Response{Message: "Alias deleted successfully"})
+}
@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+// TestParseCounterparty splits the descriptions banks write into merchant,
+// method and document
+func TestParseCounterparty(t *testing.T) {
+	tests := []struct {
+		description string
+		source      string
+		transType   string
+		merchant    string
+		method      string
+		document    string
+	}{
+		{"Transferência enviada pelo Pix - FULANO DE TAL - •••.123.456-•• - BCO XYZ", "checking", "debit", "Fulano de Tal", "pix", "•••.123.456-••"},
+		{"Pix recebido - MARIA DA SILVA - 123.456.789-00", "checking", "credit", "Maria da Silva", "pix", "•••.456.789-••"},
+		{"Compra no débito - PADARIA X", "checking", "debit", "Padaria X", "debit", ""},
+		{"TED recebida - EMPRESA ABC LTDA - 12.345.678/0001-90", "checking", "credit", "Empresa Abc", "ted", "12.345.678/0001-90"},
+		{"Pagamento de boleto efetuado - CONDOMINIO EDIFICIO SOL", "checking", "debit", "Condominio Edificio Sol", "boleto", ""},
+		{"SUPERMERCADO EXTRA", "checking", "debit", "Supermercado Extra", "", ""},
+		// Card purchases
+		{"Uber *Trip", "credit_card", "debit", "Uber", "credit", ""},
+		{"IFD*Restaurante Sabor", "credit_card", "debit", "Restaurante Sabor", "credit", ""},
+		{"Mercadolivre*loja - Parcela 2/10", "credit_card", "debit", "Mercadolivre", "credit", ""},
+		// Refunds are of the merchant after the operation
+		{"Estorno Netflix.com", "credit_card", "credit", "Netflix.com", "", ""},
+		{"Estorno de compra no débito - PADARIA X", "checking", "credit", "Padaria X", "debit", ""},
+		{"Reembolso - LOJA Y", "credit_card", "credit", "Loja Y", "", ""},
+		// Bill payments have no counterparty
+		{"Pagamento em 14 FEV", "credit_card", "credit", "", "", ""},
+		{"Pagamento recebido", "credit_card", "credit", "", "", ""},
+		{"PAGAMENTO DA FATURA", "credit_card", "credit", "", "", ""},
+		{"Pagamento via Pix - JOSE", "checking", "debit", "Jose", "pix", ""},
+	}
+	for _, tt := range tests {
+		merchant, method, document := parseCounterparty(tt.description, tt.source, tt.transType)
+		if merchant != tt.merchant || method != tt.method || document != tt.document {
+			t.Errorf("parseCounterparty(%q) = %q, %q, %q; want %q, %q, %q",
+				tt.description, merchant, method, document, tt.merchant, tt.method, tt.document)
+		}
+	}
+}
+
+// TestNormalizeMerchant checks spellings of one merchant end up the same
+func TestNormalizeMerchant(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"PADARIA REAL LTDA", "Padaria Real"},
+		{"Padaria Real ME", "Padaria Real"},
+		{"PAG*PADARIA REAL", "Padaria Real"},
+		{"PAGSEGURO * Padaria Real", "Padaria Real"},
+		{"UBER *TRIP", "Uber"},
+		{"LOJA X - PARCELA 3/10", "Loja X"},
+		{"LOJA X 03/10", "Loja X"},
+		{"CASA DOS PAES S.A.", "Casa dos Paes"},
+		{"FULANO 12.345.678/0001-90", "Fulano"},
+		{"•••.123.456-••", ""},
+		{"  ", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeMerchant(tt.name); got != tt.want {
+			t.Errorf("normalizeMerchant(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
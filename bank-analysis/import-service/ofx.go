@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ofxTransaction holds the raw fields of a single STMTTRN aggregate
+type ofxTransaction struct {
+	Line       int
+	Start      int // Offset of the <STMTTRN> tag in the file, for error reports
+	DatePosted string
+	Amount     string
+	FITID      string
+	Name       string
+	Memo       string
+	Source     string
+	Account    string // BANKID/ACCTID of the statement, or the card's ACCTID
+	Currency   string // CURDEF of the statement the transaction belongs to
+}
+
+// isOFXFile reports whether the file name looks like an OFX statement
+func isOFXFile(filename string) bool {
+	return strings.EqualFold(filepath.Ext(filename), ".ofx")
+}
+
+// parseOFX reads an OFX statement and converts its STMTTRN entries into
+// transactions. OFX 1.x (SGML, where leaf elements have no closing tag) and
+// OFX 2.x (XML) are both handled by the same tag scanner.
+func parseOFX(file io.Reader, userID string) (ParseResult, error) {
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return ParseResult{}, fmt.Errorf("Failed to read OFX file")
+	}
+
+	body := string(data)
+	start := strings.Index(strings.ToUpper(body), "<OFX>")
+	if start == -1 {
+		return ParseResult{}, fmt.Errorf("OFX format not recognized. Missing <OFX> element")
+	}
+	line := strings.Count(body[:start], "\n") + 1
+	full := body
+	body = body[start:]
+
+	var result ParseResult
+	var current *ofxTransaction
+	source := "checking"
+	currency := ""
+	bankID, accountID := "", ""
+
+	for len(body) > 0 {
+		open := strings.IndexByte(body, '<')
+		if open == -1 {
+			break
+		}
+		end := strings.IndexByte(body[open:], '>')
+		if end == -1 {
+			break
+		}
+		tag := strings.ToUpper(strings.TrimSpace(body[open+1 : open+end]))
+		line += strings.Count(body[:open], "\n")
+		body = body[open+end+1:]
+
+		// Text up to the next tag is the element value (SGML leaves are not closed)
+		text := body
+		if next := strings.IndexByte(body, '<'); next != -1 {
+			text = body[:next]
+		}
+		value := strings.TrimSpace(html.UnescapeString(text))
+
+		switch tag {
+		case "BANKMSGSRSV1", "STMTRS":
+			source = "checking"
+			bankID, accountID = "", ""
+		case "CREDITCARDMSGSRSV1", "CCSTMTRS":
+			source = "credit_card"
+			bankID, accountID = "", ""
+		case "STMTTRN":
+			account := accountID
+			if bankID != "" && accountID != "" {
+				account = bankID + "/" + accountID
+			}
+			current = &ofxTransaction{Line: line, Start: len(full) - len(body) - end - 1, Source: source, Account: account, Currency: currency}
+		case "/STMTTRN":
+			if current == nil {
+				continue
+			}
+			raw := full[current.Start : len(full)-len(body)]
+			if t, err := current.toTransaction(userID); err != nil {
+				log.Printf("Skipping OFX transaction %q: %v", current.FITID, err)
+				result.Skipped = append(result.Skipped, skippedRow(current.Line, raw, err))
+			} else {
+				t.Raw = raw
+				result.Transactions = append(result.Transactions, t)
+			}
+			current = nil
+		}
+
+		// CURDEF and the account are given by the statement before its
+		// transactions; an ACCTID within a transaction names a transfer's other side
+		switch {
+		case tag == "CURDEF":
+			currency = normalizeCurrency(value)
+		case tag == "BANKID" && current == nil:
+			bankID = value
+		case tag == "ACCTID" && current == nil:
+			accountID = value
+		}
+
+		if current == nil || value == "" {
+			continue
+		}
+
+		switch tag {
+		case "DTPOSTED":
+			current.DatePosted = value
+		case "TRNAMT":
+			current.Amount = value
+		case "FITID":
+			current.FITID = value
+		case "NAME":
+			current.Name = value
+		case "MEMO":
+			current.Memo = value
+		}
+	}
+
+	return result, nil
+}
+
+// toTransaction converts the raw OFX fields into a Transaction
+func (o *ofxTransaction) toTransaction(userID string) (Transaction, error) {
+	// DTPOSTED is YYYYMMDD optionally followed by time and timezone, e.g. 20240105120000[-3:BRT]
+	if len(o.DatePosted) < 8 {
+		return Transaction{}, invalidField("date", "invalid DTPOSTED %q", o.DatePosted)
+	}
+	date, err := time.Parse("20060102", o.DatePosted[:8])
+	if err != nil {
+		return Transaction{}, invalidField("date", "invalid DTPOSTED %q", o.DatePosted)
+	}
+
+	// The OFX spec allows a comma as decimal separator
+	amountStr := o.Amount
+	if !strings.Contains(amountStr, ".") {
+		amountStr = strings.ReplaceAll(amountStr, ",", ".")
+	}
+	amount, err := strconv.ParseFloat(amountStr, 64)
+	if err != nil {
+		return Transaction{}, invalidField("amount", "invalid TRNAMT %q", o.Amount)
+	}
+
+	transType := "debit"
+	if amount > 0 {
+		transType = "credit"
+	}
+
+	// Banks disagree on which of NAME and MEMO carries the useful text
+	description := o.Name
+	if o.Memo != "" && o.Memo != o.Name {
+		if description == "" {
+			description = o.Memo
+		} else {
+			description += " - " + o.Memo
+		}
+	}
+
+	return Transaction{
+		UserID:      userID,
+		Date:        date,
+		Description: description,
+		Category:    "Uncategorized",
+		Amount:      math.Abs(amount),
+		Type:        transType,
+		Source:      o.Source,
+		ExternalID:  o.FITID,
+		Account:     o.Account,
+		Currency:    o.Currency,
+		Line:        o.Line,
+	}, nil
+}
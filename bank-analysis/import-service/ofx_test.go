@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// ofxRow is what a test expects of one parsed row
+type ofxRow struct {
+	line        int
+	date        string
+	description string
+	amount      float64
+	transType   string
+	fitID       string
+}
+
+// TestOFXFixtures parses the SGML and XML exports of testdata/ofx and checks
+// every row, the sign of TRNAMT deciding credit or debit.
+func TestOFXFixtures(t *testing.T) {
+	tests := []struct {
+		fixture string
+		source  string
+		account string
+		rows    []ofxRow
+		skipped []int // Lines of the transactions reported as skipped
+	}{
+		{
+			fixture: "itau_sgml.ofx",
+			source:  "checking",
+			account: "0341/12345-6",
+			rows: []ofxRow{
+				{40, "2024-03-04", "PAG BOLETO - CONDOMINIO", 150, "debit", "20240304001"},
+				{48, "2024-03-05", "SALARIO ACME & CIA", 5000, "credit", "20240305001"},
+				{55, "2024-03-08", "PIX ENVIADO PADARIA", 89.90, "debit", "20240308001"},
+			},
+			skipped: []int{62},
+		},
+		{
+			fixture: "nubank_xml.ofx",
+			source:  "credit_card",
+			account: "5d1f7a2c-0000-4000-8000-000000000001",
+			rows: []ofxRow{
+				{23, "2024-02-10", "Uber *Trip", 15.40, "debit", "65c7a1f0-0000-4000-8000-000000000001"},
+				{30, "2024-02-10", "Uber *Trip", 15.40, "debit", "65c7a1f0-0000-4000-8000-000000000002"},
+				{37, "2024-02-14", "Pagamento recebido", 1000, "credit", "65c7a1f0-0000-4000-8000-000000000003"},
+				{44, "2024-02-25", "Estorno - Netflix.com", 55.90, "credit", "65c7a1f0-0000-4000-8000-000000000004"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			data, err := os.ReadFile("testdata/ofx/" + tt.fixture)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := parseStatement(tt.fixture, bytes.NewReader(data), "user@example.com", "", "", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Format != "ofx" {
+				t.Errorf("format %s, want ofx", result.Format)
+			}
+
+			if len(result.Transactions) != len(tt.rows) {
+				t.Fatalf("%d transactions, want %d", len(result.Transactions), len(tt.rows))
+			}
+			fingerprints := make(map[string]bool)
+			for i, w := range tt.rows {
+				got := result.Transactions[i]
+				if got.Line != w.line || got.Date.Format("2006-01-02") != w.date || got.Description != w.description ||
+					got.Amount != w.amount || got.Type != w.transType || got.ExternalID != w.fitID {
+					t.Errorf("row %d: line %d %s %q %.2f %s %s, want line %d %s %q %.2f %s %s", i+1,
+						got.Line, got.Date.Format("2006-01-02"), got.Description, got.Amount, got.Type, got.ExternalID,
+						w.line, w.date, w.description, w.amount, w.transType, w.fitID)
+				}
+				if got.Source != tt.source || got.Account != tt.account || got.Currency != "BRL" {
+					t.Errorf("row %d: source %s, account %s and currency %s, want %s, %s and BRL", i+1, got.Source, got.Account, got.Currency, tt.source, tt.account)
+				}
+				fingerprints[got.Fingerprint] = true
+			}
+			if len(fingerprints) != len(tt.rows) {
+				t.Errorf("%d distinct fingerprints for %d rows", len(fingerprints), len(tt.rows))
+			}
+
+			if len(result.Skipped) != len(tt.skipped) {
+				t.Fatalf("%d transactions skipped, want %d", len(result.Skipped), len(tt.skipped))
+			}
+			for i, line := range tt.skipped {
+				if got := result.Skipped[i]; got.Line != line || got.Field != "date" {
+					t.Errorf("skipped line %d for %s, want line %d for the date", got.Line, got.Field, line)
+				}
+			}
+		})
+	}
+}
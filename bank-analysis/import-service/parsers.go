@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// StatementParser is implemented by every supported statement format
+type StatementParser interface {
+	// Name identifies the format in import responses
+	Name() string
+	// Detect reports whether the file looks like this format, given its name
+	// and the first bytes of its content
+	Detect(filename string, head []byte) bool
+	// Parse reads the whole file. source is only used by formats that don't
+	// say which account they come from.
+	Parse(file io.Reader, userID, source string) (ParseResult, error)
+}
+
+// detectHeadSize is how much of a file is handed to Detect
+const detectHeadSize = 8192
+
+// parsers is the registry consulted for every imported file, in order.
+// Structured formats come first and the generic CSV profile last, so it only
+// picks up files no specific profile claimed.
+var parsers []StatementParser
+
+func init() {
+	parsers = []StatementParser{ofxParser{}, qifParser{}, camtParser{}, workbookParser{}, pdfParser{}}
+	for _, p := range bankProfiles {
+		parsers = append(parsers, p)
+	}
+}
+
+// detectParser returns the first parser that accepts the file. The user's own
+// profiles are tried after the built-in ones but before the generic fallback.
+func detectParser(filename string, head []byte, userParsers []StatementParser) StatementParser {
+	candidates := make([]StatementParser, 0, len(parsers)+len(userParsers))
+	candidates = append(candidates, parsers[:len(parsers)-1]...)
+	candidates = append(candidates, userParsers...)
+	candidates = append(candidates, parsers[len(parsers)-1])
+
+	for _, p := range candidates {
+		if p.Detect(filename, head) {
+			return p
+		}
+	}
+	return nil
+}
+
+// parseStatement detects the file format and parses it with the matching parser.
+// sheet picks the worksheet of Excel workbooks, empty picks one automatically.
+func parseStatement(filename string, file io.Reader, userID, source, sheet string, userParsers []StatementParser) (ParseResult, error) {
+	reader := bufio.NewReaderSize(file, detectHeadSize)
+	head, err := reader.Peek(detectHeadSize)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return ParseResult{}, fmt.Errorf("Failed to read file")
+	}
+
+	parser := detectParser(filename, head, userParsers)
+	if parser == nil {
+		return ParseResult{}, fmt.Errorf("File format not recognized")
+	}
+	// Workbook sheets are matched against the same profiles as CSV files
+	if _, ok := parser.(workbookParser); ok {
+		parser = workbookParser{Sheet: sheet, Profiles: workbookProfiles(userParsers)}
+	}
+	return parseWith(parser, reader, userID, source)
+}
+
+// workbookProfiles lists the CSV profiles in the order detectParser tries them
+func workbookProfiles(userParsers []StatementParser) []*BankProfile {
+	profiles := make([]*BankProfile, 0, len(bankProfiles)+len(userParsers))
+	profiles = append(profiles, bankProfiles[:len(bankProfiles)-1]...)
+	for _, p := range userParsers {
+		if profile, ok := p.(*BankProfile); ok {
+			profiles = append(profiles, profile)
+		}
+	}
+	return append(profiles, bankProfiles[len(bankProfiles)-1])
+}
+
+// parseWith parses the file with a parser chosen by the caller
+func parseWith(parser StatementParser, file io.Reader, userID, source string) (ParseResult, error) {
+	result, err := parser.Parse(file, userID, source)
+	if result.Format == "" {
+		result.Format = parser.Name()
+	}
+	assignFingerprints(result.Transactions)
+	describeCounterparties(result.Transactions)
+	detectInstallments(result.Transactions)
+	return result, err
+}
+
+// fieldError is a parse error caused by a single field of a record
+type fieldError struct {
+	Field  string // "date", "amount", "description" or "type"
+	Reason string
+}
+
+func (e *fieldError) Error() string { return e.Reason }
+
+// invalidField returns a fieldError with a formatted reason
+func invalidField(field, format string, args ...interface{}) error {
+	return &fieldError{Field: field, Reason: fmt.Sprintf(format, args...)}
+}
+
+// skippedRow reports a record that failed to parse, naming the failing field when known
+func skippedRow(line int, raw string, err error) SkippedRow {
+	row := SkippedRow{Line: line, Raw: raw, Reason: err.Error()}
+	var fieldErr *fieldError
+	if errors.As(err, &fieldErr) {
+		row.Field = fieldErr.Field
+	}
+	return row
+}
+
+// ofxParser adapts parseOFX to the registry
+type ofxParser struct{}
+
+func (ofxParser) Name() string { return "ofx" }
+
+func (ofxParser) Detect(filename string, head []byte) bool {
+	upper := bytes.ToUpper(head)
+	return isOFXFile(filename) || bytes.Contains(upper, []byte("OFXHEADER")) || bytes.Contains(upper, []byte("<OFX>"))
+}
+
+func (ofxParser) Parse(file io.Reader, userID, source string) (ParseResult, error) {
+	return parseOFX(file, userID)
+}
+
+// qifParser adapts parseQIF to the registry
+type qifParser struct{}
+
+func (qifParser) Name() string { return "qif" }
+
+func (qifParser) Detect(filename string, head []byte) bool {
+	return isQIFFile(filename) || bytes.HasPrefix(bytes.TrimSpace(head), []byte("!Type:"))
+}
+
+func (qifParser) Parse(file io.Reader, userID, source string) (ParseResult, error) {
+	return parseQIF(file, userID)
+}
+
+// camtParser adapts parseCAMT to the registry
+type camtParser struct{}
+
+func (camtParser) Name() string { return "camt" }
+
+func (camtParser) Detect(filename string, head []byte) bool {
+	return bytes.Contains(head, []byte("BkToCstmrStmt")) || bytes.Contains(head, []byte("BkToCstmrAcctRpt"))
+}
+
+func (camtParser) Parse(file io.Reader, userID, source string) (ParseResult, error) {
+	return parseCAMT(file, userID)
+}
@@ -0,0 +1,1021 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/ascii85"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// maxPDFStreamSize bounds how much a single compressed stream may inflate to
+const maxPDFStreamSize = 64 << 20
+
+// maxPDFFormDepth bounds how deeply form XObjects may draw one another
+const maxPDFFormDepth = 8
+
+// PDF objects are read into these types, plus bool, float64 for every number,
+// []interface{} for arrays and nil for null
+type (
+	pdfName    string
+	pdfString  string // Raw bytes, decoded by the font that shows them
+	pdfKeyword string // Content stream operators and the closing delimiters
+	pdfDict    map[pdfName]interface{}
+	pdfRef     struct{ Num, Gen int }
+	pdfStream  struct {
+		Dict pdfDict
+		Data []byte // Still encoded with the stream's filters
+	}
+)
+
+// isPDFFile reports whether the file name looks like a PDF document
+func isPDFFile(filename string) bool {
+	return strings.EqualFold(filepath.Ext(filename), ".pdf")
+}
+
+// pdfLexer reads PDF objects and content stream operators from a buffer
+type pdfLexer struct {
+	data []byte
+	pos  int
+}
+
+func isPDFSpace(c byte) bool {
+	return c == 0 || c == '\t' || c == '\n' || c == '\f' || c == '\r' || c == ' '
+}
+
+func isPDFDelimiter(c byte) bool {
+	return strings.IndexByte("()<>[]{}/%", c) != -1
+}
+
+func (l *pdfLexer) skipSpace() {
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		if c == '%' {
+			for l.pos < len(l.data) && l.data[l.pos] != '\n' && l.data[l.pos] != '\r' {
+				l.pos++
+			}
+			continue
+		}
+		if !isPDFSpace(c) {
+			return
+		}
+		l.pos++
+	}
+}
+
+// regular reads a run of characters up to the next space or delimiter
+func (l *pdfLexer) regular() string {
+	start := l.pos
+	for l.pos < len(l.data) && !isPDFSpace(l.data[l.pos]) && !isPDFDelimiter(l.data[l.pos]) {
+		l.pos++
+	}
+	return string(l.data[start:l.pos])
+}
+
+// next reads one object. Dictionaries and arrays are read whole; ">>" and
+// "]" only come back on their own when they don't close anything.
+func (l *pdfLexer) next() (interface{}, error) {
+	l.skipSpace()
+	if l.pos >= len(l.data) {
+		return nil, io.EOF
+	}
+
+	c := l.data[l.pos]
+	switch {
+	case bytes.HasPrefix(l.data[l.pos:], []byte("<<")):
+		l.pos += 2
+		dict := pdfDict{}
+		for {
+			key, err := l.next()
+			if err != nil {
+				return nil, err
+			}
+			if key == pdfKeyword(">>") {
+				return dict, nil
+			}
+			name, ok := key.(pdfName)
+			if !ok {
+				return nil, fmt.Errorf("dictionary key is not a name")
+			}
+			value, err := l.next()
+			if err != nil {
+				return nil, err
+			}
+			dict[name] = value
+		}
+	case bytes.HasPrefix(l.data[l.pos:], []byte(">>")):
+		l.pos += 2
+		return pdfKeyword(">>"), nil
+	case c == '[':
+		l.pos++
+		array := []interface{}{}
+		for {
+			value, err := l.next()
+			if err != nil {
+				return nil, err
+			}
+			if value == pdfKeyword("]") {
+				return array, nil
+			}
+			array = append(array, value)
+		}
+	case c == ']' || c == '{' || c == '}':
+		l.pos++
+		return pdfKeyword(c), nil
+	case c == '<':
+		return l.hexString()
+	case c == '(':
+		return l.literalString()
+	case c == '/':
+		l.pos++
+		return pdfName(decodeNameEscapes(l.regular())), nil
+	case c == '+' || c == '-' || c == '.' || (c >= '0' && c <= '9'):
+		return l.number(), nil
+	}
+
+	word := l.regular()
+	if word == "" {
+		l.pos++ // A stray ')' or '>'
+		return pdfKeyword(c), nil
+	}
+	switch word {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+	return pdfKeyword(word), nil
+}
+
+// number reads a number, or a "12 0 R" reference starting with it
+func (l *pdfLexer) number() interface{} {
+	word := l.regular()
+	value, _ := strconv.ParseFloat(word, 64)
+
+	num, err := strconv.Atoi(word)
+	if err != nil || num < 0 {
+		return value
+	}
+	save := l.pos
+	l.skipSpace()
+	if gen, err := strconv.Atoi(l.regular()); err == nil {
+		l.skipSpace()
+		if l.regular() == "R" {
+			return pdfRef{Num: num, Gen: gen}
+		}
+	}
+	l.pos = save
+	return value
+}
+
+func (l *pdfLexer) hexString() (interface{}, error) {
+	end := bytes.IndexByte(l.data[l.pos:], '>')
+	if end == -1 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	digits := make([]byte, 0, end)
+	for _, c := range l.data[l.pos+1 : l.pos+end] {
+		if !isPDFSpace(c) {
+			digits = append(digits, c)
+		}
+	}
+	l.pos += end + 1
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	decoded := make([]byte, len(digits)/2)
+	if _, err := hex.Decode(decoded, digits); err != nil {
+		return nil, err
+	}
+	return pdfString(decoded), nil
+}
+
+func (l *pdfLexer) literalString() (interface{}, error) {
+	var out []byte
+	depth := 0
+	for l.pos++; l.pos < len(l.data); l.pos++ {
+		c := l.data[l.pos]
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				l.pos++
+				return pdfString(out), nil
+			}
+			depth--
+		case '\\':
+			l.pos++
+			if l.pos >= len(l.data) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			c = l.data[l.pos]
+			switch c {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r', '\n':
+				// A backslash at the end of a line continues the string on the next
+				if c == '\r' && l.pos+1 < len(l.data) && l.data[l.pos+1] == '\n' {
+					l.pos++
+				}
+				continue
+			}
+			if c >= '0' && c <= '7' {
+				octal := 0
+				for i := 0; i < 3 && l.pos < len(l.data) && l.data[l.pos] >= '0' && l.data[l.pos] <= '7'; i++ {
+					octal = octal*8 + int(l.data[l.pos]-'0')
+					l.pos++
+				}
+				l.pos--
+				c = byte(octal)
+			}
+		}
+		out = append(out, c)
+	}
+	return nil, io.ErrUnexpectedEOF
+}
+
+// decodeNameEscapes replaces the #xx escapes of a name
+func decodeNameEscapes(name string) string {
+	if !strings.Contains(name, "#") {
+		return name
+	}
+	var out strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] == '#' && i+2 < len(name) {
+			if b, err := strconv.ParseUint(name[i+1:i+3], 16, 8); err == nil {
+				out.WriteByte(byte(b))
+				i += 2
+				continue
+			}
+		}
+		out.WriteByte(name[i])
+	}
+	return out.String()
+}
+
+// pdfDocument holds the objects of a PDF file by object number
+type pdfDocument struct {
+	objects map[int]interface{}
+	root    interface{} // The document catalog, from the trailer
+}
+
+// pdfObjectHeader matches the "12 0 obj" line that opens an indirect object
+var pdfObjectHeader = regexp.MustCompile(`(\d+)\s+\d+\s+obj\b`)
+
+// readPDF loads every object of a PDF file. Objects are found by scanning for
+// their headers rather than through the cross-reference table, which is often
+// broken in generated statements; later definitions of an object replace
+// earlier ones, as incremental updates do.
+func readPDF(data []byte) (*pdfDocument, error) {
+	head := data
+	if len(head) > 1024 {
+		head = head[:1024]
+	}
+	if !bytes.Contains(head, []byte("%PDF-")) {
+		return nil, fmt.Errorf("Not a PDF file")
+	}
+	if bytes.Contains(data, []byte("/Encrypt")) {
+		return nil, fmt.Errorf("Password protected PDFs are not supported, save an unprotected copy of the statement first")
+	}
+
+	doc := &pdfDocument{objects: make(map[int]interface{})}
+	var objectStreams []pdfStream
+	for pos := 0; pos < len(data); {
+		loc := pdfObjectHeader.FindSubmatchIndex(data[pos:])
+		if loc == nil {
+			break
+		}
+		num, _ := strconv.Atoi(string(data[pos+loc[2] : pos+loc[3]]))
+		lexer := &pdfLexer{data: data, pos: pos + loc[1]}
+		pos += loc[1]
+
+		value, err := lexer.next()
+		if err != nil {
+			continue
+		}
+		if dict, ok := value.(pdfDict); ok {
+			if stream, ok := lexer.stream(dict); ok {
+				value = stream
+				if dict["Type"] == pdfName("ObjStm") {
+					objectStreams = append(objectStreams, stream)
+				}
+				if dict["Type"] == pdfName("XRef") && dict["Root"] != nil {
+					doc.root = dict["Root"]
+				}
+			}
+		}
+		doc.objects[num] = value
+		pos = lexer.pos
+	}
+
+	// Objects packed into object streams (PDF 1.5) are only found once those are decoded
+	for _, stream := range objectStreams {
+		doc.unpackObjectStream(stream)
+	}
+
+	if i := bytes.LastIndex(data, []byte("trailer")); i != -1 {
+		lexer := &pdfLexer{data: data, pos: i + len("trailer")}
+		if trailer, err := lexer.next(); err == nil {
+			if dict, ok := trailer.(pdfDict); ok && dict["Root"] != nil {
+				doc.root = dict["Root"]
+			}
+		}
+	}
+	if doc.dict(doc.root) == nil {
+		doc.root = nil
+		for _, obj := range doc.objects {
+			if dict, ok := obj.(pdfDict); ok && dict["Type"] == pdfName("Catalog") {
+				doc.root = dict
+			}
+		}
+	}
+	if doc.root == nil {
+		return nil, fmt.Errorf("Failed to read PDF file, no document catalog found")
+	}
+	return doc, nil
+}
+
+// stream reads the data of a stream object whose dictionary was just read
+func (l *pdfLexer) stream(dict pdfDict) (pdfStream, bool) {
+	save := l.pos
+	l.skipSpace()
+	if !bytes.HasPrefix(l.data[l.pos:], []byte("stream")) {
+		l.pos = save
+		return pdfStream{}, false
+	}
+	l.pos += len("stream")
+	if l.pos < len(l.data) && l.data[l.pos] == '\r' {
+		l.pos++
+	}
+	if l.pos < len(l.data) && l.data[l.pos] == '\n' {
+		l.pos++
+	}
+	start := l.pos
+
+	// Trust /Length when "endstream" follows it, otherwise search for the keyword
+	end := -1
+	if n, ok := dict["Length"].(float64); ok && n >= 0 && start+int(n) <= len(l.data) {
+		tail := bytes.TrimLeft(l.data[start+int(n):], "\r\n \t")
+		if bytes.HasPrefix(tail, []byte("endstream")) {
+			end = start + int(n)
+		}
+	}
+	if end == -1 {
+		i := bytes.Index(l.data[start:], []byte("endstream"))
+		if i == -1 {
+			l.pos = save
+			return pdfStream{}, false
+		}
+		end = start + i
+		if end > start && l.data[end-1] == '\n' {
+			end--
+		}
+		if end > start && l.data[end-1] == '\r' {
+			end--
+		}
+	}
+	l.pos = end + bytes.Index(l.data[end:], []byte("endstream")) + len("endstream")
+	return pdfStream{Dict: dict, Data: l.data[start:end]}, true
+}
+
+// unpackObjectStream adds the objects compressed into an object stream
+func (d *pdfDocument) unpackObjectStream(stream pdfStream) {
+	data, err := d.decodeStream(stream)
+	if err != nil {
+		return
+	}
+	count, _ := stream.Dict["N"].(float64)
+	first, _ := stream.Dict["First"].(float64)
+	if int(first) > len(data) {
+		return
+	}
+
+	header := &pdfLexer{data: data[:int(first)]}
+	for i := 0; i < int(count); i++ {
+		num, err1 := header.next()
+		offset, err2 := header.next()
+		n, ok1 := num.(float64)
+		off, ok2 := offset.(float64)
+		if err1 != nil || err2 != nil || !ok1 || !ok2 {
+			return
+		}
+		if _, defined := d.objects[int(n)]; defined || int(first+off) >= len(data) {
+			continue
+		}
+		lexer := &pdfLexer{data: data, pos: int(first + off)}
+		if value, err := lexer.next(); err == nil {
+			d.objects[int(n)] = value
+		}
+	}
+}
+
+// resolve follows references until it reaches a direct object
+func (d *pdfDocument) resolve(v interface{}) interface{} {
+	for i := 0; i < 32; i++ {
+		ref, ok := v.(pdfRef)
+		if !ok {
+			return v
+		}
+		v = d.objects[ref.Num]
+	}
+	return nil
+}
+
+// dict resolves v to a dictionary, or the dictionary of a stream
+func (d *pdfDocument) dict(v interface{}) pdfDict {
+	switch v := d.resolve(v).(type) {
+	case pdfDict:
+		return v
+	case pdfStream:
+		return v.Dict
+	}
+	return nil
+}
+
+// array resolves v to an array, wrapping a single object into one
+func (d *pdfDocument) array(v interface{}) []interface{} {
+	switch v := d.resolve(v).(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		return v
+	default:
+		return []interface{}{v}
+	}
+}
+
+// number resolves v to a number, or fallback when it isn't one
+func (d *pdfDocument) number(v interface{}, fallback float64) float64 {
+	if n, ok := d.resolve(v).(float64); ok {
+		return n
+	}
+	return fallback
+}
+
+// decodeStream applies the filters of a stream. Image filters are not
+// supported, text never needs them.
+func (d *pdfDocument) decodeStream(stream pdfStream) ([]byte, error) {
+	data := stream.Data
+	for _, filter := range d.array(stream.Dict["Filter"]) {
+		switch d.resolve(filter) {
+		case pdfName("FlateDecode"), pdfName("Fl"):
+			reader, err := zlib.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			// Generated PDFs often end their streams early, keep what inflated
+			out, err := io.ReadAll(io.LimitReader(reader, maxPDFStreamSize))
+			if err != nil && len(out) == 0 {
+				return nil, err
+			}
+			data = out
+		case pdfName("ASCIIHexDecode"), pdfName("AHx"):
+			value, err := (&pdfLexer{data: append(append([]byte("<"), data...), '>')}).hexString()
+			if err != nil {
+				return nil, err
+			}
+			data = []byte(value.(pdfString))
+		case pdfName("ASCII85Decode"), pdfName("A85"):
+			text := bytes.TrimPrefix(bytes.TrimSpace(data), []byte("<~"))
+			if i := bytes.Index(text, []byte("~>")); i != -1 {
+				text = text[:i]
+			}
+			out, err := io.ReadAll(ascii85.NewDecoder(bytes.NewReader(text)))
+			if err != nil {
+				return nil, err
+			}
+			data = out
+		default:
+			return nil, fmt.Errorf("unsupported stream filter %v", filter)
+		}
+	}
+	return data, nil
+}
+
+// streamData resolves v to a stream and decodes it
+func (d *pdfDocument) streamData(v interface{}) ([]byte, error) {
+	stream, ok := d.resolve(v).(pdfStream)
+	if !ok {
+		return nil, fmt.Errorf("not a stream")
+	}
+	return d.decodeStream(stream)
+}
+
+// pdfPage is a leaf of the page tree with the resources it inherits
+type pdfPage struct {
+	Dict      pdfDict
+	Resources pdfDict
+}
+
+// pages lists the pages of the document in reading order
+func (d *pdfDocument) pages() []pdfPage {
+	var pages []pdfPage
+	visited := make(map[int]bool)
+	var walk func(node interface{}, resources pdfDict)
+	walk = func(node interface{}, resources pdfDict) {
+		if ref, ok := node.(pdfRef); ok {
+			if visited[ref.Num] {
+				return
+			}
+			visited[ref.Num] = true
+		}
+		dict := d.dict(node)
+		if dict == nil {
+			return
+		}
+		if r := d.dict(dict["Resources"]); r != nil {
+			resources = r
+		}
+		if kids := d.array(dict["Kids"]); len(kids) > 0 || dict["Type"] == pdfName("Pages") {
+			for _, kid := range kids {
+				walk(kid, resources)
+			}
+			return
+		}
+		pages = append(pages, pdfPage{Dict: dict, Resources: resources})
+	}
+	walk(d.dict(d.root)["Pages"], nil)
+	return pages
+}
+
+// pdfFont turns the bytes shown with a font into text
+type pdfFont struct {
+	codeLength   int               // Bytes per character code
+	toUnicode    map[uint32]string // From the font's ToUnicode CMap
+	widths       map[uint32]float64
+	defaultWidth float64
+	simple       bool // One byte codes in a standard encoding, readable without a CMap
+	macRoman     bool
+}
+
+// loadFont reads what text extraction needs from a font dictionary
+func (d *pdfDocument) loadFont(v interface{}) *pdfFont {
+	dict := d.dict(v)
+	font := &pdfFont{codeLength: 1, simple: true, defaultWidth: 500, widths: make(map[uint32]float64)}
+	if dict == nil {
+		return font
+	}
+
+	if d.resolve(dict["Subtype"]) == pdfName("Type0") {
+		font.codeLength, font.simple = 2, false
+		if descendants := d.array(dict["DescendantFonts"]); len(descendants) > 0 {
+			cid := d.dict(descendants[0])
+			font.defaultWidth = d.number(cid["DW"], 1000)
+			font.readCIDWidths(d, d.array(cid["W"]))
+		}
+	} else {
+		first := uint32(d.number(dict["FirstChar"], 0))
+		for i, w := range d.array(dict["Widths"]) {
+			font.widths[first+uint32(i)] = d.number(w, font.defaultWidth)
+		}
+		encoding := d.resolve(dict["Encoding"])
+		if enc := d.dict(encoding); enc != nil {
+			encoding = d.resolve(enc["BaseEncoding"])
+		}
+		font.macRoman = encoding == pdfName("MacRomanEncoding")
+	}
+
+	if data, err := d.streamData(dict["ToUnicode"]); err == nil {
+		font.toUnicode, font.codeLength = parseToUnicode(data, font.codeLength)
+	}
+	return font
+}
+
+// readCIDWidths reads the W array of a CID font, which lists widths either as
+// "first [w1 w2 ...]" or as "first last w"
+func (f *pdfFont) readCIDWidths(d *pdfDocument, w []interface{}) {
+	for i := 0; i+1 < len(w); {
+		first := uint32(d.number(w[i], 0))
+		if widths, ok := d.resolve(w[i+1]).([]interface{}); ok {
+			for j, width := range widths {
+				f.widths[first+uint32(j)] = d.number(width, f.defaultWidth)
+			}
+			i += 2
+			continue
+		}
+		if i+2 >= len(w) {
+			return
+		}
+		last := uint32(d.number(w[i+1], 0))
+		width := d.number(w[i+2], f.defaultWidth)
+		for c := first; c <= last && c-first < 1<<16; c++ {
+			f.widths[c] = width
+		}
+		i += 3
+	}
+}
+
+// parseToUnicode reads the bfchar and bfrange mappings of a ToUnicode CMap.
+// The code length comes from its codespace ranges when it has them.
+func parseToUnicode(data []byte, codeLength int) (map[uint32]string, int) {
+	mapping := make(map[uint32]string)
+	lexer := &pdfLexer{data: data}
+	var operands []interface{}
+	for {
+		value, err := lexer.next()
+		if err != nil {
+			break
+		}
+		op, ok := value.(pdfKeyword)
+		if !ok {
+			operands = append(operands, value)
+			continue
+		}
+		switch op {
+		case "endcodespacerange":
+			if len(operands) >= 2 {
+				if lo, ok := operands[0].(pdfString); ok && len(lo) > 0 {
+					codeLength = len(lo)
+				}
+			}
+		case "endbfchar":
+			for i := 0; i+1 < len(operands); i += 2 {
+				src, ok1 := operands[i].(pdfString)
+				dst, ok2 := operands[i+1].(pdfString)
+				if ok1 && ok2 {
+					mapping[codeValue(src)] = utf16BEString(dst)
+				}
+			}
+		case "endbfrange":
+			for i := 0; i+2 < len(operands); i += 3 {
+				lo, ok1 := operands[i].(pdfString)
+				hi, ok2 := operands[i+1].(pdfString)
+				if !ok1 || !ok2 {
+					continue
+				}
+				first, last := codeValue(lo), codeValue(hi)
+				for c := first; c <= last && c-first < 1<<16; c++ {
+					switch dst := operands[i+2].(type) {
+					case pdfString:
+						// The last UTF-16 unit of the destination counts up with the code
+						units := utf16BEUnits(dst)
+						if len(units) > 0 {
+							units[len(units)-1] += uint16(c - first)
+						}
+						mapping[c] = string(utf16.Decode(units))
+					case []interface{}:
+						if int(c-first) < len(dst) {
+							if s, ok := dst[c-first].(pdfString); ok {
+								mapping[c] = utf16BEString(s)
+							}
+						}
+					}
+				}
+			}
+		}
+		operands = operands[:0]
+	}
+	return mapping, codeLength
+}
+
+func codeValue(s pdfString) uint32 {
+	var c uint32
+	for i := 0; i < len(s); i++ {
+		c = c<<8 | uint32(s[i])
+	}
+	return c
+}
+
+func utf16BEUnits(s pdfString) []uint16 {
+	units := make([]uint16, len(s)/2)
+	for i := range units {
+		units[i] = uint16(s[2*i])<<8 | uint16(s[2*i+1])
+	}
+	return units
+}
+
+func utf16BEString(s pdfString) string {
+	return string(utf16.Decode(utf16BEUnits(s)))
+}
+
+// decode splits shown bytes into character codes, returning the text of each
+func (f *pdfFont) decode(s pdfString) (codes []uint32, texts []string) {
+	for i := 0; i < len(s); i += f.codeLength {
+		end := i + f.codeLength
+		if end > len(s) {
+			end = len(s)
+		}
+		code := codeValue(s[i:end])
+		text, ok := f.toUnicode[code]
+		if !ok && f.simple {
+			decoder := charmap.Windows1252
+			if f.macRoman {
+				decoder = charmap.Macintosh
+			}
+			text = string(decoder.DecodeByte(byte(code)))
+		}
+		codes = append(codes, code)
+		texts = append(texts, text)
+	}
+	return codes, texts
+}
+
+// pdfMatrix is a PDF transformation matrix [a b c d e f]
+type pdfMatrix [6]float64
+
+var identityMatrix = pdfMatrix{1, 0, 0, 1, 0, 0}
+
+// multiply returns m applied before n
+func (m pdfMatrix) multiply(n pdfMatrix) pdfMatrix {
+	return pdfMatrix{
+		m[0]*n[0] + m[1]*n[2], m[0]*n[1] + m[1]*n[3],
+		m[2]*n[0] + m[3]*n[2], m[2]*n[1] + m[3]*n[3],
+		m[4]*n[0] + m[5]*n[2] + n[4], m[4]*n[1] + m[5]*n[3] + n[5],
+	}
+}
+
+func translation(tx, ty float64) pdfMatrix {
+	return pdfMatrix{1, 0, 0, 1, tx, ty}
+}
+
+// pdfTextRun is text shown at one position of a page
+type pdfTextRun struct {
+	X, Y float64 // Start of the text on the page
+	EndX float64
+	Size float64
+	Text string
+}
+
+// pdfTextState is the graphics and text state content streams change
+type pdfTextState struct {
+	ctm        pdfMatrix
+	tm, tlm    pdfMatrix
+	font       *pdfFont
+	fontSize   float64
+	leading    float64
+	charSpace  float64
+	wordSpace  float64
+	horizScale float64
+}
+
+// pdfContent interprets the content streams of one page, collecting text runs
+type pdfContent struct {
+	doc   *pdfDocument
+	fonts map[interface{}]*pdfFont
+	runs  []pdfTextRun
+}
+
+// pageText returns the lines of text of a page, top to bottom
+func (d *pdfDocument) pageText(page pdfPage, fonts map[interface{}]*pdfFont) []string {
+	var content []byte
+	for _, part := range d.array(page.Dict["Contents"]) {
+		if data, err := d.streamData(part); err == nil {
+			content = append(append(content, data...), '\n')
+		}
+	}
+	c := &pdfContent{doc: d, fonts: fonts}
+	c.run(content, page.Resources, identityMatrix, 0)
+	return textLines(c.runs)
+}
+
+// run interprets a content stream drawn with the given resources and matrix
+func (c *pdfContent) run(content []byte, resources pdfDict, ctm pdfMatrix, depth int) {
+	state := pdfTextState{ctm: ctm, tm: identityMatrix, tlm: identityMatrix, horizScale: 1}
+	var saved []pdfTextState
+	var operands []interface{}
+	num := func(i int) float64 {
+		if i < len(operands) {
+			if n, ok := operands[i].(float64); ok {
+				return n
+			}
+		}
+		return 0
+	}
+	matrix := func() pdfMatrix {
+		return pdfMatrix{num(0), num(1), num(2), num(3), num(4), num(5)}
+	}
+	moveLine := func(tx, ty float64) {
+		state.tlm = translation(tx, ty).multiply(state.tlm)
+		state.tm = state.tlm
+	}
+	last := func() interface{} {
+		if len(operands) == 0 {
+			return nil
+		}
+		return operands[len(operands)-1]
+	}
+
+	lexer := &pdfLexer{data: content}
+	for {
+		value, err := lexer.next()
+		if err != nil {
+			break
+		}
+		op, ok := value.(pdfKeyword)
+		if !ok {
+			operands = append(operands, value)
+			continue
+		}
+
+		switch op {
+		case "q":
+			saved = append(saved, state)
+		case "Q":
+			// The text matrix is not part of the graphics state q and Q save
+			if len(saved) > 0 {
+				tm, tlm := state.tm, state.tlm
+				state = saved[len(saved)-1]
+				saved = saved[:len(saved)-1]
+				state.tm, state.tlm = tm, tlm
+			}
+		case "cm":
+			state.ctm = matrix().multiply(state.ctm)
+		case "BT":
+			state.tm, state.tlm = identityMatrix, identityMatrix
+		case "Tf":
+			if len(operands) < 2 {
+				break
+			}
+			if name, ok := operands[0].(pdfName); ok {
+				state.font = c.font(resources, name)
+				state.fontSize = num(1)
+			}
+		case "TL":
+			state.leading = num(0)
+		case "Tc":
+			state.charSpace = num(0)
+		case "Tw":
+			state.wordSpace = num(0)
+		case "Tz":
+			state.horizScale = num(0) / 100
+		case "Td":
+			moveLine(num(0), num(1))
+		case "TD":
+			state.leading = -num(1)
+			moveLine(num(0), num(1))
+		case "Tm":
+			state.tm, state.tlm = matrix(), matrix()
+		case "T*":
+			moveLine(0, -state.leading)
+		case "Tj":
+			if s, ok := last().(pdfString); ok {
+				c.show(&state, s)
+			}
+		case "'":
+			moveLine(0, -state.leading)
+			if s, ok := last().(pdfString); ok {
+				c.show(&state, s)
+			}
+		case "\"":
+			state.wordSpace, state.charSpace = num(0), num(1)
+			moveLine(0, -state.leading)
+			if s, ok := last().(pdfString); ok {
+				c.show(&state, s)
+			}
+		case "TJ":
+			items, _ := last().([]interface{})
+			for _, item := range items {
+				switch item := item.(type) {
+				case pdfString:
+					c.show(&state, item)
+				case float64:
+					state.tm = translation(-item/1000*state.fontSize*state.horizScale, 0).multiply(state.tm)
+				}
+			}
+		case "Do":
+			if name, ok := last().(pdfName); ok && depth < maxPDFFormDepth {
+				c.drawForm(resources, name, state.ctm, depth)
+			}
+		case "ID":
+			// Inline image data is binary, skip to the end of the image
+			if end := bytes.Index(content[lexer.pos:], []byte("EI")); end != -1 {
+				lexer.pos += end + 2
+			} else {
+				lexer.pos = len(content)
+			}
+		}
+		operands = operands[:0]
+	}
+}
+
+// font returns the font a content stream names, loading it once per page
+func (c *pdfContent) font(resources pdfDict, name pdfName) *pdfFont {
+	ref := c.doc.dict(resources["Font"])[name]
+	key := interface{}(ref)
+	if _, ok := ref.(pdfRef); !ok {
+		key = name
+	}
+	font, ok := c.fonts[key]
+	if !ok {
+		font = c.doc.loadFont(ref)
+		c.fonts[key] = font
+	}
+	return font
+}
+
+// drawForm runs the content of a form XObject, which may hold text
+func (c *pdfContent) drawForm(resources pdfDict, name pdfName, ctm pdfMatrix, depth int) {
+	stream, ok := c.doc.resolve(c.doc.dict(resources["XObject"])[name]).(pdfStream)
+	if !ok || stream.Dict["Subtype"] != pdfName("Form") {
+		return
+	}
+	data, err := c.doc.decodeStream(stream)
+	if err != nil {
+		return
+	}
+	if r := c.doc.dict(stream.Dict["Resources"]); r != nil {
+		resources = r
+	}
+	if m := c.doc.array(stream.Dict["Matrix"]); len(m) == 6 {
+		var form pdfMatrix
+		for i := range form {
+			form[i] = c.doc.number(m[i], 0)
+		}
+		ctm = form.multiply(ctm)
+	}
+	c.run(data, resources, ctm, depth+1)
+}
+
+// show records a shown string and moves the text matrix past it
+func (c *pdfContent) show(state *pdfTextState, s pdfString) {
+	font := state.font
+	if font == nil {
+		font = &pdfFont{codeLength: 1, simple: true, defaultWidth: 500}
+	}
+	start := state.tm.multiply(state.ctm)
+	codes, texts := font.decode(s)
+
+	var text strings.Builder
+	for i, code := range codes {
+		text.WriteString(texts[i])
+		width, ok := font.widths[code]
+		if !ok {
+			width = font.defaultWidth
+		}
+		advance := width/1000*state.fontSize + state.charSpace
+		if font.codeLength == 1 && code == ' ' {
+			advance += state.wordSpace
+		}
+		state.tm = translation(advance*state.horizScale, 0).multiply(state.tm)
+	}
+
+	end := state.tm.multiply(state.ctm)
+	size := state.fontSize * math.Hypot(start[2], start[3])
+	if text.Len() > 0 {
+		c.runs = append(c.runs, pdfTextRun{X: start[4], Y: start[5], EndX: end[4], Size: size, Text: text.String()})
+	}
+}
+
+// textLines groups text runs on the same baseline into lines, reading lines
+// top to bottom and runs left to right. Runs further apart than a space are
+// separated by one.
+func textLines(runs []pdfTextRun) []string {
+	sort.SliceStable(runs, func(i, j int) bool { return runs[i].Y > runs[j].Y })
+
+	var lines []string
+	for start := 0; start < len(runs); {
+		end := start + 1
+		for end < len(runs) && runs[start].Y-runs[end].Y <= math.Max(runs[start].Size, 1)*0.4 {
+			end++
+		}
+		line := runs[start:end]
+		sort.SliceStable(line, func(i, j int) bool { return line[i].X < line[j].X })
+
+		var text strings.Builder
+		for i, run := range line {
+			if i > 0 && run.X-line[i-1].EndX > run.Size*0.15 {
+				text.WriteByte(' ')
+			}
+			text.WriteString(run.Text)
+		}
+		if s := strings.Join(strings.Fields(text.String()), " "); s != "" {
+			lines = append(lines, s)
+		}
+		start = end
+	}
+	return lines
+}
+
+// extractPDFText returns the lines of text of every page of a PDF
+func extractPDFText(data []byte) ([]string, error) {
+	doc, err := readPDF(data)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, page := range doc.pages() {
+		lines = append(lines, doc.pageText(page, make(map[interface{}]*pdfFont))...)
+	}
+	return lines, nil
+}
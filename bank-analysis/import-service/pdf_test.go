@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestNubankPDFStatement parses the fixture bill and checks every row it
+// lists: the repeated Uber ride is kept twice, the payment and the refund
+// written with a "−" sign are credits and the IOF line without an amount is
+// reported as skipped. The refund is of Netflix and the payment of no merchant.
+func TestNubankPDFStatement(t *testing.T) {
+	data, err := os.ReadFile("testdata/pdf/nubank_fatura.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := parseStatement("nubank_fatura.pdf", bytes.NewReader(data), "user@example.com", defaultSource, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Format != "pdf:nubank_credit_card_pdf" {
+		t.Errorf("format %s, want pdf:nubank_credit_card_pdf", result.Format)
+	}
+
+	want := []struct {
+		date        string
+		description string
+		amount      float64
+		transType   string
+		merchant    string
+	}{
+		{"2024-02-08", "Padaria Real", 23.90, "debit", "Padaria Real"},
+		{"2024-02-10", "Uber *Trip", 15.40, "debit", "Uber"},
+		{"2024-02-10", "Uber *Trip", 15.40, "debit", "Uber"},
+		{"2024-02-14", "Pagamento em 14 FEV", 1000, "credit", ""},
+		{"2024-02-20", "Mercadolivre*loja - Parcela 2/10", 1250, "debit", "Mercadolivre"},
+		{"2024-02-25", "Estorno Netflix.com", 55.90, "credit", "Netflix.com"},
+	}
+	if len(result.Transactions) != len(want) {
+		t.Fatalf("%d transactions, want %d", len(result.Transactions), len(want))
+	}
+	for i, w := range want {
+		got := result.Transactions[i]
+		if got.Date.Format("2006-01-02") != w.date || got.Description != w.description || got.Amount != w.amount || got.Type != w.transType {
+			t.Errorf("row %d: %s %q %.2f %s, want %s %q %.2f %s", i+1,
+				got.Date.Format("2006-01-02"), got.Description, got.Amount, got.Type, w.date, w.description, w.amount, w.transType)
+		}
+		if got.Merchant != w.merchant {
+			t.Errorf("row %d: merchant %q, want %q", i+1, got.Merchant, w.merchant)
+		}
+		if got.Source != "credit_card" || got.Currency != "BRL" {
+			t.Errorf("row %d: source %s and currency %s, want credit_card and BRL", i+1, got.Source, got.Currency)
+		}
+	}
+	if result.Transactions[1].Fingerprint == result.Transactions[2].Fingerprint {
+		t.Error("the two Uber rides share a fingerprint")
+	}
+
+	if len(result.Skipped) != 1 {
+		t.Fatalf("%d rows skipped, want the IOF line", len(result.Skipped))
+	}
+	if skipped := result.Skipped[0]; skipped.Line != 13 || skipped.Raw != `01 MAR IOF de "Amazon Prime"` {
+		t.Errorf("skipped line %d %q, want line 13 with the IOF line", skipped.Line, skipped.Raw)
+	}
+}
+
+// buildPDF writes the objects as "n 0 obj" in order, followed by a
+// cross-reference table and a trailer naming object 1 as the catalog
+func buildPDF(objects ...string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return buf.Bytes()
+}
+
+// pdfStreamObject writes a stream object with the given dictionary entries
+func pdfStreamObject(entries, content string) string {
+	return fmt.Sprintf("<< %s /Length %d >>\nstream\n%s\nendstream", entries, len(content), content)
+}
+
+// TestMalformedPDF checks damaged files are rejected with an error, without
+// panicking or looping
+func TestMalformedPDF(t *testing.T) {
+	text := "BT /F1 12 Tf 72 720 Td (08 FEV Padaria 23,90) Tj ET"
+	page := "<< /Type /Page /Parent 2 0 R /Contents 4 0 R /Resources << /Font << /F1 5 0 R >> >> >>"
+	font := "<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>"
+
+	// The catalog has no /Type, so it can only be found through the trailer
+	untyped := buildPDF("<< /Pages 2 0 R >>", "<< /Type /Pages /Kids [3 0 R] /Count 1 >>", page, pdfStreamObject("", text), font)
+	truncatedXref := untyped[:bytes.Index(untyped, []byte("xref"))+len("xref\n0 6\n0000000000 65")]
+
+	// The content stream claims more bytes than the file has and never ends
+	overrun := buildPDF("<< /Type /Catalog /Pages 2 0 R >>", "<< /Type /Pages /Kids [3 0 R] /Count 1 >>", page,
+		"<< /Length 100000 >>\nstream\n"+text+"\nendstream", font)
+	overrun = overrun[:bytes.Index(overrun, []byte(text))+len(text)/2]
+
+	// A page whose content refers to itself, a page tree listing itself and
+	// a form that draws itself
+	cyclic := buildPDF(
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [2 0 R 3 0 R 6 0 R] /Count 2 >>",
+		"<< /Type /Page /Parent 2 0 R /Contents 4 0 R >>",
+		"5 0 R",
+		"4 0 R",
+		"<< /Type /Page /Parent 2 0 R /Contents 7 0 R /Resources 8 0 R >>",
+		pdfStreamObject("", "/X Do"),
+		"<< /Font << /F1 10 0 R >> /XObject << /X 9 0 R >> >>",
+		pdfStreamObject("/Type /XObject /Subtype /Form /Resources 8 0 R", text+" /X Do"),
+		font,
+	)
+
+	tests := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		// Undamaged, the first two are read and only their layout is unknown
+		{"intact untyped catalog", untyped, "layout not recognized"},
+		{"truncated xref", truncatedXref, "no document catalog found"},
+		{"stream length overrun", overrun, "no text"},
+		{"cyclic references", cyclic, "layout not recognized"},
+		{"header only", []byte("%PDF-1.7\n"), "no document catalog found"},
+		{"not a PDF", []byte("08 FEV Padaria 23,90"), "Not a PDF file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			done := make(chan error, 1)
+			go func() {
+				defer func() {
+					if r := recover(); r != nil {
+						done <- fmt.Errorf("panic: %v", r)
+					}
+				}()
+				_, err := pdfParser{}.Parse(bytes.NewReader(tt.data), "user@example.com", defaultSource)
+				done <- err
+			}()
+
+			select {
+			case err := <-done:
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("got error %v, want one containing %q", err, tt.err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("parsing did not finish")
+			}
+		})
+	}
+}
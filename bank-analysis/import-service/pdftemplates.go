@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PDFTemplate describes the text layout of a bank's PDF statement: how to
+// recognize it and how its transaction lines are written. Patterns are
+// matched against the text extracted from the PDF, one line per text line.
+type PDFTemplate struct {
+	ID   string
+	Bank string
+	// DetectPatterns must all match the statement text for the template to apply
+	DetectPatterns []*regexp.Regexp
+	// StatementDate finds the date the statement closes or is due, with the
+	// groups day, month and year. Transaction dates without a year get the
+	// year that doesn't put them after the statement date.
+	StatementDate *regexp.Regexp
+	// LineStart matches the start of a transaction line. Lines it matches that
+	// Transaction doesn't are reported as skipped, as they likely are
+	// transactions the layout didn't anticipate.
+	LineStart *regexp.Regexp
+	// Transaction matches a transaction line with the groups day, month,
+	// description and amount, and optionally year and sign (a minus sign)
+	Transaction *regexp.Regexp
+	// DescriptionCleanup is removed from descriptions, e.g. a masked card number
+	DescriptionCleanup *regexp.Regexp
+	DecimalSeparator   string
+	// PositiveIsDebit is set for card statements, which list purchases as positive amounts
+	PositiveIsDebit bool
+	// Source is the account type the statement always belongs to; empty keeps the caller's source
+	Source string
+	// Currency is the currency of amounts written without a symbol
+	Currency string
+}
+
+// statementMonths are the month abbreviations used by Brazilian statements
+var statementMonths = map[string]time.Month{
+	"JAN": time.January, "FEV": time.February, "MAR": time.March, "ABR": time.April,
+	"MAI": time.May, "JUN": time.June, "JUL": time.July, "AGO": time.August,
+	"SET": time.September, "OUT": time.October, "NOV": time.November, "DEZ": time.December,
+}
+
+// pdfTemplates are the built-in PDF statement layouts, tried in order
+var pdfTemplates = []*PDFTemplate{
+	{
+		// Nubank credit card bill ("fatura"). Transaction lines read
+		// "12 FEV •••• 1234 Padaria Real 23,90", payments and refunds carry a minus sign.
+		ID:   "nubank_credit_card_pdf",
+		Bank: "Nubank",
+		DetectPatterns: []*regexp.Regexp{
+			regexp.MustCompile(`(?i)nu pagamentos|nubank`),
+			regexp.MustCompile(`(?i)\bfatura\b`),
+		},
+		StatementDate:      regexp.MustCompile(`(?i)(?:vencimento|fatura)[^\d\n]{0,30}(?P<day>\d{2}) (?P<month>[a-z]{3}) (?P<year>\d{4})`),
+		LineStart:          regexp.MustCompile(`(?i)^\d{2} (?:JAN|FEV|MAR|ABR|MAI|JUN|JUL|AGO|SET|OUT|NOV|DEZ) `),
+		Transaction:        regexp.MustCompile(`(?i)^(?P<day>\d{2}) (?P<month>JAN|FEV|MAR|ABR|MAI|JUN|JUL|AGO|SET|OUT|NOV|DEZ) (?P<description>.+?) (?P<sign>[-−])? ?(?:R\$ ?)?(?P<amount>\d{1,3}(?:\.\d{3})*,\d{2})$`),
+		DescriptionCleanup: regexp.MustCompile(`^(?:•+|\*+) ?\d{4} `),
+		DecimalSeparator:   ",",
+		PositiveIsDebit:    true,
+		Source:             "credit_card",
+		Currency:           "BRL",
+	},
+}
+
+// matches reports whether the statement text has the template's layout
+func (t *PDFTemplate) matches(text string) bool {
+	for _, pattern := range t.DetectPatterns {
+		if !pattern.MatchString(text) {
+			return false
+		}
+	}
+	return true
+}
+
+// group returns a named group of a submatch, or "" when the pattern lacks it
+func group(pattern *regexp.Regexp, match []string, name string) string {
+	if i := pattern.SubexpIndex(name); i != -1 && i < len(match) {
+		return match[i]
+	}
+	return ""
+}
+
+// parseStatementDate reads a date written with a month number or abbreviation.
+// year is 0 when the date has no year.
+func parseStatementDate(day, month string, year int) (time.Time, error) {
+	d, err := strconv.Atoi(day)
+	if err != nil {
+		return time.Time{}, err
+	}
+	m, ok := statementMonths[strings.ToUpper(month)]
+	if !ok {
+		n, err := strconv.Atoi(month)
+		if err != nil || n < 1 || n > 12 {
+			return time.Time{}, fmt.Errorf("unknown month %s", month)
+		}
+		m = time.Month(n)
+	}
+	date := time.Date(year, m, d, 0, 0, 0, 0, time.UTC)
+	if date.Day() != d {
+		return time.Time{}, fmt.Errorf("day %d out of range", d)
+	}
+	return date, nil
+}
+
+// parse turns the lines of a statement into transactions
+func (t *PDFTemplate) parse(lines []string, userID, source string) (ParseResult, error) {
+	match := t.StatementDate.FindStringSubmatch(strings.Join(lines, "\n"))
+	if match == nil {
+		return ParseResult{}, fmt.Errorf("Statement date not found in the %s PDF", t.Bank)
+	}
+	year, _ := strconv.Atoi(group(t.StatementDate, match, "year"))
+	statementDate, err := parseStatementDate(group(t.StatementDate, match, "day"), group(t.StatementDate, match, "month"), year)
+	if err != nil {
+		return ParseResult{}, fmt.Errorf("Invalid statement date: %s", match[0])
+	}
+
+	if t.Source != "" {
+		source = t.Source
+	}
+
+	result := ParseResult{Format: "pdf:" + t.ID}
+	for i, line := range lines {
+		if !t.LineStart.MatchString(line) {
+			continue
+		}
+		tx, err := t.parseLine(line, statementDate)
+		if err != nil {
+			log.Printf("Line %d: %v", i+1, err)
+			result.Skipped = append(result.Skipped, skippedRow(i+1, line, err))
+			continue
+		}
+		tx.UserID = userID
+		tx.Source = source
+		tx.Line = i + 1
+		tx.Raw = line
+		result.Transactions = append(result.Transactions, tx)
+	}
+	return result, nil
+}
+
+// parseLine converts one transaction line
+func (t *PDFTemplate) parseLine(line string, statementDate time.Time) (Transaction, error) {
+	match := t.Transaction.FindStringSubmatch(line)
+	if match == nil {
+		return Transaction{}, fmt.Errorf("Line doesn't follow the %s statement layout", t.Bank)
+	}
+
+	day, month := group(t.Transaction, match, "day"), group(t.Transaction, match, "month")
+	year, _ := strconv.Atoi(group(t.Transaction, match, "year"))
+	explicitYear := year != 0
+	if !explicitYear {
+		year = statementDate.Year()
+	}
+	date, err := parseStatementDate(day, month, year)
+	if err != nil {
+		return Transaction{}, invalidField("date", "Invalid date: %s %s", day, month)
+	}
+	if !explicitYear && date.After(statementDate) {
+		date = date.AddDate(-1, 0, 0)
+	}
+
+	amountStr := group(t.Transaction, match, "amount")
+	_, currency := splitCurrency(amountStr)
+	if currency == "" {
+		currency = t.Currency
+	}
+	amount, err := parseAmount(amountStr, t.DecimalSeparator)
+	if err != nil {
+		return Transaction{}, invalidField("amount", "Invalid amount format: %s", amountStr)
+	}
+	if group(t.Transaction, match, "sign") != "" {
+		amount = -amount
+	}
+	if t.PositiveIsDebit {
+		amount = -amount
+	}
+
+	description := group(t.Transaction, match, "description")
+	if t.DescriptionCleanup != nil {
+		description = t.DescriptionCleanup.ReplaceAllString(description, "")
+	}
+	description = strings.TrimSpace(description)
+	if description == "" {
+		return Transaction{}, invalidField("description", "Missing description")
+	}
+
+	transType := "debit"
+	if amount > 0 {
+		transType = "credit"
+	}
+
+	return Transaction{
+		Date:        date,
+		Description: description,
+		Category:    "Uncategorized",
+		Amount:      math.Abs(amount), // Store amount as positive
+		Type:        transType,
+		Currency:    currency,
+	}, nil
+}
+
+// pdfParser reads text-based PDF statements with the layout of one of the pdfTemplates.
+// Scanned statements have no text to read and are rejected.
+type pdfParser struct{}
+
+func (pdfParser) Name() string { return "pdf" }
+
+func (pdfParser) Detect(filename string, head []byte) bool {
+	return isPDFFile(filename) || bytes.HasPrefix(head, []byte("%PDF-"))
+}
+
+func (pdfParser) Parse(file io.Reader, userID, source string) (ParseResult, error) {
+	data, err := io.ReadAll(file)
+	if err != nil {
+		log.Printf("ERROR: Failed to read PDF: %v", err)
+		return ParseResult{}, fmt.Errorf("Failed to read PDF file")
+	}
+	lines, err := extractPDFText(data)
+	if err != nil {
+		return ParseResult{}, err
+	}
+	if len(lines) == 0 {
+		return ParseResult{}, fmt.Errorf("The PDF has no text, scanned statements are not supported")
+	}
+
+	text := strings.Join(lines, "\n")
+	for _, template := range pdfTemplates {
+		if template.matches(text) {
+			return template.parse(lines, userID, source)
+		}
+	}
+
+	banks := make([]string, len(pdfTemplates))
+	for i, template := range pdfTemplates {
+		banks[i] = template.Bank + " (" + template.ID + ")"
+	}
+	return ParseResult{}, fmt.Errorf("PDF statement layout not recognized. Supported layouts: %s", strings.Join(banks, ", "))
+}
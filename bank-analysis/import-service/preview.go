@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// PreviewTransaction is a parsed transaction and whether it is already stored
+type PreviewTransaction struct {
+	Transaction
+	Duplicate bool `json:"duplicate"`
+}
+
+// PreviewResponse describes what an upload would import without writing anything
+type PreviewResponse struct {
+	Filename       string               `json:"filename"`
+	Format         string               `json:"format"`
+	Transactions   []PreviewTransaction `json:"transactions"`
+	Skipped        []SkippedRow         `json:"skipped"`
+	Statements     []StatementBalance   `json:"statements,omitempty"`
+	DuplicateCount int                  `json:"duplicateCount"`
+}
+
+// findDuplicates reports, for each transaction, whether an upload would
+// match a document that is already stored
+func findDuplicates(ctx context.Context, transactions []Transaction) ([]bool, error) {
+	projection := bson.M{"fingerprint": 1}
+	existing, err := findExisting(ctx, transactions, projection)
+	if err != nil {
+		return nil, err
+	}
+
+	duplicates := make([]bool, len(transactions))
+	for i, t := range transactions {
+		_, duplicates[i] = existing[t.Fingerprint]
+	}
+	return duplicates, nil
+}
+
+// previewHandler parses an upload exactly like uploadHandler but only reports
+// what would be imported, skipped and matched against existing documents
+func previewHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, upload, err := parseUpload(ctx, w, r, userID)
+	if err != nil {
+		http.Error(w, err.Error(), uploadErrorStatus(err))
+		return
+	}
+
+	applyMerchantAliases(ctx, userID, result.Transactions)
+	linkStoredInstallments(ctx, userID, result.Transactions)
+	categorize(ctx, userID, result.Transactions)
+
+	duplicates, err := findDuplicates(ctx, result.Transactions)
+	if err != nil {
+		log.Printf("Error looking up duplicates: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := PreviewResponse{
+		Filename:     upload.Name,
+		Format:       result.Format,
+		Transactions: make([]PreviewTransaction, len(result.Transactions)),
+		Skipped:      result.Skipped,
+		Statements:   result.Statements,
+	}
+	if resp.Skipped == nil {
+		resp.Skipped = []SkippedRow{}
+	}
+	for i, t := range result.Transactions {
+		resp.Transactions[i] = PreviewTransaction{Transaction: t, Duplicate: duplicates[i]}
+		if duplicates[i] {
+			resp.DuplicateCount++
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BankProfile describes a bank's CSV export: how to recognize it, which
+// columns hold each field and how dates and amounts are written.
+// Header names are compared after normalizeHeader.
+type BankProfile struct {
+	ID   string
+	Bank string
+	// DetectHeaders must all be present in the header row for the profile to match
+	DetectHeaders []string
+	// Candidate header names for each field, in order of preference
+	DateColumns        []string
+	AmountColumns      []string
+	CreditColumns      []string // For exports that split money in and out into two columns
+	DebitColumns       []string
+	DescriptionColumns []string // Every column present is joined into the description
+	CategoryColumns    []string
+	ExternalIDColumns  []string // Bank-assigned transaction ID, used to tell identical transactions apart
+	CurrencyColumns    []string // ISO 4217 code of each row, for exports of several currencies
+	DateLayouts        []string // Several layouts are told apart per file, see detectDateLayout
+	// DecimalSeparator, "," or ".", applies when no amount of the file tells
+	// which one it uses; empty rejects such files as ambiguous
+	DecimalSeparator string
+	// PositiveIsDebit is set for card statements, which list purchases as positive amounts
+	PositiveIsDebit bool
+	// Source is the account type the export always belongs to; empty keeps the caller's source
+	Source string
+	// Currency is the currency of rows whose amount has no symbol and that
+	// have no currency column; empty leaves it to the upload
+	Currency string
+}
+
+// bankProfiles are the built-in CSV profiles. The generic profile has no
+// DetectHeaders and must stay last.
+var bankProfiles = []*BankProfile{
+	{
+		ID:                 "nubank_checking",
+		Bank:               "Nubank",
+		DetectHeaders:      []string{"data", "valor", "identificador", "descricao"},
+		DateColumns:        []string{"data"},
+		AmountColumns:      []string{"valor"},
+		DescriptionColumns: []string{"descricao"},
+		ExternalIDColumns:  []string{"identificador"},
+		DateLayouts:        []string{"02/01/2006"},
+		DecimalSeparator:   ".",
+		Currency:           "BRL",
+	},
+	{
+		ID:                 "nubank_credit_card",
+		Bank:               "Nubank",
+		DetectHeaders:      []string{"date", "title", "amount"},
+		DateColumns:        []string{"date"},
+		AmountColumns:      []string{"amount"},
+		DescriptionColumns: []string{"title"},
+		CategoryColumns:    []string{"category"},
+		DateLayouts:        []string{"2006-01-02"},
+		DecimalSeparator:   ".",
+		PositiveIsDebit:    true,
+		Source:             "credit_card",
+		Currency:           "BRL",
+	},
+	{
+		ID:                 "itau",
+		Bank:               "Itaú",
+		DetectHeaders:      []string{"data", "lancamento", "valor"},
+		DateColumns:        []string{"data"},
+		AmountColumns:      []string{"valor"},
+		DescriptionColumns: []string{"lancamento"},
+		DateLayouts:        []string{"02/01/2006"},
+		DecimalSeparator:   ",",
+		Currency:           "BRL",
+	},
+	{
+		ID:                 "bradesco",
+		Bank:               "Bradesco",
+		DetectHeaders:      []string{"data", "historico", "credito(r$)", "debito(r$)"},
+		DateColumns:        []string{"data"},
+		CreditColumns:      []string{"credito(r$)"},
+		DebitColumns:       []string{"debito(r$)"},
+		DescriptionColumns: []string{"historico"},
+		DateLayouts:        []string{"02/01/2006", "02/01/06"},
+		DecimalSeparator:   ",",
+		Currency:           "BRL",
+	},
+	{
+		ID:                 "inter",
+		Bank:               "Banco Inter",
+		DetectHeaders:      []string{"data lancamento", "historico", "descricao", "valor"},
+		DateColumns:        []string{"data lancamento"},
+		AmountColumns:      []string{"valor"},
+		DescriptionColumns: []string{"historico", "descricao"},
+		DateLayouts:        []string{"02/01/2006"},
+		DecimalSeparator:   ",",
+		Currency:           "BRL",
+	},
+	{
+		ID:                 "c6",
+		Bank:               "C6 Bank",
+		DetectHeaders:      []string{"data lancamento", "titulo", "entrada(r$)", "saida(r$)"},
+		DateColumns:        []string{"data lancamento"},
+		CreditColumns:      []string{"entrada(r$)"},
+		DebitColumns:       []string{"saida(r$)"},
+		DescriptionColumns: []string{"titulo", "descricao"},
+		DateLayouts:        []string{"02/01/2006"},
+		DecimalSeparator:   ",",
+		Currency:           "BRL",
+	},
+	{
+		ID:                 "generic",
+		Bank:               "Generic CSV",
+		DateColumns:        []string{"data", "date", "data lancamento", "data da transacao", "transaction date", "posted date"},
+		AmountColumns:      []string{"valor", "amount", "value", "valor(r$)", "quantia"},
+		CreditColumns:      []string{"credito", "credit", "entrada"},
+		DebitColumns:       []string{"debito", "debit", "saida"},
+		DescriptionColumns: []string{"descricao", "description", "historico", "lancamento", "title", "titulo", "memo", "payee"},
+		CategoryColumns:    []string{"categoria", "category"},
+		CurrencyColumns:    []string{"moeda", "currency"},
+		DateLayouts:        []string{"02/01/2006", "2006-01-02", "01/02/2006", "02-01-2006"},
+	},
+}
+
+// csvColumns holds the resolved column indexes of a profile for one file
+type csvColumns struct {
+	date        int
+	amount      int
+	credit      int
+	debit       int
+	category    int
+	externalID  int
+	currency    int
+	description []int
+}
+
+// headerReplacer strips the accents that appear in Brazilian bank headers
+var headerReplacer = strings.NewReplacer(
+	"á", "a", "à", "a", "â", "a", "ã", "a",
+	"é", "e", "ê", "e", "í", "i",
+	"ó", "o", "ô", "o", "õ", "o", "ú", "u", "ç", "c",
+)
+
+// normalizeHeader lowercases a header, removes accents and extra spaces so
+// "Descrição", "descricao " and "Crédito (R$)" compare as "descricao" and "credito(r$)"
+func normalizeHeader(h string) string {
+	h = headerReplacer.Replace(strings.ToLower(h))
+	h = strings.Join(strings.Fields(h), " ")
+	return strings.ReplaceAll(h, " (", "(")
+}
+
+// newStatementCSVReader returns a CSV reader configured for a bank export
+func newStatementCSVReader(file io.Reader, comma rune) *csv.Reader {
+	reader := csv.NewReader(file)
+	reader.Comma = comma
+	reader.FieldsPerRecord = -1 // Footers and totals often have fewer columns
+	return reader
+}
+
+// headerIndex returns the index of the first candidate present in the header
+func headerIndex(header []string, candidates []string) int {
+	for _, c := range candidates {
+		for i, h := range header {
+			if h == c {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// resolveColumns maps the profile's columns onto a header row. It fails when
+// the row lacks a detect header, a date, a description or any amount column.
+func (p *BankProfile) resolveColumns(header []string) (csvColumns, bool) {
+	normalized := make([]string, len(header))
+	for i, h := range header {
+		normalized[i] = normalizeHeader(h)
+	}
+
+	for _, required := range p.DetectHeaders {
+		if headerIndex(normalized, []string{required}) == -1 {
+			return csvColumns{}, false
+		}
+	}
+
+	cols := csvColumns{
+		date:       headerIndex(normalized, p.DateColumns),
+		amount:     headerIndex(normalized, p.AmountColumns),
+		credit:     headerIndex(normalized, p.CreditColumns),
+		debit:      headerIndex(normalized, p.DebitColumns),
+		category:   headerIndex(normalized, p.CategoryColumns),
+		externalID: headerIndex(normalized, p.ExternalIDColumns),
+		currency:   headerIndex(normalized, p.CurrencyColumns),
+	}
+	for _, c := range p.DescriptionColumns {
+		if i := headerIndex(normalized, []string{c}); i != -1 {
+			cols.description = append(cols.description, i)
+		}
+	}
+
+	hasAmount := cols.amount != -1 || (cols.credit != -1 && cols.debit != -1)
+	if cols.date == -1 || !hasAmount || len(cols.description) == 0 {
+		return csvColumns{}, false
+	}
+	return cols, true
+}
+
+// Name identifies the profile in import responses
+func (p *BankProfile) Name() string {
+	return p.ID
+}
+
+// Detect checks whether one of the first lines of the file is a header this profile understands
+func (p *BankProfile) Detect(filename string, head []byte) bool {
+	_, ok := p.findHeader(decodeCSVHead(head))
+	return ok
+}
+
+// Parse reads every row of a CSV export using the profile's mapping
+func (p *BankProfile) Parse(file io.Reader, userID, source string) (ParseResult, error) {
+	// Keep the content so rejected rows can be reported as they appear in the file
+	data, err := io.ReadAll(file)
+	if err != nil {
+		log.Printf("ERROR: Failed to read CSV file: %v", err)
+		return ParseResult{}, fmt.Errorf("Failed to read CSV file")
+	}
+	data, encoding := decodeCSV(data)
+
+	header, ok := p.findHeader(data)
+	if !ok {
+		return ParseResult{}, fmt.Errorf("CSV format not recognized by profile %s", p.ID)
+	}
+	log.Printf("CSV Headers: %v (profile %s, %s)", header.Row, p.ID, encoding)
+
+	// The preamble before the header is left out; rows keep their line in the file
+	data = data[header.Offset:]
+	reader := newStatementCSVReader(bytes.NewReader(data), header.Comma)
+	if _, err := reader.Read(); err != nil {
+		log.Printf("ERROR: Failed to read CSV header: %v", err)
+		return ParseResult{}, fmt.Errorf("Failed to read CSV header")
+	}
+	cols := header.Cols
+
+	result := ParseResult{Header: rawRecord(data, 0, reader.InputOffset())}
+	offset := reader.InputOffset()
+
+	// Every row is read before any is converted, since the locale is decided from whole columns
+	var records []csvRecord
+	var rows [][]string
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		raw := rawRecord(data, offset, reader.InputOffset())
+		offset = reader.InputOffset()
+
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			records = append(records, csvRecord{raw: raw, line: parseErr.StartLine + header.Line, err: parseErr.Err})
+			continue
+		}
+		if err != nil {
+			log.Printf("ERROR: Failed to read CSV row: %v", err)
+			return ParseResult{}, fmt.Errorf("Failed to read CSV file")
+		}
+
+		line, _ := reader.FieldPos(0)
+		records = append(records, csvRecord{row: row, raw: raw, line: line + header.Line})
+		rows = append(rows, row)
+	}
+
+	locale, err := p.detectLocale(rows, cols)
+	if err != nil {
+		log.Printf("ERROR: %v (profile %s)", err, p.ID)
+		return ParseResult{}, err
+	}
+
+	result.Transactions, result.Skipped = p.convertRecords(records, cols, locale, userID, source)
+	return result, nil
+}
+
+// csvRecord is a data row of a statement together with where it came from
+type csvRecord struct {
+	row  []string
+	raw  string // The row as it appears in the file
+	line int
+	err  error // A malformed row (e.g. a stray quote) only costs that row
+}
+
+// errNoMovement is returned for a row of split credit and debit columns with
+// both empty, such as Bradesco's "SALDO ANTERIOR" balance line. It is not a
+// transaction, so it is left out instead of reported as a skipped row.
+var errNoMovement = errors.New("No credit or debit amount")
+
+// convertRecords turns the rows of one file into transactions using the
+// locale decided for the file, reporting the rows that can't be converted
+func (p *BankProfile) convertRecords(records []csvRecord, cols csvColumns, locale csvLocale, userID, source string) ([]Transaction, []SkippedRow) {
+	if p.Source != "" {
+		source = p.Source
+	}
+
+	var transactions []Transaction
+	var skipped []SkippedRow
+	for _, rec := range records {
+		err := rec.err
+		var t Transaction
+		if err == nil {
+			t, err = p.parseRow(rec.row, cols, locale)
+		}
+		if err == errNoMovement {
+			log.Printf("Row %d: %v, left out", rec.line, err)
+			continue
+		}
+		if err != nil {
+			log.Printf("Row %d: %v", rec.line, err)
+			skipped = append(skipped, skippedRow(rec.line, rec.raw, err))
+			continue
+		}
+		t.UserID = userID
+		t.Source = source
+		t.Line = rec.line
+		t.Raw = rec.raw
+
+		transactions = append(transactions, t)
+	}
+	return transactions, skipped
+}
+
+// rawRecord returns data[start:end] without its line terminator
+func rawRecord(data []byte, start, end int64) string {
+	return strings.TrimRight(string(data[start:end]), "\r\n")
+}
+
+// cell returns the trimmed value at index i, or "" when the row is too short
+func cell(row []string, i int) string {
+	if i < 0 || i >= len(row) {
+		return ""
+	}
+	return strings.TrimSpace(row[i])
+}
+
+// parseRow converts one CSV row into a Transaction without user or source
+func (p *BankProfile) parseRow(row []string, cols csvColumns, locale csvLocale) (Transaction, error) {
+	dateStr := cell(row, cols.date)
+	date, err := time.Parse(locale.DateLayout, dateOnly(dateStr))
+	if err != nil {
+		return Transaction{}, invalidField("date", "Invalid date format: %s", dateStr)
+	}
+
+	// The currency column wins over the symbol of the amount, which wins over the profile
+	currency := normalizeCurrency(cell(row, cols.currency))
+	amountCurrency := func(s string) {
+		if _, c := splitCurrency(s); currency == "" && c != "" {
+			currency = c
+		}
+	}
+
+	var amount float64
+	if cols.amount != -1 {
+		amountStr := cell(row, cols.amount)
+		amountCurrency(amountStr)
+		if amount, err = parseAmount(amountStr, locale.DecimalSeparator); err != nil {
+			return Transaction{}, invalidField("amount", "Invalid amount format: %s", amountStr)
+		}
+	} else {
+		// Split columns: money in is credit, money out is debit whatever its sign
+		credit, debit := 0.0, 0.0
+		if cell(row, cols.credit) == "" && cell(row, cols.debit) == "" {
+			return Transaction{}, errNoMovement
+		}
+		if s := cell(row, cols.credit); s != "" {
+			amountCurrency(s)
+			if credit, err = parseAmount(s, locale.DecimalSeparator); err != nil {
+				return Transaction{}, invalidField("amount", "Invalid amount format: %s", s)
+			}
+		}
+		if s := cell(row, cols.debit); s != "" {
+			amountCurrency(s)
+			if debit, err = parseAmount(s, locale.DecimalSeparator); err != nil {
+				return Transaction{}, invalidField("amount", "Invalid amount format: %s", s)
+			}
+		}
+		amount = math.Abs(credit) - math.Abs(debit)
+	}
+	if p.PositiveIsDebit {
+		amount = -amount
+	}
+
+	var parts []string
+	for _, i := range cols.description {
+		if s := cell(row, i); s != "" {
+			parts = append(parts, s)
+		}
+	}
+	description := strings.Join(parts, " - ")
+	if description == "" {
+		return Transaction{}, invalidField("description", "Missing description")
+	}
+
+	// Determine transaction type based on amount
+	transType := "debit"
+	if amount > 0 {
+		transType = "credit"
+	}
+
+	category := "Uncategorized"
+	if s := cell(row, cols.category); s != "" {
+		category = s
+	}
+
+	if currency == "" {
+		currency = p.Currency
+	}
+
+	return Transaction{
+		Date:        date,
+		Description: description,
+		Category:    category,
+		ExternalID:  cell(row, cols.externalID),
+		Amount:      math.Abs(amount), // Store amount as positive
+		Type:        transType,
+		Currency:    currency,
+	}, nil
+}
+
+// parseAmount parses an amount written with the given decimal separator.
+// The currency symbol or code, thousands separators and "(1,00)" or "1,00-" negatives are handled.
+func parseAmount(s, decimalSeparator string) (float64, error) {
+	s, _ = splitCurrency(s)
+	s = strings.ReplaceAll(s, " ", "")
+
+	negative := false
+	if strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")") {
+		negative = true
+		s = s[1 : len(s)-1]
+	} else if strings.HasSuffix(s, "-") {
+		negative = true
+		s = s[:len(s)-1]
+	}
+
+	if decimalSeparator == "," {
+		s = strings.ReplaceAll(s, ".", "")
+		s = strings.ReplaceAll(s, ",", ".")
+	} else {
+		s = strings.ReplaceAll(s, ",", "")
+	}
+
+	amount, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if negative {
+		amount = -amount
+	}
+	return amount, nil
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// qifRecord holds the raw fields of a single QIF record (terminated by ^)
+type qifRecord struct {
+	Line     int
+	Source   string
+	Date     string
+	Amount   string
+	Payee    string
+	Memo     string
+	Category string
+	Splits   []qifSplit
+	Raw      []string // Lines of the record, for error reports
+}
+
+// qifSplit is one S/E/$ split line group of a QIF record
+type qifSplit struct {
+	Category string
+	Memo     string
+	Amount   string
+}
+
+// isQIFFile reports whether the file name looks like a QIF export
+func isQIFFile(filename string) bool {
+	return strings.EqualFold(filepath.Ext(filename), ".qif")
+}
+
+// parseQIF reads the !Type:Bank and !Type:CCard sections of a QIF file.
+// Records of other types (investments, category lists, account lists) are ignored.
+func parseQIF(file io.Reader, userID string) (ParseResult, error) {
+	var records []qifRecord
+	var current qifRecord
+	source := ""
+	lineCount := 0
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lineCount++
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" {
+			continue
+		}
+
+		// Section headers decide which account type the following records belong to
+		if strings.HasPrefix(line, "!") {
+			header := strings.ToLower(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(header, "!type:bank"):
+				source = "checking"
+			case strings.HasPrefix(header, "!type:ccard"):
+				source = "credit_card"
+			case strings.HasPrefix(header, "!option"), strings.HasPrefix(header, "!clear"):
+				// Options don't change the current section
+			default:
+				source = ""
+			}
+			current = qifRecord{}
+			continue
+		}
+
+		if current.Line == 0 {
+			current.Line = lineCount
+		}
+		current.Raw = append(current.Raw, line)
+
+		code, value := line[0], strings.TrimSpace(line[1:])
+		switch code {
+		case '^':
+			// A lone "^" closes nothing; records without a D line are reported when converted
+			if source != "" && len(current.Raw) > 1 {
+				current.Source = source
+				records = append(records, current)
+			}
+			current = qifRecord{}
+		case 'D':
+			current.Date = value
+		case 'T', 'U':
+			current.Amount = value
+		case 'P':
+			current.Payee = value
+		case 'M':
+			current.Memo = value
+		case 'L':
+			current.Category = value
+		case 'S':
+			current.Splits = append(current.Splits, qifSplit{Category: value})
+		case 'E':
+			if n := len(current.Splits); n > 0 {
+				current.Splits[n-1].Memo = value
+			}
+		case '$':
+			if n := len(current.Splits); n > 0 {
+				current.Splits[n-1].Amount = value
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return ParseResult{}, fmt.Errorf("Failed to read QIF file")
+	}
+
+	if len(records) == 0 {
+		return ParseResult{}, fmt.Errorf("QIF format not recognized. Requires !Type:Bank or !Type:CCard records")
+	}
+
+	// The same file always uses one date layout and decimal separator, so
+	// decide them from all records, as for CSV files
+	var dates, amounts []string
+	for _, rec := range records {
+		if rec.Date != "" {
+			dates = append(dates, rec.Date)
+		}
+		if rec.Amount != "" {
+			amounts = append(amounts, rec.Amount)
+		}
+		for _, split := range rec.Splits {
+			if split.Amount != "" {
+				amounts = append(amounts, split.Amount)
+			}
+		}
+	}
+	dayFirst, err := qifDayFirst(dates)
+	if err != nil {
+		return ParseResult{}, err
+	}
+	separator, err := detectDecimalSeparator(amounts, "")
+	if err != nil {
+		return ParseResult{}, err
+	}
+
+	var result ParseResult
+	for _, rec := range records {
+		raw := strings.Join(rec.Raw, "\n")
+		if rec.Date == "" {
+			log.Printf("QIF line %d: Record has no date", rec.Line)
+			result.Skipped = append(result.Skipped, skippedRow(rec.Line, raw, invalidField("date", "Record has no D (date) line")))
+			continue
+		}
+		date, err := parseQIFDate(rec.Date, dayFirst)
+		if err != nil {
+			log.Printf("QIF line %d: Invalid date format: %s", rec.Line, rec.Date)
+			result.Skipped = append(result.Skipped, skippedRow(rec.Line, raw, invalidField("date", "Invalid date format: %s", rec.Date)))
+			continue
+		}
+
+		description := rec.Payee
+		if rec.Memo != "" && rec.Memo != rec.Payee {
+			if description == "" {
+				description = rec.Memo
+			} else {
+				description += " - " + rec.Memo
+			}
+		}
+
+		// Split records become one transaction per split so each keeps its category
+		parts := rec.Splits
+		if len(parts) == 0 {
+			parts = []qifSplit{{Category: rec.Category, Amount: rec.Amount}}
+		}
+
+		for _, part := range parts {
+			amount, err := parseAmount(part.Amount, separator)
+			if err != nil {
+				log.Printf("QIF line %d: Invalid amount format: %s", rec.Line, part.Amount)
+				result.Skipped = append(result.Skipped, skippedRow(rec.Line, raw, invalidField("amount", "Invalid amount format: %s", part.Amount)))
+				continue
+			}
+
+			transType := "debit"
+			if amount > 0 {
+				transType = "credit"
+			}
+
+			partDescription := description
+			if part.Memo != "" {
+				partDescription += " - " + part.Memo
+			}
+
+			result.Transactions = append(result.Transactions, Transaction{
+				UserID:      userID,
+				Date:        date,
+				Description: partDescription,
+				Category:    qifCategory(part.Category),
+				Amount:      math.Abs(amount),
+				Type:        transType,
+				Source:      rec.Source,
+				Line:        rec.Line,
+				Raw:         raw,
+			})
+		}
+	}
+
+	return result, nil
+}
+
+// qifCategory turns an L/S field into a category name. "Category/Class"
+// drops the class and "[Account]" marks a transfer to another account.
+func qifCategory(value string) string {
+	if i := strings.Index(value, "/"); i != -1 {
+		value = value[:i]
+	}
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]") {
+		return "Transfer: " + strings.TrimSpace(value[1:len(value)-1])
+	}
+	if value == "" {
+		return "Uncategorized"
+	}
+	return value
+}
+
+// splitQIFDate breaks a QIF date such as 3/15'24, 15.03.2024 or 2024-03-15
+// into its numeric parts and reports whether the apostrophe year form was used
+func splitQIFDate(s string) ([]int, bool, error) {
+	s = strings.ReplaceAll(s, " ", "")
+	apostrophe := strings.Contains(s, "'")
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == '/' || r == '.' || r == '-' || r == '\''
+	})
+	if len(fields) != 3 {
+		return nil, false, fmt.Errorf("invalid QIF date %q", s)
+	}
+	parts := make([]int, 3)
+	for i, f := range fields {
+		n, err := strconv.Atoi(f)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid QIF date %q", s)
+		}
+		parts[i] = n
+	}
+	return parts, apostrophe, nil
+}
+
+// qifDayFirst decides whether the file writes dates as day/month or month/day.
+// QIF has no header for this, so it looks for a component greater than 12.
+// A file giving no hint is rejected as CSV files are, unless every date reads
+// the same either way.
+func qifDayFirst(dates []string) (bool, error) {
+	dayFirst, monthFirst := false, false
+	ambiguous := ""
+	for _, d := range dates {
+		parts, _, err := splitQIFDate(d)
+		if err != nil || parts[0] > 31 {
+			// Unparseable or year-first dates carry no hint
+			continue
+		}
+		switch {
+		case parts[0] > 12:
+			dayFirst = true
+		case parts[1] > 12:
+			monthFirst = true
+		case parts[0] != parts[1] && ambiguous == "":
+			ambiguous = d
+		}
+	}
+	switch {
+	case dayFirst && monthFirst:
+		return false, fmt.Errorf("QIF file mixes day/month and month/day dates")
+	case !dayFirst && !monthFirst && ambiguous != "":
+		return false, ambiguousDates(ambiguous, "MM/DD/YYYY", "DD/MM/YYYY")
+	}
+	return dayFirst, nil
+}
+
+// parseQIFDate parses a QIF date using the day/month order chosen for the file
+func parseQIFDate(s string, dayFirst bool) (time.Time, error) {
+	parts, apostrophe, err := splitQIFDate(s)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var year, month, day int
+	switch {
+	case parts[0] > 31:
+		year, month, day = parts[0], parts[1], parts[2]
+	case dayFirst:
+		day, month, year = parts[0], parts[1], parts[2]
+	default:
+		month, day, year = parts[0], parts[1], parts[2]
+	}
+
+	// Quicken writes 2000+ years as 'YY and older ones as /YY
+	if year < 100 {
+		if apostrophe || year < 70 {
+			year += 2000
+		} else {
+			year += 1900
+		}
+	}
+
+	if month < 1 || month > 12 || day < 1 || day > 31 {
+		return time.Time{}, fmt.Errorf("invalid QIF date %q", s)
+	}
+	date := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+	if date.Day() != day {
+		return time.Time{}, fmt.Errorf("invalid QIF date %q", s)
+	}
+	return date, nil
+}
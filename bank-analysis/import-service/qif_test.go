@@ -0,0 +1,160 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestQIFStatement parses a Brazilian export with a split record, a card
+// section and a record missing its date, which is reported instead of dropped
+func TestQIFStatement(t *testing.T) {
+	qif := `!Type:Bank
+D15/03/2024
+T-1.234,56
+PALUGUEL
+LMoradia
+^
+D18/03/2024
+T-100,00
+PSUPERMERCADO
+SMercado
+EComida
+$-80,00
+SCasa
+$-20,00
+^
+T-45,90
+PFARMACIA
+^
+!Type:CCard
+D20/03'24
+U-59,90
+PNETFLIX.COM
+L[Cartão]
+^
+`
+	result, err := parseQIF(strings.NewReader(qif), "user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		date, description, category string
+		amount                      float64
+		source                      string
+	}{
+		{"2024-03-15", "ALUGUEL", "Moradia", 1234.56, "checking"},
+		{"2024-03-18", "SUPERMERCADO - Comida", "Mercado", 80, "checking"},
+		{"2024-03-18", "SUPERMERCADO", "Casa", 20, "checking"},
+		{"2024-03-20", "NETFLIX.COM", "Transfer: Cartão", 59.90, "credit_card"},
+	}
+	if len(result.Transactions) != len(want) {
+		t.Fatalf("%d transactions, want %d", len(result.Transactions), len(want))
+	}
+	for i, w := range want {
+		got := result.Transactions[i]
+		if got.Date.Format("2006-01-02") != w.date || got.Description != w.description || got.Category != w.category ||
+			got.Amount != w.amount || got.Type != "debit" || got.Source != w.source {
+			t.Errorf("row %d: %s %q %q %.2f %s %s, want %s %q %q %.2f debit %s", i+1,
+				got.Date.Format("2006-01-02"), got.Description, got.Category, got.Amount, got.Type, got.Source,
+				w.date, w.description, w.category, w.amount, w.source)
+		}
+	}
+
+	if len(result.Skipped) != 1 {
+		t.Fatalf("%d records skipped, want the one without a date", len(result.Skipped))
+	}
+	if skipped := result.Skipped[0]; skipped.Line != 16 || skipped.Field != "date" || skipped.Raw != "T-45,90\nPFARMACIA\n^" {
+		t.Errorf("skipped line %d, field %q, raw %q; want line 16, the date and the record", skipped.Line, skipped.Field, skipped.Raw)
+	}
+}
+
+// TestQIFDecimalSeparator checks the separator is decided once for the file,
+// so an amount like 1.234 reads by what the other amounts show
+func TestQIFDecimalSeparator(t *testing.T) {
+	tests := []struct {
+		name    string
+		amounts []string
+		want    []float64
+		err     string
+	}{
+		{"comma decimals", []string{"-1.234", "10,50"}, []float64{1234, 10.50}, ""},
+		{"dot decimals", []string{"-1,234", "10.50"}, []float64{1234, 10.50}, ""},
+		{"thousands and decimals", []string{"R$ -1.234,56", "2.500"}, []float64{1234.56, 2500}, ""},
+		{"whole amounts", []string{"-12", "300"}, []float64{12, 300}, ""},
+		{"both separators", []string{"-10,50", "10.50"}, nil, `Amounts use both "," and "." as decimal separator`},
+		{"no hint", []string{"-1.234", "2.500"}, nil, "Ambiguous amounts"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var qif strings.Builder
+			qif.WriteString("!Type:Bank\n")
+			for _, amount := range tt.amounts {
+				qif.WriteString("D03/15/2024\nT" + amount + "\nPLOJA\n^\n")
+			}
+
+			result, err := parseQIF(strings.NewReader(qif.String()), "user@example.com")
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result.Transactions) != len(tt.want) {
+				t.Fatalf("%d transactions, want %d", len(result.Transactions), len(tt.want))
+			}
+			for i, want := range tt.want {
+				if got := result.Transactions[i].Amount; got != want {
+					t.Errorf("%s read as %.2f, want %.2f", tt.amounts[i], got, want)
+				}
+			}
+		})
+	}
+}
+
+// TestQIFDateOrder checks the day/month order is taken from the dates that
+// show it and that a file where none does is rejected like a CSV file
+func TestQIFDateOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		dates []string
+		want  []string
+		err   string
+	}{
+		{"day first", []string{"05/03/2024", "15/03/2024"}, []string{"2024-03-05", "2024-03-15"}, ""},
+		{"month first", []string{"3/5'24", "3/15'24"}, []string{"2024-03-05", "2024-03-15"}, ""},
+		{"year first", []string{"2024-03-05"}, []string{"2024-03-05"}, ""},
+		{"same either way", []string{"03/03/2024", "2024.03.05"}, []string{"2024-03-03", "2024-03-05"}, ""},
+		{"ambiguous", []string{"05/03/2024", "06/03/2024"}, nil,
+			`Ambiguous dates: "05/03/2024" reads as both MM/DD/YYYY and DD/MM/YYYY, no date in the file tells them apart`},
+		{"mixed", []string{"15/03/2024", "03/16/2024"}, nil, "QIF file mixes day/month and month/day dates"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var qif strings.Builder
+			qif.WriteString("!Type:Bank\n")
+			for _, date := range tt.dates {
+				qif.WriteString("D" + date + "\nT-10.00\nPLOJA\n^\n")
+			}
+
+			result, err := parseQIF(strings.NewReader(qif.String()), "user@example.com")
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, want := range tt.want {
+				if got := result.Transactions[i].Date.Format("2006-01-02"); got != want {
+					t.Errorf("%s read as %s, want %s", tt.dates[i], got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RejectedRow is a row of an import job that was not stored, either because
+// it failed validation or because the database refused it
+type RejectedRow struct {
+	JobID      primitive.ObjectID `json:"-" bson:"jobId"`
+	FileName   string             `json:"fileName" bson:"fileName"`
+	Stage      string             `json:"stage" bson:"stage"`        // "parse" or "write"
+	Header     string             `json:"-" bson:"header,omitempty"` // Header line of the CSV file the row came from
+	SkippedRow `bson:",inline"`
+}
+
+var rejectedCollection *mongo.Collection
+
+// reject stores rows of one file that were not imported
+func (run *jobRun) reject(file statementFile, header, stage string, rows []SkippedRow) {
+	if len(rows) == 0 {
+		return
+	}
+
+	docs := make([]interface{}, len(rows))
+	for i, row := range rows {
+		docs[i] = RejectedRow{JobID: run.job.ID, FileName: file.Name, Stage: stage, Header: header, SkippedRow: row}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := rejectedCollection.InsertMany(ctx, docs); err != nil {
+		log.Printf("Error saving rejected rows of job %s: %v", run.job.ID.Hex(), err)
+	}
+}
+
+// findRejectedRows loads the rejected rows of a job in the order they were found
+func findRejectedRows(ctx context.Context, jobID primitive.ObjectID) ([]RejectedRow, error) {
+	cursor, err := rejectedCollection.Find(ctx, bson.M{"jobId": jobID}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	rows := []RejectedRow{}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// rejectedRowsCSVHandler downloads the rejected rows of a job as CSV
+func rejectedRowsCSVHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	jobID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid job ID format", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	count, err := jobCollection.CountDocuments(ctx, bson.M{"_id": jobID, "userId": userID})
+	if err != nil || count == 0 {
+		http.Error(w, "Import job not found", http.StatusNotFound)
+		return
+	}
+
+	rows, err := findRejectedRows(ctx, jobID)
+	if err != nil {
+		log.Printf("Error finding rejected rows: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", "attachment; filename=rejected_rows_"+jobID.Hex()+".csv")
+	writeRejectedCSV(w, rows)
+}
+
+// writeRejectedCSV writes rejected rows so they can be fixed and uploaded again.
+// Rows that all come from one CSV layout keep the file's header and content
+// with an extra import_error column, which no bank profile reads. Anything
+// else is written as one line per row with its file, line, field and reason.
+func writeRejectedCSV(w io.Writer, rows []RejectedRow) {
+	header := ""
+	sameLayout := len(rows) > 0
+	for _, row := range rows {
+		if row.Header == "" || (header != "" && row.Header != header) {
+			sameLayout = false
+			break
+		}
+		header = row.Header
+	}
+
+	if sameLayout {
+		comma := csvDelimiter(header)
+		io.WriteString(w, header+string(comma)+"import_error\n")
+		for _, row := range rows {
+			io.WriteString(w, row.Raw+string(comma)+quoteCSVField(row.Reason, comma)+"\n")
+		}
+		return
+	}
+
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"file", "line", "field", "reason", "raw"})
+	for _, row := range rows {
+		line := ""
+		if row.Line > 0 {
+			line = strconv.Itoa(row.Line)
+		}
+		writer.Write([]string{row.FileName, line, row.Field, row.Reason, row.Raw})
+	}
+	writer.Flush()
+}
+
+// quoteCSVField quotes a value when it would otherwise break the CSV row
+func quoteCSVField(value string, comma rune) string {
+	if !strings.ContainsAny(value, string(comma)+"\"\r\n") {
+		return value
+	}
+	return `"` + strings.ReplaceAll(value, `"`, `""`) + `"`
+}
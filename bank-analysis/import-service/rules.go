@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// CategoryRule assigns a category to the transactions matching all of its
+// conditions. Rules are tried by descending priority, the first match wins.
+type CategoryRule struct {
+	ID                  primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	UserID              string             `json:"userId" bson:"userId"`
+	Name                string             `json:"name,omitempty" bson:"name,omitempty"`
+	Category            string             `json:"category" bson:"category"`
+	Priority            int                `json:"priority" bson:"priority"`
+	DescriptionContains string             `json:"descriptionContains,omitempty" bson:"descriptionContains,omitempty"` // Ignores case and accents
+	DescriptionRegex    string             `json:"descriptionRegex,omitempty" bson:"descriptionRegex,omitempty"`       // Go syntax, ignores case
+	MinAmount           *float64           `json:"minAmount,omitempty" bson:"minAmount,omitempty"`                     // Inclusive bounds on the positive amount
+	MaxAmount           *float64           `json:"maxAmount,omitempty" bson:"maxAmount,omitempty"`
+	Source              string             `json:"source,omitempty" bson:"source,omitempty"` // "checking" or "credit_card"
+	Type                string             `json:"type,omitempty" bson:"type,omitempty"`     // "credit" or "debit"
+	Enabled             bool               `json:"enabled" bson:"enabled"`
+	CreatedAt           time.Time          `json:"createdAt" bson:"createdAt"`
+	UpdatedAt           time.Time          `json:"updatedAt" bson:"updatedAt"`
+
+	pattern *regexp.Regexp
+}
+
+var ruleCollection *mongo.Collection
+
+// validate checks the rule and compiles its pattern
+func (rule *CategoryRule) validate() error {
+	rule.Name = strings.TrimSpace(rule.Name)
+	rule.Category = strings.TrimSpace(rule.Category)
+	if rule.Category == "" {
+		return fmt.Errorf("Category is required")
+	}
+	if rule.DescriptionContains == "" && rule.DescriptionRegex == "" && rule.MinAmount == nil &&
+		rule.MaxAmount == nil && rule.Source == "" && rule.Type == "" {
+		return fmt.Errorf("A rule needs at least one condition")
+	}
+	if err := rule.compile(); err != nil {
+		return fmt.Errorf("Invalid description pattern: %v", err)
+	}
+	if rule.MinAmount != nil && rule.MaxAmount != nil && *rule.MinAmount > *rule.MaxAmount {
+		return fmt.Errorf("Minimum amount must not exceed the maximum amount")
+	}
+	if err := checkSource(rule.Source); err != nil {
+		return err
+	}
+	switch rule.Type {
+	case "", "credit", "debit":
+	default:
+		return fmt.Errorf("Type must be credit or debit")
+	}
+	return nil
+}
+
+func (rule *CategoryRule) compile() error {
+	rule.pattern = nil
+	if rule.DescriptionRegex == "" {
+		return nil
+	}
+	pattern, err := regexp.Compile("(?i)" + rule.DescriptionRegex)
+	if err != nil {
+		return err
+	}
+	rule.pattern = pattern
+	return nil
+}
+
+// matches reports whether the transaction meets every condition of the rule
+func (rule *CategoryRule) matches(t Transaction) bool {
+	if rule.Source != "" && rule.Source != t.Source {
+		return false
+	}
+	if rule.Type != "" && rule.Type != t.Type {
+		return false
+	}
+	if rule.MinAmount != nil && t.Amount < *rule.MinAmount {
+		return false
+	}
+	if rule.MaxAmount != nil && t.Amount > *rule.MaxAmount {
+		return false
+	}
+	if rule.DescriptionContains != "" && !strings.Contains(normalizeHeader(t.Description), normalizeHeader(rule.DescriptionContains)) {
+		return false
+	}
+	if rule.pattern != nil && !rule.pattern.MatchString(t.Description) {
+		return false
+	}
+	return true
+}
+
+// loadCategoryRules returns the user's enabled rules in the order they are tried
+func loadCategoryRules(ctx context.Context, userID string) ([]CategoryRule, error) {
+	cursor, err := ruleCollection.Find(ctx, bson.M{"userId": userID, "enabled": true})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var stored []CategoryRule
+	if err := cursor.All(ctx, &stored); err != nil {
+		return nil, err
+	}
+
+	rules := stored[:0]
+	for _, rule := range stored {
+		if err := rule.compile(); err != nil {
+			log.Printf("Warning: Skipping category rule %s with an invalid pattern: %v", rule.ID.Hex(), err)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		if rules[i].Priority != rules[j].Priority {
+			return rules[i].Priority > rules[j].Priority
+		}
+		return rules[i].CreatedAt.Before(rules[j].CreatedAt)
+	})
+	return rules, nil
+}
+
+// matchCategoryRule returns the first rule the transaction matches, or nil
+func matchCategoryRule(rules []CategoryRule, t Transaction) *CategoryRule {
+	for i := range rules {
+		if rules[i].matches(t) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// applyCategoryRules categorizes parsed transactions. Transactions no rule
+// matches keep the category the statement gave them.
+func applyCategoryRules(rules []CategoryRule, transactions []Transaction) {
+	for i := range transactions {
+		if rule := matchCategoryRule(rules, transactions[i]); rule != nil {
+			transactions[i].Category = rule.Category
+			transactions[i].CategoryRuleID = rule.ID.Hex()
+		}
+	}
+}
+
+// categorize applies the user's rules before an import is written. A failure
+// to load them leaves the transactions as parsed.
+func categorize(ctx context.Context, userID string, transactions []Transaction) {
+	ruleCtx, ruleCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer ruleCancel()
+	rules, err := loadCategoryRules(ruleCtx, userID)
+	if err != nil {
+		log.Printf("Error loading category rules for %s: %v", userID, err)
+		return
+	}
+	applyCategoryRules(rules, transactions)
+}
+
+func listRulesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	findOptions := options.Find().SetSort(bson.D{{Key: "priority", Value: -1}, {Key: "createdAt", Value: 1}})
+	cursor, err := ruleCollection.Find(ctx, bson.M{"userId": userID}, findOptions)
+	if err != nil {
+		log.Printf("Error finding category rules: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	rules := []CategoryRule{}
+	if err := cursor.All(ctx, &rules); err != nil {
+		log.Printf("Error parsing category rules: %v", err)
+		http.Error(w, "Error parsing results", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+func createRuleHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	// Rules are enabled unless the request says otherwise
+	rule := CategoryRule{Enabled: true}
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := rule.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rule.ID = primitive.NewObjectID()
+	rule.UserID = userID
+	rule.CreatedAt = time.Now()
+	rule.UpdatedAt = rule.CreatedAt
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := ruleCollection.InsertOne(ctx, rule); err != nil {
+		log.Printf("Error inserting category rule: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rule)
+}
+
+func updateRuleHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	objectID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid rule ID format", http.StatusBadRequest)
+		return
+	}
+
+	rule := CategoryRule{Enabled: true}
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := rule.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	update := bson.M{"$set": bson.M{
+		"name":                rule.Name,
+		"category":            rule.Category,
+		"priority":            rule.Priority,
+		"descriptionContains": rule.DescriptionContains,
+		"descriptionRegex":    rule.DescriptionRegex,
+		"minAmount":           rule.MinAmount,
+		"maxAmount":           rule.MaxAmount,
+		"source":              rule.Source,
+		"type":                rule.Type,
+		"enabled":             rule.Enabled,
+		"updatedAt":           time.Now(),
+	}}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	filter := bson.M{"_id": objectID, "userId": userID}
+	var updated CategoryRule
+	if err := ruleCollection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&updated); err != nil {
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Rule not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error updating category rule: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+func deleteRuleHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	objectID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid rule ID format", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := ruleCollection.DeleteOne(ctx, bson.M{"_id": objectID, "userId": userID})
+	if err != nil {
+		log.Printf("Error deleting category rule: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if result.DeletedCount == 0 {
+		http.Error(w, "Rule not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Response{Message: "Rule deleted successfully"})
+}
+
+// applyRulesHandler recategorizes the user's stored transactions with the
+// current rules. Categories set by hand are never touched. A transaction a
+// rule categorized earlier that no rule matches anymore goes back to
+// "Uncategorized"; other categories no rule matches are kept.
+func applyRulesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	rules, err := loadCategoryRules(ctx, userID)
+	if err != nil {
+		log.Printf("Error loading category rules: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	filter := bson.M{"userId": userID, "categoryManual": bson.M{"$ne": true}}
+	projection := bson.M{"description": 1, "category": 1, "categoryRuleId": 1, "amount": 1, "type": 1, "source": 1}
+	cursor, err := collection.Find(ctx, filter, options.Find().SetProjection(projection))
+	if err != nil {
+		log.Printf("Error finding transactions to recategorize: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	var models []mongo.WriteModel
+	updated := 0
+	flush := func() error {
+		if len(models) == 0 {
+			return nil
+		}
+		result, err := collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		if result != nil {
+			updated += int(result.ModifiedCount)
+		}
+		models = models[:0]
+		return err
+	}
+
+	for cursor.Next(ctx) {
+		var stored struct {
+			ID          primitive.ObjectID `bson:"_id"`
+			Transaction `bson:",inline"`
+		}
+		if err := cursor.Decode(&stored); err != nil {
+			log.Printf("Error decoding transaction: %v", err)
+			continue
+		}
+
+		category, ruleID := stored.Category, ""
+		if rule := matchCategoryRule(rules, stored.Transaction); rule != nil {
+			category, ruleID = rule.Category, rule.ID.Hex()
+		} else if stored.CategoryRuleID != "" {
+			category = "Uncategorized"
+		}
+		if category == stored.Category && ruleID == stored.CategoryRuleID {
+			continue
+		}
+
+		// A suggestion's confidence no longer applies once a rule decides the category
+		update := bson.M{"$set": bson.M{"category": category, "categoryRuleId": ruleID}, "$unset": bson.M{"categoryConfidence": ""}}
+		if ruleID == "" {
+			update = bson.M{"$set": bson.M{"category": category}, "$unset": bson.M{"categoryRuleId": "", "categoryConfidence": ""}}
+		}
+		// Skip the transaction if it was categorized by hand in the meantime
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": stored.ID, "categoryManual": bson.M{"$ne": true}}).
+			SetUpdate(update))
+		if len(models) == bulkWriteBatch {
+			if err = flush(); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = cursor.Err()
+	}
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		log.Printf("Error recategorizing transactions: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Recategorized %d transactions of %s with %d rules", updated, userID, len(rules))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Response{
+		Message: fmt.Sprintf("Recategorized %d transactions", updated),
+		Count:   updated,
+	})
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Folder scans and watches only read from the import root, where every user
+// has a directory of their own, and from the shared drop folders configured
+// by the administrator. A folder path in a request is relative to the user's
+// directory, or "shared:<name>/<subfolder>" for a shared folder.
+
+// defaultImportRoot is where user directories live unless IMPORT_ROOT says otherwise
+const defaultImportRoot = "/data/imports"
+
+// sharedFolderPrefix starts the folder paths that point into a shared drop folder
+const sharedFolderPrefix = "shared:"
+
+// SharedFolder is a drop folder the administrator opened to a list of users
+type SharedFolder struct {
+	Name  string
+	Path  string
+	Users []string // "*" opens the folder to every user
+}
+
+// errFolderNotAllowed is returned for folders outside the places a user may import from
+var errFolderNotAllowed = errors.New("Folder is outside your import directory")
+
+// importRoot reads the directory holding the user directories from IMPORT_ROOT
+func importRoot() string {
+	if root := os.Getenv("IMPORT_ROOT"); root != "" {
+		return root
+	}
+	return defaultImportRoot
+}
+
+// userDirName escapes a user ID into a directory name. Letters, digits and
+// "@.+-" are kept and every other byte, "_" included, is written as "_" and
+// its two hex digits, so distinct IDs never share a directory.
+func userDirName(userID string) string {
+	var name strings.Builder
+	for i := 0; i < len(userID); i++ {
+		c := userID[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', strings.IndexByte("@.+-", c) != -1:
+			name.WriteByte(c)
+		default:
+			fmt.Fprintf(&name, "_%02x", c)
+		}
+	}
+	return name.String()
+}
+
+// userImportDir returns the directory of a user below the import root
+func userImportDir(userID string) (string, error) {
+	name := userDirName(userID)
+	if name == "" || strings.Trim(name, ".") == "" {
+		return "", fmt.Errorf("invalid user ID %q for an import directory", userID)
+	}
+	return filepath.Join(importRoot(), name), nil
+}
+
+// sharedFolderConfig holds the parsed IMPORT_SHARED_FOLDERS, read once
+var sharedFolderConfig struct {
+	once    sync.Once
+	folders map[string]SharedFolder
+}
+
+// sharedFolders returns the shared drop folders by name
+func sharedFolders() map[string]SharedFolder {
+	sharedFolderConfig.once.Do(func() {
+		sharedFolderConfig.folders = parseSharedFolders(os.Getenv("IMPORT_SHARED_FOLDERS"))
+	})
+	return sharedFolderConfig.folders
+}
+
+// parseSharedFolders parses IMPORT_SHARED_FOLDERS, a ";" separated list of
+// name=path:user,user entries, e.g.
+//
+//	family=/srv/drop/family:ana@example.com,joao@example.com;office=/srv/drop/office:*
+//
+// Malformed entries are logged and ignored, a folder is never opened by mistake.
+func parseSharedFolders(config string) map[string]SharedFolder {
+	folders := make(map[string]SharedFolder)
+	for _, entry := range strings.Split(config, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, rest, ok := strings.Cut(entry, "=")
+		path, users, ok2 := strings.Cut(rest, ":")
+		name, path = strings.TrimSpace(name), strings.TrimSpace(path)
+		if !ok || !ok2 || name == "" || strings.ContainsAny(name, "/\\") || !filepath.IsAbs(path) {
+			log.Printf("Warning: Ignoring malformed shared folder %q in IMPORT_SHARED_FOLDERS", entry)
+			continue
+		}
+		folder := SharedFolder{Name: name, Path: path}
+		for _, user := range strings.Split(users, ",") {
+			if user = strings.TrimSpace(user); user != "" {
+				folder.Users = append(folder.Users, user)
+			}
+		}
+		folders[name] = folder
+	}
+	return folders
+}
+
+// allows reports whether the shared folder is open to the user
+func (f SharedFolder) allows(userID string) bool {
+	for _, user := range f.Users {
+		if user == "*" || user == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// importBases lists the directories the user may import from
+func importBases(userID string) ([]string, error) {
+	userDir, err := userImportDir(userID)
+	if err != nil {
+		return nil, err
+	}
+	bases := []string{userDir}
+	for _, folder := range sharedFolders() {
+		if folder.allows(userID) {
+			bases = append(bases, folder.Path)
+		}
+	}
+	return bases, nil
+}
+
+// resolveImportFolder turns the folder path of a request into the directory
+// it names, with symlinks resolved. The user's directory is created on first use.
+func resolveImportFolder(userID, folderPath string) (string, error) {
+	var base, rel string
+	if strings.HasPrefix(folderPath, sharedFolderPrefix) {
+		name, sub, _ := strings.Cut(strings.TrimPrefix(folderPath, sharedFolderPrefix), "/")
+		folder, ok := sharedFolders()[name]
+		if !ok || !folder.allows(userID) {
+			return "", fmt.Errorf("Shared folder %s not found", name)
+		}
+		base, rel = folder.Path, sub
+	} else {
+		userDir, err := userImportDir(userID)
+		if err != nil {
+			return "", err
+		}
+		if err := os.MkdirAll(userDir, 0o750); err != nil {
+			log.Printf("Error creating import directory %s: %v", userDir, err)
+			return "", fmt.Errorf("Failed to create your import directory")
+		}
+		base, rel = userDir, folderPath
+		// Absolute paths are accepted when they point into the user's directory
+		if filepath.IsAbs(folderPath) {
+			base, rel = folderPath, ""
+		}
+	}
+
+	return checkImportFolder(userID, filepath.Join(base, rel))
+}
+
+// checkImportFolder verifies that a directory lies within the user's
+// directory or a shared folder open to the user and returns it with symlinks
+// resolved. Jobs check their folder again when they run, as the filesystem
+// may have changed since.
+func checkImportFolder(userID, folder string) (string, error) {
+	resolved, err := checkImportPath(userID, folder)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(resolved)
+	if err != nil || !info.IsDir() {
+		return "", fmt.Errorf("Folder not found")
+	}
+	return resolved, nil
+}
+
+// checkImportPath resolves symlinks and ".." in a path and verifies the result
+// lies within the user's directory or a shared folder open to the user, so
+// neither can lead out of them.
+func checkImportPath(userID, path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", fmt.Errorf("Folder not found")
+	}
+
+	bases, err := importBases(userID)
+	if err != nil {
+		return "", err
+	}
+	for _, base := range bases {
+		realBase, err := filepath.EvalSymlinks(base)
+		if err != nil {
+			continue
+		}
+		if rel, err := filepath.Rel(realBase, resolved); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return resolved, nil
+		}
+	}
+	log.Printf("Rejected import path %s for %s, resolves to %s", path, userID, resolved)
+	return "", errFolderNotAllowed
+}
+
+// listFoldersHandler tells the user which folders they may scan or watch
+func listFoldersHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	shared := []string{}
+	for _, folder := range sharedFolders() {
+		if folder.allows(userID) {
+			shared = append(shared, sharedFolderPrefix+folder.Name)
+		}
+	}
+	sort.Strings(shared)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Shared []string `json:"shared"` // Folder paths of the shared folders open to the user
+	}{shared})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestUserDirName checks IDs are escaped into a single path element and that
+// IDs which would read the same with "_" or "/" unescaped keep apart.
+func TestUserDirName(t *testing.T) {
+	tests := []struct {
+		userID string
+		want   string
+	}{
+		{"ana@example.com", "ana@example.com"},
+		{"ana+bank@example.com", "ana+bank@example.com"},
+		{"../ana", ".._2fana"},
+		{"ana/bob", "ana_2fbob"},
+		{"ana_2fbob", "ana_5f2fbob"},
+		{"ana_bob", "ana_5fbob"},
+		{"ana bob", "ana_20bob"},
+		{"joão", "jo_c3_a3o"},
+	}
+	seen := make(map[string]string)
+	for _, tt := range tests {
+		got := userDirName(tt.userID)
+		if got != tt.want {
+			t.Errorf("userDirName(%q) = %q, want %q", tt.userID, got, tt.want)
+		}
+		if other, ok := seen[got]; ok {
+			t.Errorf("%q and %q share the directory %q", other, tt.userID, got)
+		}
+		seen[got] = tt.userID
+	}
+
+	for _, userID := range []string{"", ".", ".."} {
+		if dir, err := userImportDir(userID); err == nil {
+			t.Errorf("userImportDir(%q) = %s, want an error", userID, dir)
+		}
+	}
+}
+
+// TestParseSharedFolders checks well-formed entries are read and malformed
+// ones dropped without opening anything.
+func TestParseSharedFolders(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   map[string]SharedFolder
+	}{
+		{"empty", "", map[string]SharedFolder{}},
+		{
+			"two folders",
+			" family=/srv/drop/family:ana@example.com, joao@example.com ;office=/srv/drop/office:*;",
+			map[string]SharedFolder{
+				"family": {Name: "family", Path: "/srv/drop/family", Users: []string{"ana@example.com", "joao@example.com"}},
+				"office": {Name: "office", Path: "/srv/drop/office", Users: []string{"*"}},
+			},
+		},
+		{"no users", "family=/srv/drop/family:", map[string]SharedFolder{"family": {Name: "family", Path: "/srv/drop/family"}}},
+		{"relative path", "family=drop/family:*", map[string]SharedFolder{}},
+		{"no user list", "family=/srv/drop/family", map[string]SharedFolder{}},
+		{"no name", "=/srv/drop/family:*", map[string]SharedFolder{}},
+		{"slash in name", "../family=/srv/drop/family:*", map[string]SharedFolder{}},
+		{"malformed entry kept apart", "family=drop:*;office=/srv/drop/office:*", map[string]SharedFolder{
+			"office": {Name: "office", Path: "/srv/drop/office", Users: []string{"*"}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseSharedFolders(tt.config); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestCheckImportPath builds an import root with two users, a shared folder
+// and symlinks, and checks which paths a user may reach.
+func TestCheckImportPath(t *testing.T) {
+	tmp, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(tmp, "imports")
+	t.Setenv("IMPORT_ROOT", root)
+
+	userID := "ana@example.com"
+	userDir := filepath.Join(root, userDirName(userID))
+	otherDir := filepath.Join(root, userDirName("bob@example.com"))
+	shared := filepath.Join(tmp, "drop", "family")
+	closed := filepath.Join(tmp, "drop", "office")
+	outside := filepath.Join(tmp, "etc")
+	for _, dir := range []string{filepath.Join(userDir, "2024"), otherDir, filepath.Join(shared, "march"), closed, outside} {
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, link := range [][2]string{
+		{outside, filepath.Join(userDir, "escape")},
+		{otherDir, filepath.Join(userDir, "neighbour")},
+		{filepath.Join(userDir, "2024"), filepath.Join(userDir, "this-year")},
+		{outside, filepath.Join(shared, "escape")},
+	} {
+		if err := os.Symlink(link[0], link[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sharedFolderConfig.once.Do(func() {})
+	saved := sharedFolderConfig.folders
+	sharedFolderConfig.folders = parseSharedFolders("family=" + shared + ":" + userID + ";office=" + closed + ":bob@example.com")
+	t.Cleanup(func() { sharedFolderConfig.folders = saved })
+
+	tests := []struct {
+		name   string
+		folder string // Folder path as a request sends it
+		want   string // Resolved directory, empty when rejected
+	}{
+		{"own directory", "", userDir},
+		{"subfolder", "2024", filepath.Join(userDir, "2024")},
+		{"absolute path inside", filepath.Join(userDir, "2024"), filepath.Join(userDir, "2024")},
+		{"symlink inside", "this-year", filepath.Join(userDir, "2024")},
+		{"dot dot to the root", "..", ""},
+		{"dot dot to another user", "../" + userDirName("bob@example.com"), ""},
+		{"dot dot through a subfolder", "2024/../../..", ""},
+		{"absolute path outside", outside, ""},
+		{"absolute path of another user", otherDir, ""},
+		{"symlink escaping the root", "escape", ""},
+		{"symlink to another user", "neighbour", ""},
+		{"shared folder", "shared:family", shared},
+		{"shared subfolder", "shared:family/march", filepath.Join(shared, "march")},
+		{"dot dot out of a shared folder", "shared:family/../office", ""},
+		{"symlink escaping a shared folder", "shared:family/escape", ""},
+		{"shared folder not open to the user", "shared:office", ""},
+		{"unknown shared folder", "shared:nope", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveImportFolder(userID, tt.folder)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("resolved to %s, want it rejected", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("got %s (%v), want %s", got, err, tt.want)
+			}
+		})
+	}
+
+	// Files are checked on their own by the jobs
+	if _, err := checkImportPath(userID, filepath.Join(userDir, "escape", "passwd")); err == nil {
+		t.Error("a file behind an escaping symlink was accepted")
+	}
+	if err := os.WriteFile(filepath.Join(shared, "march", "extrato.csv"), nil, 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkImportPath(userID, filepath.Join(shared, "march", "extrato.csv")); err != nil {
+		t.Errorf("file in the shared folder rejected: %v", err)
+	}
+	if _, err := checkImportPath("bob@example.com", filepath.Join(shared, "march", "extrato.csv")); err != errFolderNotAllowed {
+		t.Errorf("file in a shared folder closed to the user: got %v, want %v", err, errFolderNotAllowed)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// bulkWriteBatch is how many rows are looked up and written per BulkWrite
+const bulkWriteBatch = 500
+
+// duplicateLookupBatch bounds the number of fingerprints looked up per query
+const duplicateLookupBatch = 500
+
+// upsertStats counts what happened to the transactions of one import
+type upsertStats struct {
+	Inserted  int
+	Updated   int
+	Unchanged int
+	Errors    []string
+	Failed    []SkippedRow // The rows behind Errors, for the rejected rows report
+}
+
+// upsertTransactions stores the transactions under the given batch and records
+// every insert and update in the batch's change log so it can be rolled back.
+// Rows are written with unordered bulk writes of up to bulkWriteBatch rows.
+// progress, when set, is called after every bulk write. Once ctx is cancelled
+// the remaining rows are left out.
+func upsertTransactions(ctx context.Context, batchID string, transactions []Transaction, progress func(upsertStats)) upsertStats {
+	var stats upsertStats
+	rows := make([]int, 0, bulkWriteBatch)
+	keys := make(map[string]bool)
+
+	flush := func() {
+		if len(rows) == 0 {
+			return
+		}
+		writeRows(ctx, batchID, transactions, rows, &stats)
+		rows = rows[:0]
+		keys = make(map[string]bool)
+		if progress != nil {
+			progress(stats)
+		}
+	}
+
+	for i, t := range transactions {
+		if ctx.Err() != nil {
+			return stats
+		}
+
+		// A row repeating one of the pending rows has to see the first one
+		// stored, otherwise the unordered write would insert both
+		if keys[t.Fingerprint] {
+			flush()
+		}
+		keys[t.Fingerprint] = true
+		rows = append(rows, i)
+
+		if len(rows) == bulkWriteBatch {
+			flush()
+		}
+	}
+	if ctx.Err() == nil {
+		flush()
+	}
+	return stats
+}
+
+// writeRows upserts the given rows of transactions with a single unordered
+// BulkWrite. Rows whose stored document would not change are left untouched so
+// they stay with the batch that wrote them.
+func writeRows(ctx context.Context, batchID string, transactions []Transaction, rows []int, stats *upsertStats) {
+	batch := make([]Transaction, len(rows))
+	for i, row := range rows {
+		batch[i] = transactions[row]
+		batch[i].BatchID = batchID
+	}
+
+	existing, err := findExisting(ctx, batch, nil)
+	if err == nil {
+		err = findAccountless(ctx, batch, existing)
+	}
+	if err != nil {
+		for _, row := range rows {
+			addRowError(stats, transactions, row, err)
+		}
+		return
+	}
+
+	var models []mongo.WriteModel
+	var modelRows []int   // Row of transactions written by each model
+	var previous []bson.M // Stored document each model updates, nil for upserts
+	var written []bson.M  // Document each model leaves, without the _id of upserts
+	for i, t := range batch {
+		stored, found := existing[t.Fingerprint]
+		if found {
+			keepStoredCategory(stored, &t)
+		}
+		switch {
+		case !found:
+			models = append(models, mongo.NewUpdateOneModel().
+				SetFilter(dedupFilter(t)).
+				SetUpdate(bson.D{{Key: "$set", Value: t}}).
+				SetUpsert(true))
+			previous = append(previous, nil)
+		case sameContent(stored, t):
+			stats.Unchanged++
+			continue
+		default:
+			update := bson.D{{Key: "$set", Value: t}}
+			document := writtenDocument(stored, t)
+			// A suggestion's confidence only describes the category it suggested
+			if _, ok := stored["categoryConfidence"]; ok && stored["category"] != t.Category {
+				update = append(update, bson.E{Key: "$unset", Value: bson.M{"categoryConfidence": ""}})
+				delete(document, "categoryConfidence")
+			}
+			models = append(models, mongo.NewUpdateOneModel().
+				SetFilter(bson.D{{Key: "_id", Value: stored["_id"]}}).
+				SetUpdate(update))
+			previous = append(previous, stored)
+			modelRows = append(modelRows, rows[i])
+			written = append(written, document)
+			continue
+		}
+		modelRows = append(modelRows, rows[i])
+		written = append(written, writtenDocument(stored, t))
+	}
+	if len(models) == 0 {
+		return
+	}
+
+	result, err := collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+
+	// Unordered writes report the models that failed and still apply the others
+	failed := make(map[int]bool)
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) {
+		for _, writeErr := range bulkErr.WriteErrors {
+			failed[writeErr.Index] = true
+			addRowError(stats, transactions, modelRows[writeErr.Index], fmt.Errorf("%s", writeErr.Message))
+		}
+		if bulkErr.WriteConcernError != nil {
+			log.Printf("Warning: Write concern error while importing batch %s: %v", batchID, bulkErr.WriteConcernError)
+		}
+	} else if err != nil {
+		for _, row := range modelRows {
+			addRowError(stats, transactions, row, err)
+		}
+		return
+	}
+
+	var upserted map[int64]interface{}
+	if result != nil {
+		upserted = result.UpsertedIDs
+	}
+
+	var changes []interface{}
+	for i := range models {
+		if failed[i] {
+			continue
+		}
+		if previous[i] != nil {
+			stats.Updated++
+			id, _ := previous[i]["_id"].(primitive.ObjectID)
+			changes = append(changes, BatchChange{BatchID: batchID, TransactionID: id, Operation: "update", Previous: previous[i], Written: written[i]})
+			continue
+		}
+		if id, ok := upserted[int64(i)].(primitive.ObjectID); ok {
+			stats.Inserted++
+			if written[i] != nil {
+				written[i]["_id"] = id
+			}
+			changes = append(changes, BatchChange{BatchID: batchID, TransactionID: id, Operation: "insert", Written: written[i]})
+		} else {
+			// Another import stored the same transaction in the meantime
+			stats.Updated++
+		}
+	}
+	recordChanges(ctx, batchID, changes)
+}
+
+// findExisting loads the stored documents matching the transactions, keyed by
+// fingerprint. A nil projection loads the full documents.
+func findExisting(ctx context.Context, transactions []Transaction, projection bson.M) (map[string]bson.M, error) {
+	existing := make(map[string]bson.M)
+
+	for start := 0; start < len(transactions); start += duplicateLookupBatch {
+		end := start + duplicateLookupBatch
+		if end > len(transactions) {
+			end = len(transactions)
+		}
+
+		// Every file belongs to one user, but group by user to stay correct regardless
+		fingerprints := make(map[string]bson.A)
+		for _, t := range transactions[start:end] {
+			fingerprints[t.UserID] = append(fingerprints[t.UserID], t.Fingerprint)
+		}
+		filters := bson.A{}
+		for userID, values := range fingerprints {
+			filters = append(filters, bson.M{"userId": userID, "fingerprint": bson.M{"$in": values}})
+		}
+
+		findOptions := options.Find()
+		if projection != nil {
+			findOptions.SetProjection(projection)
+		}
+		cursor, err := collection.Find(ctx, bson.M{"$or": filters}, findOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		var stored []bson.M
+		err = cursor.All(ctx, &stored)
+		cursor.Close(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, doc := range stored {
+			if fp, ok := doc["fingerprint"].(string); ok {
+				existing[fp] = doc
+			}
+		}
+	}
+	return existing, nil
+}
+
+// addRowError reports a failed row by the line of the file it was read from
+func addRowError(stats *upsertStats, transactions []Transaction, row int, err error) {
+	line := transactions[row].Line
+	if line == 0 {
+		line = row + 1
+	}
+	log.Printf("Error upserting transaction from row %d: %v", line, err)
+	stats.Errors = append(stats.Errors, fmt.Sprintf("Row %d: %v", line, err))
+	stats.Failed = append(stats.Failed, SkippedRow{Line: line, Raw: transactions[row].Raw, Reason: err.Error()})
+}
+
+// keepStoredCategory keeps the category of a stored transaction that a
+// re-import of it would lose. A category the user picked by hand always
+// outlives re-imports. One applied from a suggestion, carried over by a
+// duplicate merge or read from the file is kept when the re-imported row has
+// none; a category rule that now matches the row still takes over, while a
+// category of a rule that no longer matches is dropped as applying the rules
+// would drop it.
+func keepStoredCategory(stored bson.M, t *Transaction) {
+	category, _ := stored["category"].(string)
+	switch {
+	case stored["categoryManual"] == true:
+		t.Category = category
+		t.CategoryRuleID = ""
+	case t.CategoryRuleID != "" || (t.Category != "" && t.Category != "Uncategorized"):
+		// The re-imported row brings a category of its own
+	case category != "" && category != "Uncategorized" && stored["categoryRuleId"] == nil:
+		t.Category = category
+	}
+}
+
+// transactionFields returns the fields writing t sets, as they read back from the database
+func transactionFields(t Transaction) (bson.M, error) {
+	data, err := bson.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	var fields bson.M
+	if err := bson.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// writtenDocument is the document setting t's fields over stored leaves,
+// stored being nil for an insert. It is nil when t can't be encoded.
+func writtenDocument(stored bson.M, t Transaction) bson.M {
+	fields, err := transactionFields(t)
+	if err != nil {
+		return nil
+	}
+	document := make(bson.M, len(stored)+len(fields))
+	for key, value := range stored {
+		document[key] = value
+	}
+	for key, value := range fields {
+		document[key] = value
+	}
+	return document
+}
+
+// sameDocument reports whether two stored documents hold the same fields and
+// values. The pending duplicate flag is left out, duplicate detection sets it
+// right after an import and it doesn't change the transaction.
+func sameDocument(a, b bson.M) bool {
+	fields := func(doc bson.M) map[string]interface{} {
+		f := make(map[string]interface{}, len(doc))
+		for key, value := range doc {
+			if key == "duplicateStatus" && value == "pending" {
+				continue
+			}
+			f[key] = value
+		}
+		return f
+	}
+	fa, fb := fields(a), fields(b)
+	if len(fa) != len(fb) {
+		return false
+	}
+	for key, value := range fa {
+		other, ok := fb[key]
+		if !ok || !reflect.DeepEqual(value, other) {
+			return false
+		}
+	}
+	return true
+}
+
+// sameContent reports whether writing t would leave the stored document as it is
+func sameContent(previous bson.M, t Transaction) bool {
+	fields, err := transactionFields(t)
+	if err != nil {
+		return false
+	}
+
+	for key, value := range fields {
+		if key == "batchId" {
+			continue
+		}
+		if !reflect.DeepEqual(previous[key], value) {
+			return false
+		}
+	}
+	return true
+}
+
+// recordChanges appends to a batch's change log. A failure only costs the
+// ability to undo those rows, so it is logged rather than failing the import.
+func recordChanges(ctx context.Context, batchID string, changes []interface{}) {
+	if len(changes) == 0 {
+		return
+	}
+	if _, err := batchChangeCollection.InsertMany(ctx, changes, options.InsertMany().SetOrdered(false)); err != nil {
+		log.Printf("Warning: Failed to record changes of batch %s: %v", batchID, err)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// benchRows is the size of the file the write benchmarks import
+const benchRows = 50000
+
+// benchTransactions generates unique transactions the way a parsed file has them
+func benchTransactions(rows int) []Transaction {
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	transactions := make([]Transaction, rows)
+	for i := range transactions {
+		transactions[i] = Transaction{
+			UserID:      "bench@example.com",
+			Date:        day.AddDate(0, 0, i%365),
+			Description: fmt.Sprintf("Benchmark purchase %d", i),
+			Category:    "Benchmark",
+			Amount:      float64(i%10000)/100 + 1,
+			Type:        "debit",
+			Source:      defaultSource,
+			Line:        i + 2,
+		}
+	}
+	assignFingerprints(transactions)
+	return transactions
+}
+
+// benchDatabase points the collections at a scratch database of the MongoDB
+// at MONGO_BENCH_URI, skipping the test or benchmark when it isn't set
+func benchDatabase(tb testing.TB) *mongo.Database {
+	uri := os.Getenv("MONGO_BENCH_URI")
+	if uri == "" {
+		tb.Skip("MONGO_BENCH_URI not set")
+	}
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { client.Disconnect(ctx) })
+
+	db := client.Database("bank_analysis_bench")
+	collection = db.Collection("transactions")
+	batchCollection = db.Collection("import_batches")
+	batchChangeCollection = db.Collection("batch_changes")
+	jobCollection = db.Collection("import_jobs")
+	rejectedCollection = db.Collection("import_rejected_rows")
+	duplicateCollection = db.Collection("import_duplicates")
+	return db
+}
+
+// resetBenchDatabase empties the scratch database and recreates the fingerprint index
+func resetBenchDatabase(tb testing.TB, db *mongo.Database) {
+	ctx := context.Background()
+	if err := db.Drop(ctx); err != nil {
+		tb.Fatal(err)
+	}
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "userId", Value: 1}, {Key: "fingerprint", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// BenchmarkUpsertPerRow is the write path before bulk writes: one upsert per row
+func BenchmarkUpsertPerRow(b *testing.B) {
+	db := benchDatabase(b)
+	transactions := benchTransactions(benchRows)
+	ctx := context.Background()
+
+	var elapsed time.Duration
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		resetBenchDatabase(b, db)
+		b.StartTimer()
+		start := time.Now()
+		for _, t := range transactions {
+			_, err := collection.UpdateOne(ctx, dedupFilter(t), bson.M{"$set": t}, options.Update().SetUpsert(true))
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		elapsed += time.Since(start)
+	}
+	b.ReportMetric(float64(benchRows*b.N)/elapsed.Seconds(), "rows/s")
+}
+
+// BenchmarkUpsertTransactions is the bulk write path, first storing a file
+// and then importing it again, which finds every row unchanged
+func BenchmarkUpsertTransactions(b *testing.B) {
+	db := benchDatabase(b)
+	transactions := benchTransactions(benchRows)
+	ctx := context.Background()
+
+	for _, run := range []string{"insert", "reimport"} {
+		b.Run(run, func(b *testing.B) {
+			var elapsed time.Duration
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				if run == "insert" || i == 0 {
+					resetBenchDatabase(b, db)
+				}
+				if run == "reimport" && i == 0 {
+					upsertTransactions(ctx, "bench", transactions, nil)
+				}
+				b.StartTimer()
+				start := time.Now()
+				stats := upsertTransactions(ctx, "bench", transactions, nil)
+				elapsed += time.Since(start)
+				if len(stats.Errors) > 0 {
+					b.Fatal(stats.Errors[0])
+				}
+			}
+			b.ReportMetric(float64(benchRows*b.N)/elapsed.Seconds(), "rows/s")
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestUploadTooLarge checks both upload endpoints answer 413 for a body over
+// maxUploadSize, whether or not the client announced its length
+func TestUploadTooLarge(t *testing.T) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	file, err := form.CreateFormFile("file", "extrato.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(bytes.Repeat([]byte("01/03/2024;PADARIA;-1,00\n"), maxUploadSize/25+1))
+	form.Close()
+
+	handlers := map[string]http.HandlerFunc{"/upload": uploadHandler, "/preview": previewHandler}
+	for path, handler := range handlers {
+		for _, announced := range []bool{true, false} {
+			req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body.Bytes()))
+			req.Header.Set("Content-Type", form.FormDataContentType())
+			req.Header.Set("X-User-ID", "user@example.com")
+			if !announced {
+				req.ContentLength = -1
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != http.StatusRequestEntityTooLarge {
+				t.Errorf("%s with announced length %v answered %d: %s", path, announced, rec.Code, rec.Body.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// UserProfile is a column mapping a user saved for a bank without a built-in profile
+type UserProfile struct {
+	ID                primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	UserID            string             `json:"userId" bson:"userId"`
+	Name              string             `json:"name" bson:"name"`
+	DateColumn        string             `json:"dateColumn" bson:"dateColumn"`
+	AmountColumn      string             `json:"amountColumn" bson:"amountColumn"`
+	DescriptionColumn string             `json:"descriptionColumn" bson:"descriptionColumn"`
+	CategoryColumn    string             `json:"categoryColumn,omitempty" bson:"categoryColumn,omitempty"`
+	ExternalIDColumn  string             `json:"externalIdColumn,omitempty" bson:"externalIdColumn,omitempty"` // Column with the bank's transaction ID
+	CurrencyColumn    string             `json:"currencyColumn,omitempty" bson:"currencyColumn,omitempty"`     // Column with each row's currency code
+	Currency          string             `json:"currency,omitempty" bson:"currency,omitempty"`                 // ISO 4217 code of the rows without one
+	DateLayout        string             `json:"dateLayout" bson:"dateLayout"`                                 // e.g. "DD/MM/YYYY"
+	DecimalSeparator  string             `json:"decimalSeparator" bson:"decimalSeparator"`                     // "," or ".", empty detects it
+	SignConvention    string             `json:"signConvention" bson:"signConvention"`                         // "positive_credit" or "positive_debit"
+	Source            string             `json:"source,omitempty" bson:"source,omitempty"`                     // "checking" or "credit_card"
+	CreatedAt         time.Time          `json:"createdAt" bson:"createdAt"`
+	UpdatedAt         time.Time          `json:"updatedAt" bson:"updatedAt"`
+}
+
+var profileCollection *mongo.Collection
+
+// dateLayoutReplacer turns a user-facing date pattern into a Go time layout
+var dateLayoutReplacer = strings.NewReplacer("YYYY", "2006", "YY", "06", "MM", "01", "DD", "02")
+
+// goDateLayout converts patterns such as DD/MM/YYYY or YYYY-MM-DD into a Go layout
+func goDateLayout(pattern string) (string, error) {
+	layout := dateLayoutReplacer.Replace(strings.ToUpper(strings.TrimSpace(pattern)))
+	if layout == "" || strings.ContainsAny(layout, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") {
+		return "", fmt.Errorf("unsupported date layout %q, use DD, MM, YY and YYYY", pattern)
+	}
+	return layout, nil
+}
+
+// validate checks the mapping and fills in defaults
+func (p *UserProfile) validate() error {
+	p.Name = strings.TrimSpace(p.Name)
+	if p.Name == "" {
+		return fmt.Errorf("Name is required")
+	}
+	if p.DateColumn == "" || p.AmountColumn == "" || p.DescriptionColumn == "" {
+		return fmt.Errorf("Date, amount and description columns are required")
+	}
+	if _, err := goDateLayout(p.DateLayout); err != nil {
+		return err
+	}
+	switch p.DecimalSeparator {
+	case "", ",", ".":
+	default:
+		return fmt.Errorf("Decimal separator must be \",\", \".\" or empty to detect it")
+	}
+	switch p.SignConvention {
+	case "":
+		p.SignConvention = "positive_credit"
+	case "positive_credit", "positive_debit":
+	default:
+		return fmt.Errorf("Sign convention must be positive_credit or positive_debit")
+	}
+	if err := checkSource(p.Source); err != nil {
+		return err
+	}
+	if p.Currency != "" {
+		if p.Currency = normalizeCurrency(p.Currency); p.Currency == "" {
+			return fmt.Errorf("Currency must be an ISO 4217 code such as BRL or USD")
+		}
+	}
+	return nil
+}
+
+// toBankProfile turns the saved mapping into a profile the CSV parser understands
+func (p *UserProfile) toBankProfile() *BankProfile {
+	layout, _ := goDateLayout(p.DateLayout)
+	profile := &BankProfile{
+		ID:                 "user:" + p.ID.Hex(),
+		Bank:               p.Name,
+		DetectHeaders:      []string{normalizeHeader(p.DateColumn), normalizeHeader(p.AmountColumn), normalizeHeader(p.DescriptionColumn)},
+		DateColumns:        []string{normalizeHeader(p.DateColumn)},
+		AmountColumns:      []string{normalizeHeader(p.AmountColumn)},
+		DescriptionColumns: []string{normalizeHeader(p.DescriptionColumn)},
+		DateLayouts:        []string{layout},
+		DecimalSeparator:   p.DecimalSeparator,
+		PositiveIsDebit:    p.SignConvention == "positive_debit",
+		Source:             p.Source,
+		Currency:           p.Currency,
+	}
+	if p.CategoryColumn != "" {
+		profile.CategoryColumns = []string{normalizeHeader(p.CategoryColumn)}
+	}
+	if p.ExternalIDColumn != "" {
+		profile.ExternalIDColumns = []string{normalizeHeader(p.ExternalIDColumn)}
+	}
+	if p.CurrencyColumn != "" {
+		profile.CurrencyColumns = []string{normalizeHeader(p.CurrencyColumn)}
+	}
+	return profile
+}
+
+// loadUserProfile fetches one of the user's saved mappings
+func loadUserProfile(ctx context.Context, userID, id string) (*UserProfile, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var profile UserProfile
+	filter := bson.M{"_id": objectID, "userId": userID}
+	if err := profileCollection.FindOne(ctx, filter).Decode(&profile); err != nil {
+		return nil, err
+	}
+	return &profile, nil
+}
+
+// loadUserParsers returns the user's saved mappings as parsers for format detection
+func loadUserParsers(ctx context.Context, userID string) ([]StatementParser, error) {
+	cursor, err := profileCollection.Find(ctx, bson.M{"userId": userID}, options.Find().SetSort(bson.M{"name": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var profiles []UserProfile
+	if err := cursor.All(ctx, &profiles); err != nil {
+		return nil, err
+	}
+
+	parsers := make([]StatementParser, 0, len(profiles))
+	for i := range profiles {
+		parsers = append(parsers, profiles[i].toBankProfile())
+	}
+	return parsers, nil
+}
+
+func listProfilesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := profileCollection.Find(ctx, bson.M{"userId": userID}, options.Find().SetSort(bson.M{"name": 1}))
+	if err != nil {
+		log.Printf("Error finding profiles: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	profiles := []UserProfile{}
+	if err := cursor.All(ctx, &profiles); err != nil {
+		log.Printf("Error parsing profiles: %v", err)
+		http.Error(w, "Error parsing results", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profiles)
+}
+
+func getProfileHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	profile, err := loadUserProfile(ctx, userID, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Profile not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profile)
+}
+
+func createProfileHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	var profile UserProfile
+	if err := json.NewDecoder(r.Body).Decode(&profile); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := profile.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	profile.ID = primitive.NewObjectID()
+	profile.UserID = userID
+	profile.CreatedAt = time.Now()
+	profile.UpdatedAt = profile.CreatedAt
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := profileCollection.InsertOne(ctx, profile); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			http.Error(w, "A profile with this name already exists", http.StatusConflict)
+			return
+		}
+		log.Printf("Error inserting profile: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(profile)
+}
+
+func updateProfileHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	objectID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid profile ID format", http.StatusBadRequest)
+		return
+	}
+
+	var profile UserProfile
+	if err := json.NewDecoder(r.Body).Decode(&profile); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := profile.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	update := bson.M{"$set": bson.M{
+		"name":              profile.Name,
+		"dateColumn":        profile.DateColumn,
+		"amountColumn":      profile.AmountColumn,
+		"descriptionColumn": profile.DescriptionColumn,
+		"categoryColumn":    profile.CategoryColumn,
+		"externalIdColumn":  profile.ExternalIDColumn,
+		"currencyColumn":    profile.CurrencyColumn,
+		"currency":          profile.Currency,
+		"dateLayout":        profile.DateLayout,
+		"decimalSeparator":  profile.DecimalSeparator,
+		"signConvention":    profile.SignConvention,
+		"source":            profile.Source,
+		"updatedAt":         time.Now(),
+	}}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	filter := bson.M{"_id": objectID, "userId": userID}
+	var updated UserProfile
+	if err := profileCollection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&updated); err != nil {
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Profile not found", http.StatusNotFound)
+			return
+		}
+		if mongo.IsDuplicateKeyError(err) {
+			http.Error(w, "A profile with this name already exists", http.StatusConflict)
+			return
+		}
+		log.Printf("Error updating profile: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+func deleteProfileHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	objectID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid profile ID format", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := profileCollection.DeleteOne(ctx, bson.M{"_id": objectID, "userId": userID})
+	if err != nil {
+		log.Printf("Error deleting profile: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if result.DeletedCount == 0 {
+		http.Error(w, "Profile not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Response{Message: "Profile deleted successfully"})
+}
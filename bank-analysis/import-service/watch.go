@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// FolderWatch is the folder a user registered to be imported automatically.
+// Each user watches at most one folder.
+type FolderWatch struct {
+	ID            primitive.ObjectID `json:"id" bson:"_id"`
+	UserID        string             `json:"userId" bson:"userId"`
+	FolderPath    string             `json:"folderPath" bson:"folderPath"` // As requested, see resolveImportFolder
+	Source        string             `json:"source" bson:"source"`
+	Enabled       bool               `json:"enabled" bson:"enabled"`
+	LastCheckedAt *time.Time         `json:"lastCheckedAt,omitempty" bson:"lastCheckedAt,omitempty"`
+	LastJobID     string             `json:"lastJobId,omitempty" bson:"lastJobId,omitempty"` // Latest job started for new or changed files
+	LastError     string             `json:"lastError,omitempty" bson:"lastError,omitempty"` // Why the last check failed, e.g. the folder is gone
+	CreatedAt     time.Time          `json:"createdAt" bson:"createdAt"`
+	UpdatedAt     time.Time          `json:"updatedAt" bson:"updatedAt"`
+}
+
+// WatchedFile records what a watch job last found at a path of the watched
+// folder. Size and ModTime let the poller tell unchanged files without reading
+// them, and Hash keeps a content that was processed once from being parsed
+// again, whatever the file is called.
+type WatchedFile struct {
+	UserID       string    `json:"-" bson:"userId"`
+	Hash         string    `json:"hash" bson:"hash"` // SHA-256 of the file content
+	Path         string    `json:"path" bson:"path"`
+	Size         int64     `json:"size" bson:"size"`
+	ModTime      time.Time `json:"modTime" bson:"modTime"`
+	Status       string    `json:"status" bson:"status"` // "imported", "failed" or "skipped" when the content was processed at another path
+	Format       string    `json:"format,omitempty" bson:"format,omitempty"`
+	Message      string    `json:"message,omitempty" bson:"message,omitempty"` // Why the file was not imported
+	Transactions int       `json:"transactions" bson:"transactions"`           // Transactions read from the file
+	JobID        string    `json:"jobId" bson:"jobId"`
+	BatchID      string    `json:"batchId,omitempty" bson:"batchId,omitempty"`
+	ProcessedAt  time.Time `json:"processedAt" bson:"processedAt"`
+}
+
+const (
+	// defaultWatchInterval is how often watched folders are checked unless IMPORT_WATCH_INTERVAL says otherwise
+	defaultWatchInterval = time.Minute
+	// watchSettleTime leaves files alone while they may still be being written,
+	// e.g. by a browser download
+	watchSettleTime = 10 * time.Second
+	// watchStatusFiles is how many recently processed files the status endpoint lists
+	watchStatusFiles = 50
+)
+
+var watchCollection *mongo.Collection
+var watchedFileCollection *mongo.Collection
+
+// watchInterval reads the polling interval from IMPORT_WATCH_INTERVAL, e.g. "30s"
+func watchInterval() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("IMPORT_WATCH_INTERVAL")); err == nil && d > 0 {
+		return d
+	}
+	return defaultWatchInterval
+}
+
+// watchFolders checks every enabled watch at each interval. It runs for the
+// life of the service.
+func watchFolders() {
+	ticker := time.NewTicker(watchInterval())
+	defer ticker.Stop()
+	for range ticker.C {
+		checkWatches()
+	}
+}
+
+// checkWatches checks all enabled watches once
+func checkWatches() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cursor, err := watchCollection.Find(ctx, bson.M{"enabled": true})
+	if err != nil {
+		log.Printf("Error loading folder watches: %v", err)
+		return
+	}
+	var watches []FolderWatch
+	err = cursor.All(ctx, &watches)
+	cursor.Close(ctx)
+	if err != nil {
+		log.Printf("Error parsing folder watches: %v", err)
+		return
+	}
+
+	for i := range watches {
+		checkWatch(ctx, &watches[i])
+	}
+}
+
+// checkWatch starts a watch job when the folder has files that are new or
+// changed since they were processed. Only one watch job of a user runs at a
+// time; files changed meanwhile are picked up by the next check.
+func checkWatch(ctx context.Context, watch *FolderWatch) {
+	filter := bson.M{"userId": watch.UserID, "kind": "watch", "status": bson.M{"$in": []string{"queued", "running"}}}
+	active, err := jobCollection.CountDocuments(ctx, filter)
+	if err != nil {
+		log.Printf("Error checking watch jobs of %s: %v", watch.UserID, err)
+		return
+	}
+	if active > 0 {
+		return
+	}
+
+	set := bson.M{"lastCheckedAt": time.Now(), "lastError": ""}
+	folder, err := resolveImportFolder(watch.UserID, watch.FolderPath)
+	var pending []string
+	if err == nil {
+		if pending, err = pendingWatchFiles(ctx, watch.UserID, folder); err != nil {
+			log.Printf("Error checking watched folder %s: %v", folder, err)
+			err = fmt.Errorf("Failed to read folder")
+		}
+	}
+	if err != nil {
+		set["lastError"] = err.Error()
+	} else if len(pending) > 0 {
+		// Folders watched by older versions may keep a legacy source
+		job := newJob(watch.UserID, "watch", currentSource(watch.Source))
+		job.FolderPath = folder
+		if err := enqueueJob(ctx, job); err != nil {
+			log.Printf("Error starting watch job for %s: %v", watch.UserID, err)
+			return
+		}
+		log.Printf("Watched folder %s has %d new or changed files, started job %s", folder, len(pending), job.ID.Hex())
+		set["lastJobId"] = job.ID.Hex()
+	}
+
+	if _, err := watchCollection.UpdateByID(ctx, watch.ID, bson.M{"$set": set}); err != nil {
+		log.Printf("Error saving folder watch of %s: %v", watch.UserID, err)
+	}
+}
+
+// pendingWatchFiles lists the files of a watched folder whose size or
+// modification time differ from when they were last seen. Their content may
+// still turn out to be processed already, e.g. after a file was copied.
+func pendingWatchFiles(ctx context.Context, userID, folderPath string) ([]string, error) {
+	files, err := listStatementFiles(folderPath)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := options.Find().SetProjection(bson.M{"path": 1, "size": 1, "modTime": 1})
+	cursor, err := watchedFileCollection.Find(ctx, bson.M{"userId": userID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var seen []WatchedFile
+	err = cursor.All(ctx, &seen)
+	cursor.Close(ctx)
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]WatchedFile, len(seen))
+	for _, f := range seen {
+		known[f.Path] = f
+	}
+
+	var pending []string
+	for _, path := range files {
+		info, err := os.Stat(path)
+		if err != nil || time.Since(info.ModTime()) < watchSettleTime {
+			continue
+		}
+		// Mongo keeps times to the millisecond
+		if f, ok := known[path]; ok && f.Size == info.Size() && f.ModTime.UnixMilli() == info.ModTime().UnixMilli() {
+			continue
+		}
+		pending = append(pending, path)
+	}
+	return pending, nil
+}
+
+// importWatchedFolder imports the new and changed files of a watched folder.
+// A file whose content was processed before is only recorded as seen.
+// Files that can't be parsed are recorded as failed and not retried until
+// their content changes; files that failed to be written are retried.
+func (run *jobRun) importWatchedFolder(ctx context.Context) error {
+	job := run.job
+	folder, err := checkImportFolder(job.UserID, job.FolderPath)
+	if err != nil {
+		return err
+	}
+	files, err := pendingWatchFiles(ctx, job.UserID, folder)
+	if err != nil {
+		log.Printf("Error scanning folder %s: %v", job.FolderPath, err)
+		return fmt.Errorf("Failed to scan folder")
+	}
+	job.FilesTotal = len(files)
+	run.save(true)
+
+	userParsers := loadJobParsers(ctx, job.UserID)
+	for _, filePath := range files {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		info, err := os.Stat(filePath)
+		if err != nil {
+			continue // Removed since the folder was listed
+		}
+		file, err := readStatementFile(job.UserID, filePath)
+		if err != nil {
+			log.Printf("Error reading file %s: %v", filePath, err)
+			run.addError(fmt.Sprintf("%s: %v", filepath.Base(filePath), err))
+			continue
+		}
+		record := WatchedFile{
+			UserID:      job.UserID,
+			Hash:        file.Hash,
+			Path:        filePath,
+			Size:        info.Size(),
+			ModTime:     info.ModTime(),
+			JobID:       job.ID.Hex(),
+			ProcessedAt: time.Now(),
+		}
+
+		var previous WatchedFile
+		filter := bson.M{"userId": job.UserID, "hash": file.Hash, "status": bson.M{"$ne": "skipped"}}
+		err = watchedFileCollection.FindOne(ctx, filter).Decode(&previous)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return err
+		}
+		if err == nil {
+			if previous.Path == filePath {
+				// Touched but not changed, only remember when it was seen
+				previous.Size, previous.ModTime = record.Size, record.ModTime
+				record = previous
+			} else {
+				record.Status, record.Format = "skipped", previous.Format
+				record.Message = "Same content as " + filepath.Base(previous.Path)
+			}
+			recordWatchedFile(ctx, record)
+			job.FilesUnchanged++
+			job.FilesDone++
+			run.save(false)
+			continue
+		}
+
+		batches := len(job.BatchIDs)
+		parsed := job.RowsParsed
+		format, err := run.importStatementFile(ctx, filePath, file, userParsers)
+		if ctx.Err() != nil {
+			// Left for the next check, which imports the file again
+			return ctx.Err()
+		}
+		if err != nil {
+			run.addError(fmt.Sprintf("%s: %v", file.Name, err))
+			if format == "" {
+				record.Status, record.Message = "failed", err.Error()
+				recordWatchedFile(ctx, record)
+			}
+			continue
+		}
+
+		record.Status, record.Format = "imported", format
+		record.Transactions = job.RowsParsed - parsed
+		if len(job.BatchIDs) > batches {
+			record.BatchID = job.BatchIDs[len(job.BatchIDs)-1]
+		}
+		recordWatchedFile(ctx, record)
+		job.FilesDone++
+		run.save(false)
+	}
+	return nil
+}
+
+// recordWatchedFile stores what was last seen at a path of a watched folder
+func recordWatchedFile(ctx context.Context, record WatchedFile) {
+	filter := bson.M{"userId": record.UserID, "path": record.Path}
+	_, err := watchedFileCollection.ReplaceOne(ctx, filter, record, options.Replace().SetUpsert(true))
+	if err != nil {
+		log.Printf("Error recording watched file %s: %v", record.Path, err)
+	}
+}
+
+// watchStatus is returned by the watch endpoints
+type watchStatus struct {
+	Watch   FolderWatch   `json:"watch"`
+	LastJob *ImportJob    `json:"lastJob,omitempty"`
+	Files   []WatchedFile `json:"files"` // Most recently processed files
+}
+
+// getWatchHandler returns the user's watched folder, the job started by its
+// latest check and the files processed most recently
+func getWatchHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var status watchStatus
+	if err := watchCollection.FindOne(ctx, bson.M{"userId": userID}).Decode(&status.Watch); err != nil {
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "No folder is being watched", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error finding folder watch: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if jobID, err := primitive.ObjectIDFromHex(status.Watch.LastJobID); err == nil {
+		var job ImportJob
+		if err := jobCollection.FindOne(ctx, bson.M{"_id": jobID, "userId": userID}).Decode(&job); err == nil {
+			status.LastJob = &job
+		}
+	}
+
+	findOptions := options.Find().SetSort(bson.M{"processedAt": -1}).SetLimit(watchStatusFiles)
+	cursor, err := watchedFileCollection.Find(ctx, bson.M{"userId": userID}, findOptions)
+	if err != nil {
+		log.Printf("Error finding watched files: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	status.Files = []WatchedFile{}
+	if err := cursor.All(ctx, &status.Files); err != nil {
+		log.Printf("Error parsing watched files: %v", err)
+		http.Error(w, "Error parsing results", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// putWatchHandler registers the folder to watch, replacing the user's
+// previous one, and checks it right away
+func putWatchHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		FolderPath string `json:"folderPath"`
+		Source     string `json:"source"`
+		Enabled    *bool  `json:"enabled"` // Defaults to true
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.FolderPath == "" {
+		http.Error(w, "Folder path is required", http.StatusBadRequest)
+		return
+	}
+	// The folder is resolved again at every check, it may be moved or replaced
+	if _, err := resolveImportFolder(userID, req.FolderPath); err != nil {
+		status := http.StatusBadRequest
+		if err == errFolderNotAllowed {
+			status = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if err := checkSource(req.Source); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Source == "" {
+		req.Source = defaultSource
+	}
+	enabled := req.Enabled == nil || *req.Enabled
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	update := bson.M{
+		"$set": bson.M{
+			"folderPath": req.FolderPath,
+			"source":     req.Source,
+			"enabled":    enabled,
+			"lastError":  "",
+			"updatedAt":  now,
+		},
+		"$setOnInsert": bson.M{"_id": primitive.NewObjectID(), "createdAt": now},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var watch FolderWatch
+	if err := watchCollection.FindOneAndUpdate(ctx, bson.M{"userId": userID}, update, opts).Decode(&watch); err != nil {
+		log.Printf("Error saving folder watch: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if watch.Enabled {
+		go func() {
+			checkCtx, checkCancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer checkCancel()
+			checkWatch(checkCtx, &watch)
+		}()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(watch)
+}
+
+// deleteWatchHandler stops watching the user's folder. The record of
+// processed files is kept, so watching the folder again doesn't reparse them.
+func deleteWatchHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := watchCollection.DeleteOne(ctx, bson.M{"userId": userID})
+	if err != nil {
+		log.Printf("Error deleting folder watch: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if result.DeletedCount == 0 {
+		http.Error(w, "No folder is being watched", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Response{Message: "Folder watch removed"})
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxWorkbookPartSize bounds how much of one workbook part is decompressed
+	maxWorkbookPartSize = 64 << 20
+	// maxWorkbookSize bounds the total size of the parts of a workbook
+	maxWorkbookSize = 256 << 20
+)
+
+// errWorkbookTooLarge stops reading a workbook once its parts exceed maxWorkbookSize
+var errWorkbookTooLarge = fmt.Errorf("Workbook expands to more than %d MB", maxWorkbookSize>>20)
+
+// cellKind tells how a workbook cell stores its value
+type cellKind int
+
+const (
+	cellText cellKind = iota
+	cellNumber
+	cellDate
+)
+
+// workbookCell is a cell of a worksheet. Numbers and dates keep their value
+// so they can be written the same way the file's text cells are.
+type workbookCell struct {
+	Kind   cellKind
+	Text   string
+	Number float64
+	Date   time.Time
+}
+
+// workbookRow is a row of a worksheet; Line is its row number in Excel
+type workbookRow struct {
+	Line  int
+	Cells []workbookCell
+}
+
+type worksheet struct {
+	Name string
+	Rows []workbookRow
+}
+
+// The parts of SpreadsheetML the importer reads
+type xlsxWorkbook struct {
+	Properties struct {
+		Date1904 bool `xml:"date1904,attr"`
+	} `xml:"workbookPr"`
+	Sheets []struct {
+		Name  string `xml:"name,attr"`
+		RelID string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+type xlsxRelationships struct {
+	Relationships []struct {
+		ID     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+type xlsxSharedStrings struct {
+	Items []struct {
+		Text string `xml:"t"`
+		Runs []struct {
+			Text string `xml:"t"`
+		} `xml:"r"`
+	} `xml:"si"`
+}
+
+type xlsxStyles struct {
+	NumFmts []struct {
+		ID   int    `xml:"numFmtId,attr"`
+		Code string `xml:"formatCode,attr"`
+	} `xml:"numFmts>numFmt"`
+	CellXfs []struct {
+		NumFmtID int `xml:"numFmtId,attr"`
+	} `xml:"cellXfs>xf"`
+}
+
+type xlsxSheet struct {
+	Rows []struct {
+		Number int `xml:"r,attr"`
+		Cells  []struct {
+			Ref    string `xml:"r,attr"`
+			Style  int    `xml:"s,attr"`
+			Type   string `xml:"t,attr"`
+			Value  string `xml:"v"`
+			Inline struct {
+				Text string `xml:"t"`
+				Runs []struct {
+					Text string `xml:"t"`
+				} `xml:"r"`
+			} `xml:"is"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+// isWorkbookFile reports whether the file name has an Excel workbook extension
+func isWorkbookFile(filename string) bool {
+	ext := strings.ToLower(filepath.Ext(filename))
+	return ext == ".xlsx" || ext == ".xlsm"
+}
+
+// builtinDateFormats are the number format IDs Excel predefines for dates
+var builtinDateFormats = map[int]bool{
+	14: true, 15: true, 16: true, 17: true, 18: true, 19: true, 20: true, 21: true, 22: true,
+	45: true, 46: true, 47: true,
+}
+
+// formatLiterals matches the parts of a number format that are not placeholders:
+// quoted text, [colors] and [conditions], and escaped characters
+var formatLiterals = regexp.MustCompile(`"[^"]*"|\[[^\]]*\]|\\.`)
+
+// isDateFormat reports whether a custom number format displays a date
+func isDateFormat(code string) bool {
+	code = strings.ToLower(formatLiterals.ReplaceAllString(code, ""))
+	return strings.ContainsAny(code, "dy")
+}
+
+// workbook is an opened .xlsx file. The parts every sheet needs are read
+// when it is opened, a worksheet only when it is asked for.
+type workbook struct {
+	parts      map[string]*zip.File
+	budget     int64    // Bytes that may still be decompressed
+	names      []string // Sheet names in workbook order
+	sheetParts []string // Part holding each sheet
+	strs       []string
+	dateStyles []bool
+	epoch      time.Time
+}
+
+// openWorkbook opens an .xlsx file and reads its sheet list, shared strings
+// and styles. Like uploaded archives, the workbook is rejected when its parts
+// declare more than maxWorkbookSize, and reading stops once that much was
+// actually decompressed.
+func openWorkbook(data []byte) (*workbook, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open workbook")
+	}
+	wb := &workbook{parts: make(map[string]*zip.File), budget: maxWorkbookSize}
+	var total uint64
+	for _, f := range archive.File {
+		wb.parts[strings.TrimPrefix(f.Name, "/")] = f
+		total += f.UncompressedSize64
+		if total > maxWorkbookSize {
+			return nil, errWorkbookTooLarge
+		}
+	}
+
+	var info xlsxWorkbook
+	var rels xlsxRelationships
+	var shared xlsxSharedStrings
+	var styles xlsxStyles
+	for _, part := range []struct {
+		name string
+		v    interface{}
+	}{
+		{"xl/workbook.xml", &info},
+		{"xl/_rels/workbook.xml.rels", &rels},
+		{"xl/sharedStrings.xml", &shared},
+		{"xl/styles.xml", &styles},
+	} {
+		if err := wb.readPart(part.name, part.v); err != nil {
+			log.Printf("ERROR: Failed to read workbook part %s: %v", part.name, err)
+			if errors.Is(err, errWorkbookTooLarge) {
+				return nil, err
+			}
+			return nil, fmt.Errorf("Failed to read workbook")
+		}
+	}
+
+	wb.strs = make([]string, len(shared.Items))
+	for i, item := range shared.Items {
+		wb.strs[i] = item.Text
+		for _, run := range item.Runs {
+			wb.strs[i] += run.Text
+		}
+	}
+
+	customDates := make(map[int]bool)
+	for _, f := range styles.NumFmts {
+		customDates[f.ID] = isDateFormat(f.Code)
+	}
+	wb.dateStyles = make([]bool, len(styles.CellXfs))
+	for i, xf := range styles.CellXfs {
+		wb.dateStyles[i] = builtinDateFormats[xf.NumFmtID] || customDates[xf.NumFmtID]
+	}
+
+	// Excel counts days from 1899-12-30, which absorbs its 1900 leap year bug
+	wb.epoch = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+	if info.Properties.Date1904 {
+		wb.epoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	targets := make(map[string]string)
+	for _, rel := range rels.Relationships {
+		target := rel.Target
+		if strings.HasPrefix(target, "/") {
+			target = strings.TrimPrefix(target, "/")
+		} else {
+			target = path.Join("xl", target)
+		}
+		targets[rel.ID] = target
+	}
+	for _, s := range info.Sheets {
+		wb.names = append(wb.names, s.Name)
+		wb.sheetParts = append(wb.sheetParts, targets[s.RelID])
+	}
+	return wb, nil
+}
+
+// readPart decompresses and decodes a part of the workbook, charging it to
+// the budget. A missing part leaves v untouched.
+func (wb *workbook) readPart(name string, v interface{}) error {
+	f, ok := wb.parts[name]
+	if !ok {
+		return nil
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	limit := wb.budget
+	if limit > maxWorkbookPartSize {
+		limit = maxWorkbookPartSize
+	}
+	content, err := io.ReadAll(io.LimitReader(rc, limit+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(content)) > wb.budget {
+		return errWorkbookTooLarge
+	}
+	if len(content) > maxWorkbookPartSize {
+		return fmt.Errorf("%s is too large", name)
+	}
+	wb.budget -= int64(len(content))
+	return xml.Unmarshal(content, v)
+}
+
+// readSheet decodes the i-th worksheet of the workbook
+func (wb *workbook) readSheet(i int) (worksheet, error) {
+	name := wb.names[i]
+	var sheet xlsxSheet
+	if err := wb.readPart(wb.sheetParts[i], &sheet); err != nil {
+		log.Printf("ERROR: Failed to read sheet %s: %v", name, err)
+		if errors.Is(err, errWorkbookTooLarge) {
+			return worksheet{}, err
+		}
+		return worksheet{}, fmt.Errorf("Failed to read sheet %s", name)
+	}
+
+	ws := worksheet{Name: name}
+	for i, r := range sheet.Rows {
+		row := workbookRow{Line: r.Number}
+		if row.Line == 0 {
+			row.Line = i + 1
+		}
+		for j, c := range r.Cells {
+			col := j
+			if ref := cellColumn(c.Ref); ref != -1 {
+				col = ref
+			}
+			for len(row.Cells) <= col {
+				row.Cells = append(row.Cells, workbookCell{})
+			}
+
+			cell := workbookCell{Text: c.Value}
+			switch c.Type {
+			case "s":
+				if n, err := strconv.Atoi(c.Value); err == nil && n >= 0 && n < len(wb.strs) {
+					cell.Text = wb.strs[n]
+				}
+			case "inlineStr":
+				cell.Text = c.Inline.Text
+				for _, run := range c.Inline.Runs {
+					cell.Text += run.Text
+				}
+			case "d":
+				if date, err := time.Parse("2006-01-02", dateOnly(strings.Replace(c.Value, "T", " ", 1))); err == nil {
+					cell.Kind, cell.Date = cellDate, date
+				}
+			case "", "n":
+				n, err := strconv.ParseFloat(c.Value, 64)
+				if err != nil {
+					break
+				}
+				if c.Style >= 0 && c.Style < len(wb.dateStyles) && wb.dateStyles[c.Style] {
+					cell.Kind, cell.Date = cellDate, wb.epoch.AddDate(0, 0, int(math.Floor(n)))
+				} else {
+					cell.Kind, cell.Number = cellNumber, n
+				}
+			}
+			row.Cells[col] = cell
+		}
+		ws.Rows = append(ws.Rows, row)
+	}
+	return ws, nil
+}
+
+// cellColumn returns the zero-based column of a reference such as "C12"
+func cellColumn(ref string) int {
+	col := 0
+	n := 0
+	for _, r := range ref {
+		if r < 'A' || r > 'Z' {
+			break
+		}
+		col = col*26 + int(r-'A') + 1
+		n++
+	}
+	if n == 0 {
+		return -1
+	}
+	return col - 1
+}
+
+// texts returns the cells as strings, leaving out numbers and dates when
+// textOnly is set so they don't take part in locale detection
+func (r workbookRow) texts(textOnly bool) []string {
+	values := make([]string, len(r.Cells))
+	for i, c := range r.Cells {
+		if c.Kind == cellText || !textOnly {
+			values[i] = c.Text
+		}
+	}
+	return values
+}
+
+// render writes the row's cells as text the profile can parse, numbers and
+// dates following the locale decided for the sheet
+func (r workbookRow) render(locale csvLocale) []string {
+	values := make([]string, len(r.Cells))
+	for i, c := range r.Cells {
+		switch c.Kind {
+		case cellDate:
+			values[i] = c.Date.Format(locale.DateLayout)
+		case cellNumber:
+			values[i] = strconv.FormatFloat(c.Number, 'f', -1, 64)
+			if locale.DecimalSeparator == "," {
+				values[i] = strings.Replace(values[i], ".", ",", 1)
+			}
+		default:
+			values[i] = c.Text
+		}
+	}
+	return values
+}
+
+// joinRow writes cells as a comma separated line for rejected row reports
+func joinRow(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = quoteCSVField(v, ',')
+	}
+	return strings.Join(quoted, ",")
+}
+
+// workbookParser reads Excel workbooks with the CSV bank profiles: the chosen
+// sheet, or the first one with a header a profile understands, is turned into
+// rows and converted like a CSV file
+type workbookParser struct {
+	Sheet    string         // Name of the sheet to import, empty picks one
+	Profiles []*BankProfile // Profiles tried on each sheet, nil for the built-in ones
+}
+
+func (workbookParser) Name() string { return "xlsx" }
+
+func (workbookParser) Detect(filename string, head []byte) bool {
+	return isWorkbookFile(filename) || (bytes.HasPrefix(head, []byte("PK\x03\x04")) && bytes.Contains(head, []byte("xl/")))
+}
+
+func (p workbookParser) Parse(file io.Reader, userID, source string) (ParseResult, error) {
+	data, err := io.ReadAll(file)
+	if err != nil {
+		log.Printf("ERROR: Failed to read workbook: %v", err)
+		return ParseResult{}, fmt.Errorf("Failed to read workbook")
+	}
+	wb, err := openWorkbook(data)
+	if err != nil {
+		return ParseResult{}, err
+	}
+
+	profiles := p.Profiles
+	if profiles == nil {
+		profiles = bankProfiles
+	}
+
+	// Sheets are decoded one at a time, only the asked for one when a name is given
+	for i, name := range wb.names {
+		if p.Sheet != "" && !strings.EqualFold(name, p.Sheet) {
+			continue
+		}
+		sheet, err := wb.readSheet(i)
+		if err != nil {
+			return ParseResult{}, err
+		}
+		for _, profile := range profiles {
+			if result, ok, err := profile.parseSheet(sheet, userID, source); ok {
+				return result, err
+			}
+		}
+		if p.Sheet != "" {
+			return ParseResult{}, fmt.Errorf("Sheet %s has no header a bank profile understands", sheet.Name)
+		}
+	}
+
+	if p.Sheet != "" {
+		return ParseResult{}, fmt.Errorf("Sheet %s not found, the workbook has: %s", p.Sheet, strings.Join(wb.names, ", "))
+	}
+	return ParseResult{}, fmt.Errorf("No sheet has a header a bank profile understands")
+}
+
+// parseSheet converts a worksheet whose header the profile understands. The
+// header may come after preamble rows, as in CSV files. ok is false when the
+// profile doesn't match the sheet.
+func (p *BankProfile) parseSheet(sheet worksheet, userID, source string) (result ParseResult, ok bool, err error) {
+	start := -1
+	var cols csvColumns
+	for i, row := range sheet.Rows {
+		if i == maxPreambleLines {
+			break
+		}
+		if cols, ok = p.resolveColumns(row.texts(false)); ok {
+			start = i
+			break
+		}
+	}
+	if start == -1 {
+		return ParseResult{}, false, nil
+	}
+	log.Printf("Sheet %s header: %v (profile %s)", sheet.Name, sheet.Rows[start].texts(false), p.ID)
+
+	var rows []workbookRow
+	var texts [][]string
+	for _, row := range sheet.Rows[start+1:] {
+		if strings.TrimSpace(strings.Join(row.texts(false), "")) == "" {
+			continue
+		}
+		rows = append(rows, row)
+		texts = append(texts, row.texts(true))
+	}
+
+	// Numbers and dates stored natively carry no locale, only text cells need one
+	locale, err := p.detectLocale(texts, cols)
+	if err != nil {
+		log.Printf("ERROR: %v (sheet %s, profile %s)", err, sheet.Name, p.ID)
+		return ParseResult{}, true, err
+	}
+
+	records := make([]csvRecord, len(rows))
+	for i, row := range rows {
+		values := row.render(locale)
+		records[i] = csvRecord{row: values, raw: joinRow(values), line: row.Line}
+	}
+
+	result = ParseResult{
+		Format: "xlsx:" + p.ID,
+		Header: joinRow(sheet.Rows[start].texts(false)),
+	}
+	result.Transactions, result.Skipped = p.convertRecords(records, cols, locale, userID, source)
+	return result, true, nil
+}
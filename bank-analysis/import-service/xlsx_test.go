@@ -0,0 +1,138 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestWorkbookSheets checks the Itaú fixture: without a sheet name the
+// "Extrato" sheet is found behind the summary, and a named sheet is used as
+// asked even when it holds no statement.
+func TestWorkbookSheets(t *testing.T) {
+	data, err := os.ReadFile("testdata/xlsx/itau_two_sheets.xlsx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		sheet string
+		rows  int
+		err   string
+	}{
+		{sheet: "", rows: 3},
+		{sheet: "extrato", rows: 3},
+		{sheet: "Resumo", err: "Sheet Resumo has no header a bank profile understands"},
+		{sheet: "Saldo", err: "Sheet Saldo not found, the workbook has: Resumo, Extrato"},
+	}
+	for _, tt := range tests {
+		t.Run("sheet="+tt.sheet, func(t *testing.T) {
+			result, err := workbookParser{Sheet: tt.sheet}.Parse(bytes.NewReader(data), "user@example.com", defaultSource)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Format != "xlsx:itau" || len(result.Transactions) != tt.rows || len(result.Skipped) != 0 {
+				t.Errorf("%s with %d rows and %d skipped, want xlsx:itau with %d rows", result.Format, len(result.Transactions), len(result.Skipped), tt.rows)
+			}
+		})
+	}
+
+	// The text typed row reads the same as the native dates and numbers
+	result, err := workbookParser{}.Parse(bytes.NewReader(data), "user@example.com", defaultSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		date, description string
+		amount            float64
+		transType         string
+	}{
+		{"2024-03-04", "PAG BOLETO CONDOMÍNIO", 1234.56, "debit"},
+		{"2024-03-06", "SALÁRIO", 5000, "credit"},
+		{"2024-03-08", "CARTÃO DÉBITO AÇOUGUE", 89.90, "debit"},
+	}
+	for i, w := range want {
+		got := result.Transactions[i]
+		if got.Date.Format("2006-01-02") != w.date || got.Description != w.description || got.Amount != w.amount || got.Type != w.transType {
+			t.Errorf("row %d: %s %q %.2f %s, want %s %q %.2f %s", i+1,
+				got.Date.Format("2006-01-02"), got.Description, got.Amount, got.Type, w.date, w.description, w.amount, w.transType)
+		}
+	}
+}
+
+// TestWorkbookReadsOnlyChosenSheet breaks the summary sheet of the fixture
+// and checks naming the other sheet never decodes it
+func TestWorkbookReadsOnlyChosenSheet(t *testing.T) {
+	data, err := os.ReadFile("testdata/xlsx/itau_two_sheets.xlsx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, f := range archive.File {
+		part, err := w.Create(f.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Name == "xl/worksheets/sheet1.xml" {
+			part.Write([]byte("<worksheet><sheetData><row>"))
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(part, rc)
+		rc.Close()
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	broken := buf.Bytes()
+
+	if _, err := (workbookParser{}).Parse(bytes.NewReader(broken), "user@example.com", defaultSource); err == nil || !strings.Contains(err.Error(), "Resumo") {
+		t.Errorf("got error %v, want the summary sheet reported", err)
+	}
+	if _, err := (workbookParser{Sheet: "Extrato"}).Parse(bytes.NewReader(broken), "user@example.com", defaultSource); err != nil {
+		t.Errorf("Extrato failed: %v", err)
+	}
+}
+
+// TestWorkbookBudget checks sheets are charged against the size left for the
+// whole workbook, not only against the limit of one part
+func TestWorkbookBudget(t *testing.T) {
+	data, err := os.ReadFile("testdata/xlsx/itau_two_sheets.xlsx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb, err := openWorkbook(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wb.budget >= maxWorkbookSize {
+		t.Errorf("budget %d after reading the shared parts, want it charged", wb.budget)
+	}
+
+	// Enough for the summary sheet but not for the statement after it
+	wb.budget = 400
+	if _, err := wb.readSheet(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wb.readSheet(1); !errors.Is(err, errWorkbookTooLarge) {
+		t.Errorf("got error %v, want %v", err, errWorkbookTooLarge)
+	}
+}